@@ -21,42 +21,167 @@ package ristretto
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/ristretto/z"
 )
 
 const (
-	// TODO: find the optimal value for this or make it configurable
+	// setBufSize is the default Config.SetBufferSize.
 	setBufSize = 32 * 1024
+	// setWorkerBufSize is the size of the buffer of every Set worker, when
+	// there's more than one.
+	setWorkerBufSize = 64
+	// maxCapacityBackoff is the longest SetWaitCapacity sleeps between checks
+	// for room.
+	maxCapacityBackoff = 50 * time.Millisecond
+	// sweepInterval is how often expired items are purged.
+	sweepInterval = time.Second
+	// snapshotTimeout is how long GetSnapshot waits to lock the keys together.
+	snapshotTimeout = 10 * time.Millisecond
+	// rateInterval is how often the Metrics counters are snapshotted for
+	// Metrics.Rates.
+	rateInterval = time.Second
+	// rateSnapshots is the number of snapshots kept for Metrics.Rates, so it
+	// covers up to a minute.
+	rateSnapshots = 60
 )
 
 // Cache is a thread-safe implementation of a hashmap with a TinyLFU admission
 // policy and a Sampled LFU eviction policy. You can use the same Cache instance
 // from as many goroutines as you want.
+//
+// A nil *Cache is a valid, always empty cache: every method is a no-op (reads
+// miss and writes are dropped), so a nil cache can stand for caching being
+// disabled.
+// The same goes for a nil *Metrics, which is what the Metrics field of a cache
+// created without Config.Metrics holds.
 type Cache struct {
+	// heartbeat is the UnixNano time processItems last started waiting for or
+	// processing an item. It's kept first for 64-bit alignment of atomic ops.
+	heartbeat int64
 	// store is the central concurrent hashmap where key-value items are stored
 	store store
 	// policy determines what gets let in to the cache and what gets kicked out
 	policy policy
 	// getBuf is a custom ring buffer implementation that gets pushed to when
-	// keys are read
+	// keys are read (nil if Config.DisableGetBuffer is set)
 	getBuf *ringBuffer
 	// setBuf is a buffer allowing us to batch/drop Sets during times of high
 	// contention
 	setBuf chan *item
 	// onEvict is called for item evictions
-	onEvict func(uint64, interface{}, int64)
+	onEvict func(*Item)
+	// onAdmit is called for items admitted by the policy
+	onAdmit func(uint64, interface{}, int64)
+	// onLargeEvict is called for items evicted with a cost over
+	// largeEvictThreshold
+	onLargeEvict        func(uint64, interface{}, int64)
+	largeEvictThreshold int64
+	// maxCostPerItem, if not zero, is the largest cost of an item
+	maxCostPerItem int64
+	// evictPool, if not nil, runs onEvict asynchronously
+	evictPool *evictPool
+	// evictBatcher, if not nil, passes evictions to OnEvictBatch in batches
+	evictBatcher *evictBatcher
+	// valueEncoder transforms []byte values before they're stored
+	valueEncoder func([]byte) ([]byte, error)
+	// valueDecoder reverses valueEncoder when values are read
+	valueDecoder func([]byte) ([]byte, error)
+	// cloneValue copies values returned by Get
+	cloneValue func(interface{}) interface{}
+	// mirror, if not nil, receives a copy of every Set and Del
+	mirror *Cache
+	// loads single-flights (and bounds the concurrency of) the loaders passed
+	// to GetFresh and GetOrSet, and the calls to loader
+	loads flightGroup
+	// loader loads missing keys for GetOrLoad
+	loader func(interface{}) (interface{}, int64, error)
+	// altKeys maps the key hash of items Set with SetWithAltKey to the hash of
+	// their alternate key. It's only used by the goroutines processing Sets (or
+	// while they're stopped), guarded by procStateMu.
+	altKeys map[uint64]uint64
+	// procStateMu guards the state shared by the Set workers, when there's
+	// more than one
+	procStateMu sync.Mutex
+	// setWorkers is the number of goroutines processing the Set buffer
+	setWorkers int
 	// KeyToHash function is used to customize the key hashing algorithm.
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
 	keyToHash func(interface{}, uint8) uint64
 	// stop is used to stop the processItems goroutine
 	stop chan struct{}
+	// done is closed by the running processItems goroutine when it returns
+	done chan struct{}
+	// procMu guards starting and stopping the processItems goroutine
+	procMu sync.Mutex
+	// paused is true while processItems is stopped by Pause
+	paused bool
+	// reclaim signals processItems to release items due to memory pressure
+	reclaim chan struct{}
+	// softMemoryLimit is the heap size above which items are reclaimed
+	softMemoryLimit uint64
+	// sweep signals processItems to purge expired items
+	sweep chan struct{}
+	// closing is closed by Close, which stops the goroutine sending the sweep
+	// signals and unblocks writes waiting for room in the Set buffer
+	closing chan struct{}
+	// closed is set to 1 by Close, after which Sets, Gets and Dels fail
+	closed int32
+	// clearing is set to 1 while Clear runs
+	clearing int32
+	// clearSets counts the Sets rejected while clearing, to add to the metrics
+	// once they have been cleared
+	clearSets uint64
+	// defaultTTL is the TTL of items Set without one
+	defaultTTL time.Duration
+	// maxLifetime is how long after creation or the last Clear the cache is
+	// cleared again, and lifetime is the timer doing it
+	maxLifetime time.Duration
+	lifetime    *time.Timer
+	// shadow holds a *shadowStore with the contents of the cache before the
+	// last ClearWithShadow, until DropShadow is called
+	shadow atomic.Value
 	// cost calculates cost from a value
 	cost func(value interface{}) int64
+	// drainOnClear is true when Clear should apply buffered items instead of
+	// dropping them
+	drainOnClear bool
+	// rejectSetsOnClear is true when Sets should fail while Clear runs
+	rejectSetsOnClear bool
+	// recostOnGet is true when the cost function should be re-run on each Get
+	recostOnGet bool
+	// includeKeyCost is true when an estimate of the key size should be added
+	// to each item's cost
+	includeKeyCost bool
+	// skipNoopUpdates is true when updates that don't change the stored value
+	// shouldn't be passed on to the policy
+	skipNoopUpdates bool
+	// valueEqual compares the old and new values of an update
+	valueEqual func(a, b interface{}) bool
+	// onFirstItem is called when the cache goes from empty to non-empty
+	onFirstItem func()
+	// onPanic is called for panics recovered from callbacks
+	onPanic func(interface{})
+	// onEmpty is called when the cache goes from non-empty to empty
+	onEmpty func()
+	// empty is the last emptiness state reported to onFirstItem/onEmpty, only
+	// accessed by the goroutines processing Sets (or Clear while they're
+	// stopped), guarded by procStateMu
+	empty bool
+	// config is the Config the cache was created with, with defaults applied
+	config Config
 	// Metrics contains a running log of important statistics like hits, misses,
 	// and dropped items
 	Metrics *Metrics
@@ -82,6 +207,21 @@ type Config struct {
 	// eviction process will take care of making room for the new item and not
 	// overflowing the MaxCost value.
 	MaxCost int64
+	// MaxCostPerItem, if not zero, is the largest cost a single item can have.
+	// Items with a higher cost are rejected when they're processed, before
+	// reaching the policy, and counted by Metrics.SetsRejectedOversize; an
+	// update to such a cost removes the key. Items with a cost over MaxCost are
+	// always rejected (and counted the same), but a lower limit keeps a few
+	// outliers from evicting most of the cache to make room for themselves.
+	MaxCostPerItem int64
+	// MaxItems, if not zero, caps the number of items in the cache, in addition
+	// to MaxCost. Adding a new key to a full cache evicts (or, if the new key is
+	// accessed less than the sampled victims, rejects) like going over MaxCost
+	// does. It's meant for caches of small uniform values, where counting items
+	// is more natural than summing costs: set MaxCost high enough to never be
+	// the limit, or give every item a cost of 1. MinRetainedItems takes
+	// precedence, and it isn't supported with a custom Policy.
+	MaxItems int64
 	// BufferItems determines the size of Get buffers.
 	//
 	// Unless you have a rare use case, using `64` as the BufferItems value
@@ -92,17 +232,65 @@ type Config struct {
 	// only set this flag to true when testing or throughput performance isn't a
 	// major factor.
 	Metrics bool
-	// OnEvict is called for every eviction and passes the hashed key, value,
-	// and cost to the function.
-	OnEvict func(key uint64, value interface{}, cost int64)
+	// MetricsSink, if not nil, is passed cache events as they happen instead of
+	// keeping the built-in Metrics counters, so they can go straight into an
+	// existing metrics system. Metrics is ignored when it's set, and the
+	// Cache.Metrics counters all stay 0.
+	MetricsSink MetricsSink
+	// OnEvict is called for every item removed from the cache, whether it's
+	// evicted to make room, expired, deleted with Del or removed by Clear.
+	// Item.Reason tells them apart, so for example only capacity evictions
+	// can be written back to a slower store. Del and Clear call it too, Clear
+	// once for each item in the cache before it returns, so it may Set or Del
+	// keys of the cache but not call Clear.
+	//
+	// OnEvict used to take the hashed key, value and cost as arguments, which
+	// are now Item.Key, Item.Value and Item.Cost. Callbacks written for the old
+	// signature only need to take the item instead, and check that its Reason
+	// is EvictCapacity or EvictExpired to keep seeing just evictions.
+	OnEvict func(item *Item)
+	// OnAdmit is called for every new item admitted by the policy, with its
+	// hashed key, value and cost, which can be used to keep track of what's in
+	// the cache (along with OnEvict). It runs on the goroutine processing Sets,
+	// so it should be quick as it holds up every other Set.
+	OnAdmit func(key uint64, value interface{}, cost int64)
+	// OnLargeEvict is called for items evicted to make room (or because of
+	// memory pressure) whose cost is over LargeEvictThreshold, with their
+	// hashed key, value and cost. This singles out big, expensive to recompute
+	// items being dropped, which means the cache is too small for the large
+	// tail of the workload. Expired, deleted or cleared items aren't passed.
+	// It runs on the goroutine processing Sets, so it should be quick.
+	OnLargeEvict        func(key uint64, value interface{}, cost int64)
+	LargeEvictThreshold int64
 	// KeyToHash function is used to customize the key hashing algorithm.
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
 	KeyToHash func(key interface{}, seed uint8) uint64
 	// Cost evaluates a value and outputs a corresponding cost. This function
 	// is ran after Set is called for a new item or an item update with a cost
-	// param of 0.
+	// param of 0. When it's nil, values implementing Sizer cost their Size.
+	//
+	// The cost of an item is, in order of precedence: the cost passed to Set
+	// if it isn't 0, then the result of Cost, then the Size of a Sizer, then
+	// the estimate of AutoCost or LenCost if either is set, and otherwise 0.
 	Cost func(value interface{}) int64
+	// AutoCost, when Cost is nil, estimates the cost of values Set with a cost
+	// of 0 (that don't implement Sizer) as their size in bytes, using
+	// reflection. Strings count their length, slices and arrays their length
+	// times the element size, and maps their number of entries times the key
+	// and element sizes, on top of the size of the value itself.
+	//
+	// This is a best-effort, shallow estimate: memory referenced through
+	// pointers (including the contents of nested strings, slices and maps) isn't
+	// counted. It's better than every item costing 0, but a Cost function
+	// written for the values being cached will always be more accurate.
+	AutoCost bool
+	// LenCost, when Cost is nil, sets the cost of values Set with a cost of 0
+	// (that don't implement Sizer) to their length if they're a []byte or a
+	// string, and to 1 otherwise. It suits caches of byte slices or strings,
+	// where the cost is just the length of the value, without having to pass it
+	// to every Set. It can't be set along with AutoCost.
+	LenCost bool
 	// Hashes is the number of 64-bit hashes to chain and use as each item's
 	// unique identifier. For example, setting Hashes to 2 will set internal
 	// keys to 128-bits and therefore very little probability of colliding with
@@ -111,200 +299,2570 @@ type Config struct {
 	//
 	// The larger this value is, the worse throughput performance will be.
 	Hashes uint8
+	// DrainOnClear makes Clear apply every item still waiting in the Set
+	// buffer before clearing the cache rather than dropping it, so a Set that
+	// returned true before the Clear is always considered by the policy (and
+	// if admitted, then removed by the Clear and passed to OnEvict like any
+	// other item).
+	//
+	// Clear blocks while the buffered items are processed (in FIFO order), so
+	// with a full buffer this adds the cost of processing up to 32 * 1024 items
+	// to the latency of Clear.
+	DrainOnClear bool
+	// RejectSetsOnClear makes Sets called while Clear is running return false
+	// (counted by Metrics.SetsRejectedOnClear) instead of racing with it, so
+	// callers know to retry once the Clear is done. Sets that started before
+	// the Clear are still dropped by it, unless DrainOnClear is set.
+	RejectSetsOnClear bool
+	// RecostOnGet re-runs the Cost function on every successful Get and updates
+	// the policy if the value's cost has changed since it was last computed.
+	// This keeps the cache's cost accounting accurate for values that grow or
+	// shrink between accesses, at the price of running Cost on the read path.
+	// It has no effect if Cost is nil.
+	RecostOnGet bool
+	// SkipNoopUpdates drops updates of existing keys before they reach the
+	// policy when the new value equals the stored one (and the cost wouldn't
+	// change either). This avoids needless policy work and Cost calls for
+	// workloads that repeatedly Set the same value, such as periodic refreshes
+	// of configuration that rarely changes.
+	SkipNoopUpdates bool
+	// ValueEqual is used by SkipNoopUpdates to compare the stored and new
+	// values. If nil, []byte values are compared with bytes.Equal and anything
+	// else with reflect.DeepEqual.
+	ValueEqual func(a, b interface{}) bool
+	// OnFirstItem is called when the number of items in the cache goes from
+	// zero to non-zero, and OnEmpty when it drops back to zero (including on
+	// Clear). They're useful for lazily starting and stopping resources that
+	// only make sense while the cache holds data.
+	//
+	// To avoid thrashing when the item count hovers around zero, the item
+	// count is only checked once the Set buffer has been fully processed, so
+	// a burst of Sets and Dels that empties and refills the cache doesn't
+	// trigger either callback. Both are run on the goroutine processing Sets
+	// and should return quickly.
+	OnFirstItem func()
+	OnEmpty     func()
+	// OnPanic, if not nil, is called with the value recovered from a panic in
+	// a callback: Cost, ValueEqual and KeyToHash while a Set is processed, and
+	// OnEvict, OnEvictBatch, OnAdmit, OnLargeEvict, OnFirstItem and OnEmpty.
+	// Such panics are always recovered and counted by Metrics.CallbackPanics,
+	// so a bad value can't stop the cache from processing Sets: the item being
+	// processed is dropped if Cost or ValueEqual panics, and the rest of the
+	// eviction callbacks are skipped. OnPanic itself mustn't panic.
+	OnPanic func(recovered interface{})
+	// StoreKeys retains the original (unhashed) key of every item alongside its
+	// value. This costs memory and keeps keys reachable, but is required by
+	// methods that need to know the keys, such as GetByPrefix and Export, and
+	// for the items passed to OnEvict to carry their Item.OriginalKey. Gets
+	// then also compare the stored key, so keys with the same hash are told
+	// apart.
+	StoreKeys bool
+	// OnEvictAsync runs OnEvict on a pool of worker goroutines rather than on
+	// the goroutine processing Sets, so slow callbacks don't stall admission.
+	// Evictions are queued while all workers are busy and dropped (counted by
+	// Metrics.EvictionsDropped) if the queue is full as well.
+	OnEvictAsync bool
+	// OnEvictConcurrency is the number of OnEvict workers used when
+	// OnEvictAsync is set. It defaults to GOMAXPROCS when 0.
+	OnEvictConcurrency int
+	// ValueEncoder and ValueDecoder transform []byte values on the way in (Set)
+	// and out (Get) of the cache, for example to keep sensitive data encrypted
+	// while it's held in memory. Values of any other type are stored as is.
+	// Costs computed by the Cost function are based on the encoded form.
+	//
+	// Both functions run on the calling goroutine for every Set and Get of a
+	// []byte value, so their CPU cost is added directly to the hot path. A Set
+	// whose value fails to encode returns false, and a Get whose value fails to
+	// decode is treated as a miss.
+	ValueEncoder func([]byte) ([]byte, error)
+	ValueDecoder func([]byte) ([]byte, error)
+	// OnEvictBatch is called with batches of evicted items, which lets a
+	// downstream store (such as an L2 cache for demoted items) do bulk writes
+	// instead of a round trip per eviction. It can be used along with or
+	// instead of OnEvict and is always run on its own goroutine.
+	//
+	// A batch is delivered once EvictBatchSize items have accumulated or
+	// EvictBatchWindow has passed since the last delivery, whichever comes
+	// first. They default to 64 items and 100ms, respectively. Evictions that
+	// can't be queued for batching are counted by Metrics.EvictionsDropped.
+	OnEvictBatch     func(items []*Item)
+	EvictBatchSize   int
+	EvictBatchWindow time.Duration
+	// SoftMemoryLimit, if not 0, lets values be reclaimed when the process is
+	// under memory pressure, similar to soft references in other languages.
+	// After every garbage collection cycle the heap size is checked, and if
+	// it's above the limit the cache evicts its least valuable items until it
+	// holds half of the cost it did before. Evicted items are then missing on
+	// Get as usual, so this is only suitable for values that can be recomputed.
+	//
+	// This is best-effort: Go doesn't have weak references, so it only helps
+	// if the cached values make up a significant part of the heap.
+	SoftMemoryLimit uint64
+	// IncludeKeyCost adds an estimate of each key's size to the cost of its
+	// item, for caches where keys take up a significant amount of memory
+	// compared to values. The estimate is the length of string and []byte keys
+	// and 8 for every other (integer) key type, so it's only meaningful when
+	// costs are in bytes.
+	IncludeKeyCost bool
+	// DisableGetBuffer turns off the buffers that record Get calls for the
+	// admission and eviction policies, saving their memory and the overhead
+	// on every Get. BufferItems is ignored when this is set.
+	//
+	// Reads then have no influence on what's admitted or evicted, which will
+	// hurt the hit ratio of most workloads. It's meant for caches used as
+	// bounded write buffers that are rarely read.
+	DisableGetBuffer bool
+	// CloneValue, if not nil, is applied to every value returned by Get so
+	// that each caller gets its own copy, which prevents callers from
+	// accidentally mutating a value shared through the cache. This costs an
+	// allocation (or whatever the function does) per Get. When nil, all callers
+	// share the stored value.
+	CloneValue func(value interface{}) interface{}
+	// Mirror, if not nil, is another cache that every Set and Del that made it
+	// into the Set buffer is forwarded to, keeping it roughly in sync as a hot
+	// standby. Forwarding happens on the goroutine processing Sets and never
+	// blocks: if the mirror's buffer is full, the operation is dropped and
+	// counted by Metrics.MirrorsDropped. Values are forwarded as stored, so
+	// after ValueEncoder has been applied. Two caches must not mirror each
+	// other.
+	Mirror *Cache
+	// EvictionGracePeriod, if not 0, keeps items younger than the grace period
+	// from being picked as eviction victims, so a just-admitted item isn't
+	// evicted by the next Set, wasting the work of admitting it. This helps
+	// in high-churn workloads. If every sampled item is within the grace
+	// period, the oldest of them is evicted anyway.
+	EvictionGracePeriod time.Duration
+	// EvictionBatchRatio, if not 0, makes every eviction free up room beyond
+	// what the incoming item needs, so that afterwards at least this fraction
+	// of MaxCost is unused (like a low watermark). Evicting in larger batches
+	// amortizes the eviction work and makes Set latency more even, at the
+	// expense of a slightly lower utilization. Items too large to leave that
+	// much unused only free up the room they need. It must be less than 1.
+	EvictionBatchRatio float64
+	// MaxLifetime, if not 0, automatically clears the cache once this much
+	// time has passed since it was created or last cleared, for caches that
+	// should be fully refreshed periodically (e.g. every day). DrainOnClear
+	// applies to these Clears too.
+	MaxLifetime time.Duration
+	// DefaultTTL, if not 0, is the TTL of items Set without one (by Set and
+	// every other method but SetWithTTL), for caches that are entirely TTL
+	// based. An explicit SetWithTTL overrides it.
+	DefaultTTL time.Duration
+	// TieBreaker chooses which item to evict when the sampled victims have the
+	// same (lowest) estimated hits. It defaults to TieBreakRandom.
+	TieBreaker TieBreaker
+	// CountCollisions is a debug mode counting how often Get finds an item
+	// stored under the same hash as the key, but for a different key. Such
+	// collisions can only be told apart using the extra hashes (see Hashes) or
+	// the stored keys (see StoreKeys), so one of them should be set. A
+	// non-trivial CollisionCount means Hashes should be increased.
+	CountCollisions bool
+	// MinRetainedItems, if not 0, stops eviction (including under
+	// SoftMemoryLimit pressure) once the cache holds this many items, letting
+	// the total cost temporarily go over MaxCost instead. Since the items with
+	// the fewest hits are evicted first, the ones left are (approximately) the
+	// most frequently accessed, which keeps a core hot set in the cache while
+	// the tail is freely evictable. Expired items are still removed.
+	MinRetainedItems int
+	// MaxConcurrentLoads, if not 0, bounds how many loaders (as passed to
+	// GetFresh and GetOrSet, or Loader) run at once across all keys, so a cold
+	// cache missing on many keys at once doesn't overwhelm the backing store.
+	// Loaders over the limit wait for a slot. Unlike the single-flighting of
+	// loaders for the same key, this limits the total concurrency of cache
+	// fills.
+	MaxConcurrentLoads int
+	// Loader, if not nil, makes the cache read-through with GetOrLoad: it's
+	// called to load the value of a key that's missing, returning the value
+	// and its cost. Values are only Set if it doesn't return an error, so
+	// errors aren't cached.
+	Loader func(key interface{}) (interface{}, int64, error)
+	// Policy, if not nil, replaces the default admission and eviction policy
+	// (TinyLFU admission with sampled LFU eviction), such as with an
+	// LRUPolicy for scan-heavy workloads that TinyLFU admission doesn't suit.
+	// NumCounters and the options tuning the default policy
+	// (EvictionGracePeriod, EvictionBatchRatio, TieBreaker, MinRetainedItems
+	// and MaxItems) are then ignored, and Export isn't supported.
+	Policy Policy
+	// NumSetWorkers is the number of goroutines applying buffered Sets to the
+	// policy and the hashmap, which is 1 by default. One is usually enough,
+	// but with a very high rate of Sets on many cores it can fall behind,
+	// which fills up the Set buffer and drops Sets. Items are spread across
+	// the workers by key hash, so the Sets and Dels of any given key are
+	// still applied in order. Since admission and eviction are serialized by
+	// the policy's lock, extra workers mostly help with expensive Cost
+	// functions and callbacks; BenchmarkCacheSetWorkers shows how a workload
+	// scales.
+	//
+	// With more than one worker, OnEvict (unless OnEvictAsync is set),
+	// OnAdmit and OnLargeEvict can be called concurrently.
+	NumSetWorkers int
+	// SetBufferSize is the number of Sets (and Dels) that can be buffered
+	// while waiting to be applied, which is 32 * 1024 by default. Sets are
+	// dropped once the buffer is full, so write-heavy workloads with bursts
+	// may need a bigger buffer, while memory-constrained ones may want a
+	// smaller one.
+	SetBufferSize int
+}
+
+// valuesEqual is the default comparison used by Config.SkipNoopUpdates.
+func valuesEqual(a, b interface{}) bool {
+	if x, ok := a.([]byte); ok {
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Sizer is implemented by values that know their own cost, so they can be Set
+// with a cost of 0 without a Config.Cost function.
+type Sizer interface {
+	// Size returns the cost of the value.
+	Size() int64
+}
+
+// sizerCost returns a cost function that calls Size on values implementing
+// Sizer and fallback on the others.
+func sizerCost(fallback func(interface{}) int64) func(interface{}) int64 {
+	return func(value interface{}) int64 {
+		if sizer, ok := value.(Sizer); ok {
+			return sizer.Size()
+		}
+		return fallback(value)
+	}
+}
+
+// valueCost returns the cost of a value Set with a cost of 0: the result of
+// the cost function if there's one, or else its Size if it's a Sizer.
+func (c *Cache) valueCost(value interface{}) int64 {
+	if c.cost != nil {
+		return c.cost(value)
+	}
+	if sizer, ok := value.(Sizer); ok {
+		return sizer.Size()
+	}
+	return 0
+}
+
+// lenCost is the cost function used by Config.LenCost.
+func lenCost(value interface{}) int64 {
+	switch v := value.(type) {
+	case []byte:
+		return int64(len(v))
+	case string:
+		return int64(len(v))
+	}
+	return 1
+}
+
+// autoCost is the cost function used by Config.AutoCost. It returns a shallow
+// estimate of the value's size in bytes.
+func autoCost(value interface{}) int64 {
+	if value == nil {
+		return 0
+	}
+	v := reflect.ValueOf(value)
+	size := int64(v.Type().Size())
+	switch v.Kind() {
+	case reflect.String:
+		size += int64(v.Len())
+	case reflect.Slice:
+		size += int64(v.Len()) * int64(v.Type().Elem().Size())
+	case reflect.Map:
+		entry := v.Type().Key().Size() + v.Type().Elem().Size()
+		size += int64(v.Len()) * int64(entry)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			size += int64(v.Type().Elem().Size())
+		}
+	}
+	return size
+}
+
+type itemFlag byte
+
+const (
+	itemNew itemFlag = iota
+	itemDelete
+	itemUpdate
+	// itemWarm is a new item added by WarmMap, bypassing admission
+	itemWarm
+	// itemWait is a sentinel sent by Wait, whose costCh is closed once it's
+	// reached
+	itemWait
+)
+
+// item is passed to setBuf so items can eventually be added to the cache
+type item struct {
+	flag    itemFlag
+	key     interface{}
+	keyHash uint64
+	value   interface{}
+	cost    int64
+	// prev is the value replaced by an update, only kept when needed for
+	// Config.SkipNoopUpdates
+	prev interface{}
+	// altKey is the alternate key passed to SetWithAltKey, if any
+	altKey  interface{}
+	altHash uint64
+	// expiration is the UnixNano time the item expires at, or 0 if it never
+	// does
+	expiration int64
+	// costCh, if not nil, receives the cost recorded by the policy and is
+	// closed once the item is processed (or dropped)
+	costCh chan int64
+	// stored is true if the value was already added to the hashmap when the
+	// item was created, by SetIfAbsent
+	stored bool
+	// victimsCh, if not nil, receives the key hashes evicted to make room
+	// for the item if it's admitted, and is closed once the item is processed
+	// (or dropped)
+	victimsCh chan []uint64
+}
+
+// deliverVictims passes the key hashes of the victims to SetWithVictims.
+func (i *item) deliverVictims(victims []*item) {
+	if i.victimsCh == nil {
+		return
+	}
+	hashes := make([]uint64, len(victims))
+	for j, victim := range victims {
+		hashes[j] = victim.keyHash
+	}
+	i.victimsCh <- hashes
+}
+
+// deliverCost passes the cost recorded by the policy to SetWithComputedCost.
+func (i *item) deliverCost(cost int64) {
+	if i.costCh != nil && cost >= 0 {
+		i.costCh <- cost
+	}
+}
+
+// drop is called for items taken out of the Set buffer without being
+// processed.
+func (i *item) drop() {
+	if i.costCh != nil {
+		close(i.costCh)
+	}
+	if i.victimsCh != nil {
+		close(i.victimsCh)
+	}
+}
+
+// NewCache returns a new Cache instance and any configuration errors, if any.
+func NewCache(config *Config) (*Cache, error) {
+	switch {
+	case config.NumCounters == 0 && config.Policy == nil:
+		return nil, errors.New("NumCounters can't be zero.")
+	case config.MaxCost == 0:
+		return nil, errors.New("MaxCost can't be zero.")
+	case config.AutoCost && config.LenCost:
+		return nil, errors.New("AutoCost and LenCost can't both be set.")
+	case config.BufferItems == 0 && !config.DisableGetBuffer:
+		return nil, errors.New("BufferItems can't be zero.")
+	case config.OnEvictConcurrency < 0:
+		return nil, errors.New("OnEvictConcurrency can't be negative.")
+	case config.EvictBatchSize < 0:
+		return nil, errors.New("EvictBatchSize can't be negative.")
+	case config.EvictBatchWindow < 0:
+		return nil, errors.New("EvictBatchWindow can't be negative.")
+	case config.EvictionGracePeriod < 0:
+		return nil, errors.New("EvictionGracePeriod can't be negative.")
+	case config.EvictionBatchRatio < 0 || config.EvictionBatchRatio >= 1:
+		return nil, errors.New("EvictionBatchRatio must be in [0, 1).")
+	case config.MaxLifetime < 0:
+		return nil, errors.New("MaxLifetime can't be negative.")
+	case config.DefaultTTL < 0:
+		return nil, errors.New("DefaultTTL can't be negative.")
+	case config.MinRetainedItems < 0:
+		return nil, errors.New("MinRetainedItems can't be negative.")
+	case config.MaxConcurrentLoads < 0:
+		return nil, errors.New("MaxConcurrentLoads can't be negative.")
+	case config.NumSetWorkers < 0:
+		return nil, errors.New("NumSetWorkers can't be negative.")
+	case config.SetBufferSize < 0:
+		return nil, errors.New("SetBufferSize can't be negative.")
+	case config.MaxCostPerItem < 0:
+		return nil, errors.New("MaxCostPerItem can't be negative.")
+	case config.MaxItems < 0:
+		return nil, errors.New("MaxItems can't be negative.")
+	case config.TieBreaker < TieBreakRandom || config.TieBreaker > TieBreakLargestCost:
+		return nil, errors.New("TieBreaker is invalid.")
+	}
+	hashmap := newStore(config.Hashes, config.StoreKeys)
+	if config.CountCollisions {
+		hashmap.CountCollisions()
+	}
+	policy := newPolicy(config)
+	if config.EvictionGracePeriod > 0 {
+		policy.SetGracePeriod(config.EvictionGracePeriod)
+	}
+	if config.EvictionBatchRatio > 0 {
+		policy.SetBatchRatio(config.EvictionBatchRatio)
+	}
+	if config.TieBreaker != TieBreakRandom {
+		policy.SetTieBreaker(config.TieBreaker)
+	}
+	if config.MinRetainedItems > 0 {
+		policy.SetMinRetained(config.MinRetainedItems)
+	}
+	if config.MaxItems > 0 {
+		policy.SetMaxItems(config.MaxItems)
+	}
+	cache := &Cache{
+		store:               hashmap,
+		policy:              policy,
+		onEvict:             config.OnEvict,
+		onAdmit:             config.OnAdmit,
+		onLargeEvict:        config.OnLargeEvict,
+		largeEvictThreshold: config.LargeEvictThreshold,
+		maxCostPerItem:      config.MaxCostPerItem,
+		keyToHash:           config.KeyToHash,
+		stop:                make(chan struct{}),
+		reclaim:             make(chan struct{}, 1),
+		sweep:               make(chan struct{}, 1),
+		closing:             make(chan struct{}),
+		softMemoryLimit:     config.SoftMemoryLimit,
+		maxLifetime:         config.MaxLifetime,
+		defaultTTL:          config.DefaultTTL,
+		cost:                config.Cost,
+		drainOnClear:        config.DrainOnClear,
+		rejectSetsOnClear:   config.RejectSetsOnClear,
+		recostOnGet:         config.RecostOnGet,
+		includeKeyCost:      config.IncludeKeyCost,
+		skipNoopUpdates:     config.SkipNoopUpdates,
+		valueEqual:          config.ValueEqual,
+		onFirstItem:         config.OnFirstItem,
+		onEmpty:             config.OnEmpty,
+		onPanic:             config.OnPanic,
+		valueEncoder:        config.ValueEncoder,
+		valueDecoder:        config.ValueDecoder,
+		cloneValue:          config.CloneValue,
+		mirror:              config.Mirror,
+		loader:              config.Loader,
+		altKeys:             make(map[uint64]uint64),
+		setWorkers:          config.NumSetWorkers,
+		empty:               true,
+		config:              *config,
+	}
+	if cache.keyToHash == nil {
+		cache.keyToHash = z.KeyToHash
+	}
+	hashmap.SetKeyToHash(cache.keyToHash)
+	cache.config.KeyToHash = cache.keyToHash
+	if cache.valueEqual == nil {
+		cache.valueEqual = valuesEqual
+	}
+	cache.config.ValueEqual = cache.valueEqual
+	if cache.cost == nil && config.AutoCost {
+		cache.cost = sizerCost(autoCost)
+		cache.config.Cost = cache.cost
+	}
+	if cache.cost == nil && config.LenCost {
+		cache.cost = sizerCost(lenCost)
+		cache.config.Cost = cache.cost
+	}
+	cache.guardCallbacks()
+	if config.MaxConcurrentLoads > 0 {
+		cache.loads.limit(config.MaxConcurrentLoads)
+	}
+	if cache.setWorkers == 0 {
+		cache.setWorkers = 1
+	}
+	cache.config.NumSetWorkers = cache.setWorkers
+	if cache.config.SetBufferSize == 0 {
+		cache.config.SetBufferSize = setBufSize
+	}
+	cache.setBuf = make(chan *item, cache.config.SetBufferSize)
+	if config.OnEvict != nil && config.OnEvictAsync {
+		workers := config.OnEvictConcurrency
+		if workers == 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		cache.config.OnEvictConcurrency = workers
+		cache.evictPool = newEvictPool(cache.onEvict, workers)
+	}
+	if config.OnEvictBatch != nil {
+		size, window := config.EvictBatchSize, config.EvictBatchWindow
+		if size == 0 {
+			size = evictBatchSize
+		}
+		if window == 0 {
+			window = evictBatchWindow
+		}
+		cache.config.EvictBatchSize, cache.config.EvictBatchWindow = size, window
+		onEvictBatch := config.OnEvictBatch
+		cache.evictBatcher = newEvictBatcher(func(items []*Item) {
+			defer cache.recoverCallback()
+			onEvictBatch(items)
+		}, size, window)
+	}
+	if config.MetricsSink != nil {
+		cache.collectMetrics(config.MetricsSink)
+	} else if config.Metrics {
+		cache.collectMetrics(nil)
+	}
+	if !config.DisableGetBuffer {
+		cache.getBuf = newRingBuffer(policy, config.BufferItems)
+	} else {
+		cache.config.BufferItems = 0
+	}
+	cache.shadow.Store(&shadowStore{})
+	if cache.softMemoryLimit != 0 {
+		cache.watchMemory()
+	}
+	go cache.sweepExpired()
+	if cache.Metrics != nil && cache.Metrics.sink == nil {
+		cache.Metrics.record()
+		go cache.recordRates(cache.Metrics)
+	}
+	if cache.maxLifetime != 0 {
+		cache.lifetime = time.AfterFunc(cache.maxLifetime, cache.Clear)
+	}
+	// NOTE: benchmarks seem to show that performance decreases the more
+	//       goroutines we have running cache.processItems(), so 1 should
+	//       usually be sufficient (see Config.NumSetWorkers)
+	cache.startProcessing()
+	return cache, nil
+}
+
+// Get returns the value (if any) and a boolean representing whether the
+// value was found or not. The value can be nil and the boolean can be true at
+// the same time.
+func (c *Cache) Get(key interface{}) (interface{}, bool) {
+	if c == nil || key == nil {
+		return nil, false
+	}
+	return c.get(c.keyToHash(key, 0), key)
+}
+
+// GetByHash is like Get, but takes the hash of the key as computed by the
+// configured KeyToHash (such as returned by KeyHash), for callers that already
+// have it. The key is still used to tell apart keys with the same hash (with
+// Config.Hashes or Config.StoreKeys), but it isn't hashed again. It can be nil
+// to skip those checks.
+func (c *Cache) GetByHash(keyHash uint64, key interface{}) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.get(keyHash, key)
+}
+
+// get looks up the key by its hash for Get and GetByHash, recording the access.
+func (c *Cache) get(hashed uint64, key interface{}) (interface{}, bool) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return nil, false
+	}
+	if c.getBuf != nil {
+		c.getBuf.Push(hashed)
+	}
+	value, ok, stale := c.lookup(hashed, key, true)
+	switch {
+	case ok && stale:
+		c.Metrics.add(staleHit, hashed, 1)
+	case ok:
+		c.Metrics.add(hit, hashed, 1)
+	default:
+		c.Metrics.add(miss, hashed, 1)
+	}
+	return value, ok
+}
+
+// Peek is like Get, but without counting as an access to the key: it doesn't
+// affect admission or eviction, nor the hit and miss metrics, so the cache can
+// be inspected without skewing either.
+func (c *Cache) Peek(key interface{}) (interface{}, bool) {
+	if c == nil || key == nil {
+		return nil, false
+	}
+	value, ok, _ := c.lookup(c.keyToHash(key, 0), key, false)
+	return value, ok
+}
+
+// lookup finds the value of the key in the hashmap, or else the shadow store
+// (in which case stale is true), and decodes and clones it as configured. The
+// value is recosted if RecostOnGet is set and it's an access.
+func (c *Cache) lookup(keyHash uint64, key interface{},
+	access bool) (value interface{}, ok, stale bool) {
+	value, ok = c.store.Get(keyHash, key)
+	if !ok {
+		value, ok = c.getShadow(keyHash, key)
+		stale = ok
+	}
+	if ok {
+		if access && c.recostOnGet && c.cost != nil && !stale {
+			c.recost(keyHash, key, value)
+		}
+		if c.valueDecoder != nil {
+			value, ok = c.decode(value)
+		}
+		if ok && c.cloneValue != nil {
+			value = c.cloneValue(value)
+		}
+	}
+	return value, ok, stale
+}
+
+// GetValid is like Get, but only returns the value if valid returns true for
+// it. Otherwise the item is deleted and GetValid misses, which suits values that
+// can become invalid in place (such as a struct with an expiry field).
+//
+// valid is checked again while the key is locked before deleting, so a valid
+// value Set in the meantime isn't deleted. valid may thus be called twice, and
+// must not use the cache.
+func (c *Cache) GetValid(key interface{},
+	valid func(interface{}) bool) (interface{}, bool) {
+	if c == nil || key == nil || atomic.LoadInt32(&c.closed) == 1 {
+		return nil, false
+	}
+	keyHash := c.keyToHash(key, 0)
+	if c.getBuf != nil {
+		c.getBuf.Push(keyHash)
+	}
+	value, ok, stale := c.lookup(keyHash, key, true)
+	switch {
+	case ok && valid(value):
+		if stale {
+			c.Metrics.add(staleHit, keyHash, 1)
+		} else {
+			c.Metrics.add(hit, keyHash, 1)
+		}
+		return value, true
+	case !ok:
+		c.Metrics.add(miss, keyHash, 1)
+		return nil, false
+	}
+	// an invalid value counts as a miss
+	c.Metrics.add(miss, keyHash, 1)
+	var raw interface{}
+	deleted := c.store.DelIf(keyHash, key, func(stored interface{}) bool {
+		raw = stored
+		if c.valueDecoder != nil {
+			decoded, ok := c.decode(stored)
+			if !ok {
+				return true
+			}
+			stored = decoded
+		}
+		return !valid(stored)
+	})
+	if deleted {
+		// the value is already gone from the hashmap, this removes it from
+		// the policy (without blocking, like Set)
+		i := c.delItem(key)
+		i.value = raw
+		select {
+		case c.setBuf <- i:
+		default:
+			c.Metrics.add(dropSets, keyHash, 1)
+		}
+	}
+	return nil, false
+}
+
+// GetFresh is like Get, but with bounded staleness: if the cached value was set
+// less than maxStale ago it's returned as is. Otherwise the (stale) value is
+// still returned right away, but loader is called in the background to reload
+// it. On a miss, loader is called synchronously and its value is returned. Only
+// one loader runs at a time for any given key, and no more than
+// Config.MaxConcurrentLoads overall.
+//
+// Loaded values are Set with a cost of 0, so Config.Cost is used to compute
+// their cost. If loader returns an error nothing is Set, and on a miss GetFresh
+// returns false.
+func (c *Cache) GetFresh(key interface{}, maxStale time.Duration,
+	loader func() (interface{}, error)) (interface{}, bool) {
+	return c.GetFreshContext(context.Background(), key, maxStale, loader)
+}
+
+// GetFreshContext is like GetFresh, but on a miss it stops waiting for a slot
+// to call loader (with Config.MaxConcurrentLoads) once ctx is done, and returns
+// false. Callers waiting for the same key's loader fail along with it.
+func (c *Cache) GetFreshContext(ctx context.Context, key interface{},
+	maxStale time.Duration,
+	loader func() (interface{}, error)) (interface{}, bool) {
+	if c == nil || key == nil {
+		return nil, false
+	}
+	load := func() (interface{}, error) {
+		value, err := loader()
+		if err == nil {
+			c.Set(key, value, 0)
+		}
+		return value, err
+	}
+	hashed := c.keyToHash(key, 0)
+	value, ok := c.Get(key)
+	if !ok {
+		value, err := c.loads.Do(ctx, hashed, load)
+		if err != nil {
+			return nil, false
+		}
+		return value, true
+	}
+	// values only found in the shadow store are always stale
+	item, fresh := c.store.GetItem(hashed, key)
+	if !fresh || time.Since(time.Unix(0, item.updated)) >= maxStale {
+		c.loads.Start(hashed, load)
+	}
+	return value, true
+}
+
+// GetOrSet returns the value of the key if it's in the cache, along with true.
+// Otherwise it calls compute and Sets its result with the given cost (if the
+// key is still absent), returning it along with false. Concurrent callers
+// missing on the same key share a single compute call, and no more than
+// Config.MaxConcurrentLoads run at once overall. The computed value is
+// visible to Get as soon as GetOrSet returns, though as with any Set the policy
+// may later reject it. If compute panics, the panic is passed on to every
+// caller waiting for it.
+//
+// With a nil cache, compute is always called.
+func (c *Cache) GetOrSet(key interface{}, cost int64,
+	compute func() interface{}) (interface{}, bool) {
+	if c == nil || key == nil {
+		return compute(), false
+	}
+	if value, ok := c.Get(key); ok {
+		return value, true
+	}
+	value, _ := c.loads.Do(context.Background(), c.keyToHash(key, 0),
+		func() (interface{}, error) {
+			value := compute()
+			c.SetIfAbsent(key, value, cost)
+			return value, nil
+		})
+	return value, false
+}
+
+// GetOrLoad returns the value of the key, calling Config.Loader to load it on a
+// miss. The loaded value is Set with the cost returned by the loader, and is
+// visible to Get as soon as GetOrLoad returns. Concurrent callers missing on
+// the same key wait for a single call to the loader and share its result,
+// which keeps a hot key from sending a thundering herd to the backing store.
+//
+// If the loader returns an error nothing is Set, and the error is returned to
+// every caller waiting for it, as is a panic. An error is also returned if
+// Config.Loader isn't set.
+func (c *Cache) GetOrLoad(key interface{}) (interface{}, error) {
+	if c == nil {
+		return nil, errors.New("Cache is nil.")
+	}
+	if c.loader == nil {
+		return nil, errors.New("Config.Loader isn't set.")
+	}
+	if key == nil {
+		return nil, errors.New("Key is nil.")
+	}
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+	return c.loads.Do(context.Background(), c.keyToHash(key, 0),
+		func() (interface{}, error) {
+			value, cost, err := c.loader(key)
+			if err != nil {
+				return nil, err
+			}
+			c.SetIfAbsent(key, value, cost)
+			return value, nil
+		})
+}
+
+// shadowStore wraps the store kept by ClearWithShadow, so it can be held by an
+// atomic.Value even when there's none.
+type shadowStore struct {
+	store store
+}
+
+// getShadow looks the key up in the shadow store, if there is one.
+func (c *Cache) getShadow(keyHash uint64, key interface{}) (interface{}, bool) {
+	shadow := c.shadow.Load().(*shadowStore).store
+	if shadow == nil {
+		return nil, false
+	}
+	return shadow.Get(keyHash, key)
+}
+
+// Has returns true if Get would find the key, without counting as an access to
+// it: it doesn't affect admission or eviction, nor the hit and miss metrics.
+func (c *Cache) Has(key interface{}) bool {
+	if c == nil || key == nil {
+		return false
+	}
+	hashed := c.keyToHash(key, 0)
+	if _, ok := c.store.Get(hashed, key); ok {
+		return true
+	}
+	_, ok := c.getShadow(hashed, key)
+	return ok
+}
+
+// GetTTL returns the time left before the key expires, and whether the key is
+// in the cache (and not expired). Keys set without a TTL return 0 and true.
+// Unlike Get, it's not counted as an access to the key: it doesn't affect
+// admission or eviction, nor the hit and miss metrics.
+func (c *Cache) GetTTL(key interface{}) (time.Duration, bool) {
+	if c == nil || key == nil {
+		return 0, false
+	}
+	item, ok := c.store.GetItem(c.keyToHash(key, 0), key)
+	if !ok {
+		return 0, false
+	}
+	if item.expiration == 0 {
+		return 0, true
+	}
+	ttl := time.Until(time.Unix(0, item.expiration))
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// WouldEvict returns true if adding a new item with the given cost would
+// require evicting other items to make room for it. It's a cheap check against
+// the current usage, so producers can throttle before doing expensive work to
+// create a value. Sets still waiting in the buffer aren't accounted for.
+func (c *Cache) WouldEvict(cost int64) bool {
+	if c == nil {
+		return false
+	}
+	return cost > c.policy.Cap()
+}
+
+// CurrentCost returns the total cost of the items in the cache, as accounted
+// for by the policy. It goes down as items are deleted or evicted and follows
+// cost changes from updates, so along with MaxCost it tells how much of the
+// budget is in use. Sets still in the buffer aren't accounted for.
+func (c *Cache) CurrentCost() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.policy.Used()
+}
+
+// EstimatedMemory returns a rough estimate of the memory used by the cache in
+// bytes: the total cost of the items (as returned by CurrentCost) plus the
+// structural overhead, which is the frequency counters and an estimate of the
+// bookkeeping kept per item. It's only meaningful when costs are the sizes of
+// values in bytes, and it's meant for answering roughly how much memory a
+// cache takes up on dashboards, not for exact accounting.
+func (c *Cache) EstimatedMemory() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.policy.Used() + c.policy.Overhead() +
+		int64(c.store.Len())*storeItemOverhead
+}
+
+// CounterSaturation returns the fraction of TinyLFU frequency counters that
+// are at their max value (15). When many counters are saturated the policy
+// can't tell popular keys apart anymore and eviction quality degrades, which
+// means NumCounters is too small for the workload. This scans every counter,
+// so it's meant for occasional monitoring rather than the hot path.
+func (c *Cache) CounterSaturation() float64 {
+	if c == nil {
+		return 0
+	}
+	return c.policy.Saturation()
+}
+
+// NextReset returns the number of frequency counter increments left until
+// TinyLFU halves all of its counters, aging out the frequencies of keys that
+// are no longer popular. Counters are incremented for every Get (and WarmMap
+// item) the policy is told about, and reset every NumCounters increments.
+// Since Gets are buffered, the ones still in the Get buffers aren't accounted
+// for yet.
+func (c *Cache) NextReset() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.policy.NextReset()
+}
+
+// EstimateFrequency returns TinyLFU's estimate of how often the key was
+// accessed recently, as used for admission and eviction: the count-min sketch
+// estimate, plus one if the doorkeeper has seen the key. Estimates are
+// approximate (they can be inflated by other keys with colliding counters), they
+// saturate at 16, and they're halved every NumCounters accesses. Since Gets are
+// buffered, the ones still in the Get buffers aren't accounted for yet.
+//
+// It's meant for debugging evictions and detecting hot keys. With a custom
+// Config.Policy it always returns 0.
+func (c *Cache) EstimateFrequency(key interface{}) uint64 {
+	if c == nil || key == nil {
+		return 0
+	}
+	return uint64(c.policy.Estimate(c.keyToHash(key, 0)))
+}
+
+// EffectiveConfig returns the configuration the cache is actually running with:
+// the Config passed to NewCache with defaults filled in (such as KeyToHash,
+// ValueEqual, OnEvictConcurrency and the eviction batch settings) and ignored
+// settings zeroed. It's meant for logging what a cache is running with.
+func (c *Cache) EffectiveConfig() Config {
+	if c == nil {
+		return Config{}
+	}
+	config := c.config
+	config.MaxCost = c.policy.MaxCost()
+	return config
+}
+
+// Entry describes an item in the cache, as returned by EvictionCandidates.
+type Entry struct {
+	Key   uint64
+	Value interface{}
+	Cost  int64
+	// Hits is the estimated number of times the key was accessed recently
+	Hits int64
+}
+
+// EvictionCandidates returns up to n items the cache considers least valuable,
+// i.e. the ones with the fewest estimated hits, which are the most likely to be
+// evicted next. Nothing is evicted. It's meant for admin tools checking that
+// important items aren't on the chopping block due to a misconfigured cost or
+// hash, and it has to sort every item, so it shouldn't be called often.
+func (c *Cache) EvictionCandidates(n int) []Entry {
+	if c == nil {
+		return nil
+	}
+	candidates := c.policy.Candidates(n)
+	if len(candidates) == 0 {
+		return nil
+	}
+	entries := make([]Entry, len(candidates))
+	for i, candidate := range candidates {
+		// get with no collision checking because we don't have the key
+		value, _ := c.store.Get(candidate.key, nil)
+		entries[i] = Entry{
+			Key:   candidate.key,
+			Value: value,
+			Cost:  candidate.cost,
+			Hits:  candidate.hits,
+		}
+	}
+	return entries
+}
+
+// Fingerprint returns a hash of the (key hash, cost) pairs currently in the
+// cache. It doesn't depend on the order items were added in, so two caches
+// holding the same keys with the same costs have the same fingerprint, which
+// makes for a cheap equality check between replicas or across a warm restart.
+// Values aren't part of the fingerprint.
+func (c *Cache) Fingerprint() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.policy.Fingerprint()
+}
+
+// Len returns the number of items stored in the cache. Items are only counted
+// once they're processed, and until they're deleted or evicted, so Sets still
+// in the buffer aren't counted while expired items not yet swept are. Values
+// Set with an alternate key count twice.
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	return c.store.Len()
+}
+
+// CollisionCount returns the number of collisions found by Get, if
+// Config.CountCollisions is set.
+func (c *Cache) CollisionCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.store.Collisions()
+}
+
+// KeyHash returns the hash of the key as computed by the configured KeyToHash
+// function. It's the same hash that's passed to OnEvict, so it can be used to
+// map evictions back to the original keys. It returns false if the key is nil
+// or of a type KeyToHash doesn't support (where it panics).
+func (c *Cache) KeyHash(key interface{}) (hash uint64, ok bool) {
+	if c == nil || key == nil {
+		return 0, false
+	}
+	defer func() {
+		if recover() != nil {
+			hash, ok = 0, false
+		}
+	}()
+	return c.keyToHash(key, 0), true
+}
+
+// FlushGets pushes the accesses buffered by Get calls to the policy without
+// waiting for the buffers to fill up. Normally reads are only accounted for in
+// batches of Config.BufferItems, so right after a burst of reads the policy may
+// not yet know about them when deciding what to evict for a new item.
+//
+// This is only worth it before a Set whose admission or eviction decision
+// really matters, as it defeats the batching that keeps Gets cheap. It's
+// best-effort: buffers in use by concurrent Gets aren't flushed, and the
+// policy applies the flushed accesses asynchronously.
+func (c *Cache) FlushGets() {
+	if c == nil || c.getBuf == nil {
+		return
+	}
+	c.getBuf.Flush()
+}
+
+// decode runs the value decoder on []byte values. It returns false if the
+// value couldn't be decoded.
+func (c *Cache) decode(value interface{}) (interface{}, bool) {
+	b, ok := value.([]byte)
+	if !ok {
+		return value, true
+	}
+	decoded, err := c.valueDecoder(b)
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// GetSnapshot returns the values of all the keys found in the cache as of a
+// single point in time, so values that depend on each other aren't torn by a
+// concurrent Set or Del to some of the keys. Missing keys are left out of the
+// map. Each key counts as an access, as with Get.
+//
+// Rather than coordinating with the goroutine processing Sets, the parts of
+// the hashmap holding the keys are locked together (which also covers the
+// updates Set applies right away). If they can't all be locked within 10ms,
+// such as when writes to them keep getting in the way, GetSnapshot gives up
+// and returns false without counting any access (as it does if the cache is
+// nil). Values only found in the ClearWithShadow shadow aren't returned.
+func (c *Cache) GetSnapshot(keys []interface{}) (map[interface{}]interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.getMany(keys, time.Now().Add(snapshotTimeout))
+}
+
+// GetMany returns the values of all the keys found in the cache, leaving
+// missing keys out of the map. It's cheaper than calling Get for every key:
+// the parts of the hashmap holding the keys are locked once for all of them
+// (which also makes the result a consistent snapshot, as with GetSnapshot), and
+// the accesses are buffered for the policy in one batch. Hits and misses are
+// still recorded for every key.
+func (c *Cache) GetMany(keys []interface{}) map[interface{}]interface{} {
+	if c == nil {
+		return nil
+	}
+	snapshot, _ := c.getMany(keys, time.Time{})
+	return snapshot
+}
+
+// getMany looks up the keys for GetSnapshot and GetMany, giving up at the
+// deadline (unless it's zero) as with store.GetMany.
+func (c *Cache) getMany(keys []interface{},
+	deadline time.Time) (map[interface{}]interface{}, bool) {
+	hashes := make([]uint64, 0, len(keys))
+	nonNil := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if key != nil {
+			hashes = append(hashes, c.keyToHash(key, 0))
+			nonNil = append(nonNil, key)
+		}
+	}
+	values, found, ok := c.store.GetMany(hashes, nonNil, deadline)
+	if !ok {
+		return nil, false
+	}
+	if c.getBuf != nil {
+		c.getBuf.PushMany(hashes)
+	}
+	snapshot := make(map[interface{}]interface{}, len(nonNil))
+	for i, key := range nonNil {
+		value, ok := values[i], found[i]
+		if ok && c.valueDecoder != nil {
+			value, ok = c.decode(value)
+		}
+		if !ok {
+			c.Metrics.add(miss, hashes[i], 1)
+			continue
+		}
+		if c.cloneValue != nil {
+			value = c.cloneValue(value)
+		}
+		c.Metrics.add(hit, hashes[i], 1)
+		snapshot[key] = value
+	}
+	return snapshot, true
+}
+
+// GetByPrefix returns every item with a string key starting with the prefix.
+// It only works if Config.StoreKeys is set, otherwise the result is always
+// empty.
+//
+// This walks the entire cache, so it's O(n) in the number of items, and the
+// lookups don't count as accesses. Items added or removed concurrently may or
+// may not be included.
+func (c *Cache) GetByPrefix(prefix string) map[string]interface{} {
+	if c == nil {
+		return nil
+	}
+	found := make(map[string]interface{})
+	c.store.Range(func(i storeItem) bool {
+		if key, ok := i.key.(string); ok && strings.HasPrefix(key, prefix) {
+			found[key] = i.value
+		}
+		return true
+	})
+	return found
+}
+
+// ForEach calls fn with the key hash, value and cost of every item in the cache
+// until it returns false, such as to export the cache to a cold store on
+// shutdown. Expired items, and items the policy hasn't admitted yet, are
+// skipped.
+//
+// The hashmap is walked one shard at a time, holding the shard's read lock
+// while fn is called for its items, so fn must not write to the cache. There's
+// no snapshot across shards: items added, updated or removed concurrently may
+// or may not be seen, but each item is seen at most once and in a consistent
+// state.
+func (c *Cache) ForEach(fn func(key uint64, value interface{}, cost int64) bool) {
+	if c == nil {
+		return
+	}
+	c.store.Range(func(i storeItem) bool {
+		// alternate keys aren't known to the policy
+		cost := c.policy.Cost(i.keyHash)
+		if cost == -1 {
+			return true
+		}
+		value := i.value
+		if c.valueDecoder != nil {
+			decoded, ok := c.decode(value)
+			if !ok {
+				return true
+			}
+			value = decoded
+		}
+		return fn(i.keyHash, value, cost)
+	})
+}
+
+// MapValues replaces the value of every item with the result of transform,
+// leaving keys and costs unchanged, for in-place migrations such as
+// re-encoding every value after a format change. Each value is replaced while
+// its key is locked, so transform must be quick and must not use the cache.
+// Shards are walked one at a time, so the cache as a whole isn't transformed
+// atomically.
+//
+// The key passed to transform is nil unless Config.StoreKeys is set. Items
+// Set with SetWithAltKey are transformed once per key.
+func (c *Cache) MapValues(transform func(key, value interface{}) interface{}) {
+	if c == nil {
+		return
+	}
+	c.store.MapValues(func(key, value interface{}) interface{} {
+		current := value
+		if c.valueDecoder != nil {
+			decoded, ok := c.decode(current)
+			if !ok {
+				return value
+			}
+			current = decoded
+		}
+		transformed := transform(key, current)
+		if b, ok := transformed.([]byte); ok && c.valueEncoder != nil {
+			encoded, err := c.valueEncoder(b)
+			if err != nil {
+				// keep the current value
+				return value
+			}
+			transformed = encoded
+		}
+		return transformed
+	})
+}
+
+// WriteAgeRange returns the times the oldest and newest items in the cache were
+// last written (by Set or any other write; Gets don't count), giving a sense of
+// how far back the cache reaches and how fast its working set churns. Access
+// times aren't tracked, so an old item may still be read often. It returns
+// false if the cache is empty. It has to look at every item, so it's not meant
+// to be called often.
+func (c *Cache) WriteAgeRange() (oldest, newest time.Time, ok bool) {
+	if c == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	var min, max int64
+	c.store.Range(func(i storeItem) bool {
+		if !ok || i.updated < min {
+			min = i.updated
+		}
+		if !ok || i.updated > max {
+			max = i.updated
+		}
+		ok = true
+		return true
+	})
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	return time.Unix(0, min), time.Unix(0, max), true
+}
+
+// recost re-evaluates the cost of value and updates the policy if it differs
+// from the cost currently recorded for the key.
+func (c *Cache) recost(keyHash uint64, key, value interface{}) {
+	prev := c.policy.Cost(keyHash)
+	if prev == -1 {
+		// not admitted (yet), nothing to update
+		return
+	}
+	if cost := c.cost(value) + c.keyCost(key); cost != prev {
+		c.policy.Update(keyHash, cost)
+	}
+}
+
+// Set attempts to add the key-value item to the cache. If it returns false,
+// then the Set was dropped and the key-value item isn't added to the cache. If
+// it returns true, there's still a chance it could be dropped by the policy if
+// its determined that the key-value item isn't worth keeping, but otherwise the
+// item will be added and other items will be evicted in order to make room.
+//
+// To dynamically evaluate the items cost using the Config.Coster function, set
+// the cost parameter to 0 and Coster will be ran when needed in order to find
+// the items true cost.
+func (c *Cache) Set(key, value interface{}, cost int64) bool {
+	if c == nil || key == nil {
+		return false
+	}
+	i := c.setItem(key, value, cost, c.defaultTTL)
+	if i == nil {
+		return false
+	}
+	// attempt to send item to policy
+	select {
+	case c.setBuf <- i:
+		return true
+	default:
+		c.Metrics.add(dropSets, i.keyHash, 1)
+		return false
+	}
+}
+
+// SetWithTTL is like Set, but the item expires after ttl has passed: Get then
+// misses it, even if it's still in the cache. A ttl of 0 means the item never
+// expires, overriding Config.DefaultTTL, and a negative ttl drops the item.
+func (c *Cache) SetWithTTL(key, value interface{}, cost int64,
+	ttl time.Duration) bool {
+	if c == nil || key == nil || ttl < 0 {
+		return false
+	}
+	i := c.setItem(key, value, cost, ttl)
+	if i == nil {
+		return false
+	}
+	select {
+	case c.setBuf <- i:
+		return true
+	default:
+		c.Metrics.add(dropSets, i.keyHash, 1)
+		return false
+	}
+}
+
+// SetBlocking is like Set, but it's never dropped because the Set buffer is
+// full: it waits for room in the buffer instead, for writes that have to make
+// it into the cache such as loading a dataset. The item can still be rejected
+// by the policy once it's processed. It returns false if the item couldn't be
+// buffered, such as when the cache is closed.
+//
+// SetBlocking blocks the caller for as long as the buffer stays full, so if
+// processing of Sets stalls (such as on a slow OnEvict, or while the cache is
+// paused) so does the caller.
+func (c *Cache) SetBlocking(key, value interface{}, cost int64) bool {
+	if c == nil || key == nil || atomic.LoadInt32(&c.closed) == 1 {
+		return false
+	}
+	i := c.setItem(key, value, cost, c.defaultTTL)
+	if i == nil {
+		return false
+	}
+	return c.push(i)
+}
+
+// SetByHash is like Set, but takes the hash of the key as computed by the
+// configured KeyToHash (see GetByHash), which isn't computed again. The key is
+// still needed, for the extra hashes of Config.Hashes and for
+// Config.StoreKeys.
+func (c *Cache) SetByHash(keyHash uint64, key, value interface{},
+	cost int64) bool {
+	if c == nil || key == nil {
+		return false
+	}
+	i := c.setItemByHash(keyHash, key, value, cost, c.defaultTTL)
+	if i == nil {
+		return false
+	}
+	select {
+	case c.setBuf <- i:
+		return true
+	default:
+		c.Metrics.add(dropSets, i.keyHash, 1)
+		return false
+	}
+}
+
+// SetIfAbsent is like Set, but only adds the item if the key isn't in the cache
+// yet, and returns true if it did. The check and the insert are done atomically
+// on the hashmap when SetIfAbsent is called, so out of any number of concurrent
+// SetIfAbsent calls for the same key, at most one sees it absent and returns
+// true, and a Get right after it returns the value.
+//
+// The policy still considers the item asynchronously like any other Set, and
+// if it's rejected (or dropped because the Set buffer is full, in which case
+// SetIfAbsent returns false) the value is removed again. So a true result means
+// the key was absent and the value was inserted, not that it will stay.
+func (c *Cache) SetIfAbsent(key, value interface{}, cost int64) bool {
+	if c == nil || key == nil {
+		return false
+	}
+	i := c.newItem(c.keyToHash(key, 0), key, value, cost, c.defaultTTL)
+	if i == nil {
+		return false
+	}
+	i.stored = true
+	if !c.store.SetIfAbsent(i.keyHash, key, i.value, i.expiration) {
+		return false
+	}
+	select {
+	case c.setBuf <- i:
+		return true
+	default:
+		c.store.Del(i.keyHash, key)
+		c.Metrics.add(dropSets, i.keyHash, 1)
+		return false
+	}
+}
+
+// Swap is like Set, but also returns the value that was replaced, for
+// last-write-wins merges and similar. If the key was present, its value is
+// replaced synchronously on the hashmap, so out of any number of concurrent
+// Swaps for the same key each one returns the value written by the one before
+// it, and a Get right after it returns the new value; only the cost is updated
+// asynchronously, as with Set. A value that expired but hasn't been purged yet
+// is still replaced in place, so Swap returns it along with true (unlike Get,
+// which misses it).
+//
+// If the key was absent, Swap returns nil and false, and the value is Set like
+// any new item: it's only visible once processed, and may be rejected by the
+// policy or dropped if the Set buffer is full.
+func (c *Cache) Swap(key, value interface{}, cost int64) (interface{}, bool) {
+	if c == nil || key == nil || atomic.LoadInt32(&c.closed) == 1 {
+		return nil, false
+	}
+	i := c.newItem(c.keyToHash(key, 0), key, value, cost, c.defaultTTL)
+	if i == nil {
+		return nil, false
+	}
+	prev, had := c.store.Update(i.keyHash, key, i.value, i.expiration)
+	if had {
+		i.flag = itemUpdate
+		if c.skipNoopUpdates {
+			i.prev = prev
+		}
+	}
+	select {
+	case c.setBuf <- i:
+	default:
+		c.Metrics.add(dropSets, i.keyHash, 1)
+	}
+	if !had {
+		return nil, false
+	}
+	if c.valueDecoder != nil {
+		return c.decode(prev)
+	}
+	return prev, true
+}
+
+// SetWithVictims is like Set, but waits for the item to be processed and
+// returns whether it was admitted (or updated an existing key) along with the
+// key hashes evicted to make room for it, so callers can keep a secondary
+// index up to date on their own goroutine rather than in OnEvict. Victims of
+// later Sets (or of memory pressure) aren't included.
+//
+// Rather than applying the item inline, it goes through the Set buffer like
+// any other Set, which keeps it ordered with them. Unlike Set, it's never
+// dropped when the buffer is full, blocking instead. The price is latency:
+// each call waits for every item ahead of it in the buffer to be processed,
+// so it's much slower than Set and shouldn't be used on hot paths.
+func (c *Cache) SetWithVictims(key, value interface{},
+	cost int64) (bool, []uint64) {
+	if c == nil || key == nil || atomic.LoadInt32(&c.closed) == 1 {
+		return false, nil
+	}
+	i := c.setItem(key, value, cost, c.defaultTTL)
+	if i == nil {
+		return false, nil
+	}
+	i.victimsCh = make(chan []uint64, 1)
+	c.push(i)
+	victims, ok := <-i.victimsCh
+	return ok, victims
+}
+
+// SetWithComputedCost is like Set with a cost of 0, so Config.Cost computes the
+// cost, but it returns a channel that receives the cost recorded by the policy
+// once the item is processed, for callers that want to track their actual
+// usage. The channel is closed without receiving anything if the item is
+// dropped or rejected.
+func (c *Cache) SetWithComputedCost(key, value interface{}) <-chan int64 {
+	costCh := make(chan int64, 1)
+	if c == nil || key == nil {
+		close(costCh)
+		return costCh
+	}
+	i := c.setItem(key, value, 0, c.defaultTTL)
+	if i == nil {
+		close(costCh)
+		return costCh
+	}
+	i.costCh = costCh
+	select {
+	case c.setBuf <- i:
+	default:
+		c.Metrics.add(dropSets, i.keyHash, 1)
+		close(costCh)
+	}
+	return costCh
+}
+
+// SetWithAltKey is like Set, but also indexes the value under altKey so Get
+// works with either key. The value is only stored (and its cost only accounted
+// for) once: the policy only knows about key, and when key is deleted or
+// evicted altKey goes with it.
+//
+// Setting key again without an alternate key drops the previous altKey.
+func (c *Cache) SetWithAltKey(key, altKey, value interface{}, cost int64) bool {
+	if c == nil || key == nil || altKey == nil {
+		return false
+	}
+	i := c.setItem(key, value, cost, c.defaultTTL)
+	if i == nil {
+		return false
+	}
+	i.altKey, i.altHash = altKey, c.keyToHash(altKey, 0)
+	select {
+	case c.setBuf <- i:
+		return true
+	default:
+		c.Metrics.add(dropSets, i.keyHash, 1)
+		return false
+	}
+}
+
+// SetWithRetry is like Set, but rather than dropping the Set right away when
+// the Set buffer is full, it tries up to attempts times, sleeping for backoff
+// between attempts and doubling it each time. This is a middle ground for
+// writes that are important, but not important enough to block on.
+func (c *Cache) SetWithRetry(key, value interface{}, cost int64, attempts int,
+	backoff time.Duration) bool {
+	if c == nil || key == nil {
+		return false
+	}
+	i := c.setItem(key, value, cost, c.defaultTTL)
+	if i == nil {
+		return false
+	}
+	for n := 1; ; n++ {
+		select {
+		case c.setBuf <- i:
+			return true
+		default:
+		}
+		if n >= attempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	c.Metrics.add(dropSets, i.keyHash, 1)
+	return false
+}
+
+// SetWaitCapacity is like Set, but first waits until the cache has room for
+// the item without evicting anything, i.e. until the total cost plus cost is
+// at most MaxCost. It returns false without setting anything if there's still
+// no room after timeout. This is for callers that would rather wait for items
+// to be deleted than cause evictions.
+//
+// Room is checked against the items already processed, so concurrent Sets
+// still in the Set buffer can take it first and cause evictions anyway. If
+// cost is 0, it's computed as for Set, with Config.Cost or Sizer.
+func (c *Cache) SetWaitCapacity(key, value interface{}, cost int64,
+	timeout time.Duration) bool {
+	if c == nil || key == nil {
+		return false
+	}
+	need := cost
+	if need == 0 {
+		need = c.valueCost(value)
+	}
+	need += c.keyCost(key)
+	deadline := time.Now().Add(timeout)
+	backoff := time.Millisecond
+	for c.policy.Cap() < need {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return false
+		}
+		if backoff > left {
+			backoff = left
+		}
+		time.Sleep(backoff)
+		if backoff < maxCapacityBackoff {
+			backoff *= 2
+		}
+	}
+	return c.Set(key, value, cost)
+}
+
+// Merge updates the value of key with the result of calling merge on it, which
+// avoids the race of a Get followed by a Set for compound values such as maps
+// and structs. merge is called with the current value while the key is locked,
+// so it must be quick and must not use the cache. If the key is missing, merge
+// is called with nil and its result is Set like any new item, so it may still
+// be rejected by the policy.
+//
+// As with Set, the cost is updated asynchronously, Config.Cost is used to
+// compute it if cost is 0, and the item gets Config.DefaultTTL (replacing the
+// TTL it had). Merge returns false if the merged item was dropped.
+func (c *Cache) Merge(key interface{}, merge func(existing interface{}) interface{},
+	cost int64) bool {
+	if c == nil || key == nil || atomic.LoadInt32(&c.closed) == 1 {
+		return false
+	}
+	var i *item
+	var prev interface{}
+	keyHash := c.keyToHash(key, 0)
+	_, found := c.store.Merge(keyHash, key,
+		func(existing interface{}, expiration int64) (interface{}, int64) {
+			prev = existing
+			current := existing
+			if current != nil && c.valueDecoder != nil {
+				current, _ = c.decode(current)
+			}
+			if i = c.newItem(keyHash, key, merge(current), cost,
+				c.defaultTTL); i == nil {
+				// keep the current value
+				return existing, expiration
+			}
+			return i.value, i.expiration
+		})
+	if i == nil {
+		return false
+	}
+	if found {
+		i.flag = itemUpdate
+		if c.skipNoopUpdates {
+			i.prev = prev
+		}
+	}
+	select {
+	case c.setBuf <- i:
+		return true
+	default:
+		c.Metrics.add(dropSets, i.keyHash, 1)
+		return false
+	}
+}
+
+// KeyValueCost is a key-value item along with its cost, as passed to SetMany.
+type KeyValueCost struct {
+	Key   interface{}
+	Value interface{}
+	Cost  int64
+}
+
+// SetMany is like calling Set for every item, and returns the number of items
+// that made it into the Set buffer. The items are all prepared (hashed, and
+// updated right away if their key exists) before any is sent to the buffer, so
+// they're buffered in a tight loop. Like Set, items are dropped if the buffer
+// is full, and those buffered can still be rejected by the policy; Wait
+// returns once they've all been applied.
+func (c *Cache) SetMany(items []KeyValueCost) int {
+	if c == nil || len(items) == 0 {
+		return 0
+	}
+	prepared := make([]*item, 0, len(items))
+	for _, kvc := range items {
+		if kvc.Key == nil {
+			continue
+		}
+		if i := c.setItem(kvc.Key, kvc.Value, kvc.Cost, c.defaultTTL); i != nil {
+			prepared = append(prepared, i)
+		}
+	}
+	accepted := 0
+	for _, i := range prepared {
+		select {
+		case c.setBuf <- i:
+			accepted++
+		default:
+			c.Metrics.add(dropSets, i.keyHash, 1)
+		}
+	}
+	return accepted
+}
+
+// ValueCost is a value along with its cost, as passed to WarmMap.
+type ValueCost struct {
+	Value interface{}
+	Cost  int64
+}
+
+// WarmMap loads many items at once, such as from a snapshot at startup, so
+// they're all in the cache before it serves traffic. Unlike Set, the items are
+// applied directly rather than through the Set buffer, and they bypass
+// admission: every item that fits is added, evicting others if needed, and its
+// access frequency is seeded. Processing of Sets is stopped meanwhile.
+//
+// As with Set, Config.Cost is used to compute the cost of items with a cost of
+// 0, and Config.DefaultTTL applies.
+func (c *Cache) WarmMap(items map[interface{}]ValueCost) {
+	if c == nil || len(items) == 0 {
+		return
+	}
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return
+	}
+	// block until processItems goroutine is returned
+	c.stopProcessing()
+	for key, vc := range items {
+		if key == nil {
+			continue
+		}
+		i := c.setItem(key, vc.Value, vc.Cost, c.defaultTTL)
+		if i == nil {
+			continue
+		}
+		if i.flag == itemNew {
+			i.flag = itemWarm
+		}
+		c.processItem(i)
+	}
+	c.checkEmpty()
+	c.startProcessing()
+}
+
+// UpdateMaxCost changes the max cost of the cache, such as to shrink it while
+// memory is needed elsewhere and grow it back later. If the cost in use is over
+// the new max cost, items are evicted (as they would be to make room for a new
+// item) before UpdateMaxCost returns. Processing of Sets is stopped meanwhile,
+// so every Set still in the buffer is applied against the new max cost. A max
+// cost of 0 or less is ignored.
+func (c *Cache) UpdateMaxCost(maxCost int64) {
+	if c == nil || maxCost <= 0 {
+		return
+	}
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return
+	}
+	// block until processItems goroutine is returned
+	c.stopProcessing()
+	c.policy.UpdateMaxCost(maxCost)
+	c.evict(c.policy.Trim(maxCost))
+	c.checkEmpty()
+	c.startProcessing()
+}
+
+// setItem prepares the item to send to the Set buffer for a Set call, updating
+// the value right away if the key exists. It returns nil if the item can't be
+// Set (see newItem).
+func (c *Cache) setItem(key, value interface{}, cost int64,
+	ttl time.Duration) *item {
+	return c.setItemByHash(c.keyToHash(key, 0), key, value, cost, ttl)
+}
+
+// setItemByHash is like setItem, but with the hash of the key already computed.
+func (c *Cache) setItemByHash(keyHash uint64, key, value interface{},
+	cost int64, ttl time.Duration) *item {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return nil
+	}
+	i := c.newItem(keyHash, key, value, cost, ttl)
+	if i == nil {
+		return nil
+	}
+	// attempt to immediately update hashmap value and set flag to update so the
+	// cost is eventually updated
+	if prev, ok := c.store.Update(i.keyHash, i.key, i.value, i.expiration); ok {
+		i.flag = itemUpdate
+		if c.skipNoopUpdates {
+			i.prev = prev
+		}
+	}
+	return i
+}
+
+// newItem returns a new item for the key and its hash. It returns nil if the
+// value couldn't be encoded, or if the cache is being cleared and
+// Config.RejectSetsOnClear is set.
+func (c *Cache) newItem(keyHash uint64, key, value interface{}, cost int64,
+	ttl time.Duration) *item {
+	if c.rejectSetsOnClear && atomic.LoadInt32(&c.clearing) == 1 {
+		atomic.AddUint64(&c.clearSets, 1)
+		return nil
+	}
+	if b, ok := value.([]byte); ok && c.valueEncoder != nil {
+		encoded, err := c.valueEncoder(b)
+		if err != nil {
+			return nil
+		}
+		value = encoded
+	}
+	i := &item{
+		flag:    itemNew,
+		key:     key,
+		keyHash: keyHash,
+		value:   value,
+		cost:    cost,
+	}
+	if ttl > 0 {
+		i.expiration = time.Now().Add(ttl).UnixNano()
+	}
+	return i
+}
+
+// Del deletes the key-value item from the cache if it exists, and returns its
+// value and true if it did (and the item hadn't expired).
+//
+// The value is deleted from the hashmap right away, so it's returned at most
+// once even with concurrent Dels, while removing the key from the policy goes
+// through the Set buffer like before. The buffer is processed in order, so a
+// Set of the key after Del is only applied once the policy is done with the
+// deletion, and one before Del is removed by it. Meanwhile the key's cost is
+// still accounted for by the policy, and it can still be chosen as a victim,
+// which just finds nothing to delete.
+func (c *Cache) Del(key interface{}) (interface{}, bool) {
+	if c == nil || key == nil {
+		return nil, false
+	}
+	return c.del(c.delItem(key))
+}
+
+// DelByHash is like Del, but takes the hash of the key as computed by the
+// configured KeyToHash (see GetByHash). The key is still used to tell apart
+// keys with the same hash, and can be nil to skip those checks.
+func (c *Cache) DelByHash(keyHash uint64, key interface{}) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.del(&item{flag: itemDelete, key: key, keyHash: keyHash})
+}
+
+// del deletes the item's key from the hashmap and sends the item to the Set
+// buffer, for Del and DelByHash.
+func (c *Cache) del(i *item) (interface{}, bool) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return nil, false
+	}
+	key := i.key
+	deleted, ok := c.store.Del(i.keyHash, key)
+	i.value = deleted.value
+	c.push(i)
+	if !ok || (deleted.expiration != 0 &&
+		deleted.expired(time.Now().UnixNano())) {
+		return nil, false
+	}
+	value := deleted.value
+	if c.valueDecoder != nil {
+		if value, ok = c.decode(value); !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// delItem returns the item to send to the Set buffer for a Del call.
+func (c *Cache) delItem(key interface{}) *item {
+	return &item{
+		flag:    itemDelete,
+		key:     key,
+		keyHash: c.keyToHash(key, 0),
+	}
+}
+
+// Wait blocks until every Set, Del and other write buffered before the call has
+// been applied, so a following Get sees them (unless an item was rejected by
+// the policy). It's meant for tests and for warming up a cache before it
+// serves traffic; while the cache is paused, it blocks until Resume.
+func (c *Cache) Wait() {
+	if c == nil || atomic.LoadInt32(&c.closed) == 1 {
+		return
+	}
+	done := make(chan int64)
+	c.push(&item{flag: itemWait, costCh: done})
+	<-done
+}
+
+// push sends the item to the Set buffer, waiting for room in it unless the
+// cache is closed, in which case the item is dropped. It returns false if the
+// cache was closed meanwhile.
+func (c *Cache) push(i *item) bool {
+	select {
+	case c.setBuf <- i:
+	case <-c.closing:
+		i.drop()
+		return false
+	}
+	if atomic.LoadInt32(&c.closed) == 1 {
+		// Close may have drained the buffer before the item made it in, and
+		// nothing processes it anymore
+		c.dropBuffered()
+		return false
+	}
+	return true
+}
+
+// dropBuffered drops the items in the Set buffer without processing them.
+func (c *Cache) dropBuffered() {
+	for {
+		select {
+		case i := <-c.setBuf:
+			i.drop()
+		default:
+			return
+		}
+	}
+}
+
+// Close stops all goroutines. Items still waiting in the Set buffer are
+// dropped, and calling Close again is a no-op. After Close, Sets and Dels fail
+// and Gets miss, rather than panicking.
+func (c *Cache) Close() {
+	if c == nil || !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	c.procMu.Lock()
+	// block until processItems goroutine is returned
+	c.stopProcessing()
+	if c.lifetime != nil {
+		c.lifetime.Stop()
+	}
+	c.dropBuffered()
+	c.procMu.Unlock()
+	// the Set buffer isn't closed, since concurrent writes may still send to it
+	close(c.closing)
+	close(c.stop)
+	c.policy.Close()
+	if c.evictPool != nil {
+		c.evictPool.Close()
+	}
+	if c.evictBatcher != nil {
+		c.evictBatcher.Close()
+	}
+}
+
+// Clear empties the hashmap and zeroes all policy counters.
+//
+// It's safe to call while Sets, Gets and Dels are in flight. Processing of the
+// Set buffer is stopped meanwhile, but the buffer itself is never swapped out,
+// so concurrent Sets never panic: they're buffered (or dropped if the buffer is
+// full) as usual. Clear isn't atomic, since the shards of the hashmap are
+// emptied one at a time, but every concurrent operation observes a key either
+// before or after it's cleared: a Get either hits the old value or misses, and
+// a Set that races with Clear either is cleared along with everything else or
+// is applied to the emptied cache.
+//
+// Items still waiting in the Set buffer are dropped, unless Config.DrainOnClear
+// is set, in which case they're applied to the emptied cache before Clear
+// returns.
+func (c *Cache) Clear() {
+	c.clear(false)
+}
+
+// ClearWithShadow is like Clear, but rather than discarding the current
+// contents of the cache, it keeps them in a read-only shadow that Get falls
+// back to on a miss until DropShadow is called. This avoids a latency cliff
+// where every Get misses while the cache is being reloaded after a Clear.
+//
+// Values served from the shadow are counted by Metrics.StaleHits instead of
+// Metrics.Hits. Deleting a key removes it from the shadow as well, but the
+// shadow is otherwise never modified.
+func (c *Cache) ClearWithShadow() {
+	c.clear(true)
+}
+
+// DropShadow discards the contents kept by ClearWithShadow, once the cache has
+// been reloaded.
+func (c *Cache) DropShadow() {
+	if c == nil {
+		return
+	}
+	c.shadow.Store(&shadowStore{})
+}
+
+func (c *Cache) clear(shadow bool) {
+	if c == nil {
+		return
+	}
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	// the MaxLifetime timer can fire while the cache is being closed
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return
+	}
+	atomic.StoreInt32(&c.clearing, 1)
+	defer func() {
+		atomic.StoreInt32(&c.clearing, 0)
+		c.Metrics.add(clearSets, 0, atomic.SwapUint64(&c.clearSets, 0))
+	}()
+	// block until processItems goroutine is returned
+	c.stopProcessing()
+	if c.lifetime != nil {
+		c.lifetime.Reset(c.maxLifetime)
+	}
+	if c.drainOnClear {
+		// only drain what's buffered right now, so concurrent Sets can't keep
+		// Clear from returning
+		for n := len(c.setBuf); n > 0; n-- {
+			c.processItem(<-c.setBuf)
+		}
+	} else {
+		// drop what's buffered right now rather than swapping out the setBuf
+		// channel, which would race with concurrent Sets (such as from an
+		// admin endpoint, or during a MaxLifetime Clear)
+		for n := len(c.setBuf); n > 0; n-- {
+			(<-c.setBuf).drop()
+		}
+	}
+	if c.onEvict != nil || c.evictBatcher != nil {
+		c.evictAll()
+	}
+	// clear value hashmap and policy data
+	c.policy.Clear()
+	if shadow {
+		c.shadow.Store(&shadowStore{store: c.store.Take()})
+	} else {
+		c.store.Clear()
+	}
+	c.altKeys = make(map[uint64]uint64)
+	// only reset metrics if they're enabled
+	if c.Metrics != nil {
+		c.Metrics.Clear()
+	}
+	c.checkEmpty()
+	// restart processItems goroutine
+	c.startProcessing()
+}
+
+// Pause stops processing the Set buffer until Resume is called, giving a window
+// where the contents of the cache are frozen and can be inspected
+// consistently. Gets keep working as usual, while Sets are buffered and start
+// being dropped once the buffer is full.
+func (c *Cache) Pause() {
+	if c == nil {
+		return
+	}
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return
+	}
+	c.stopProcessing()
+	c.paused = true
+}
+
+// Resume restarts processing of the Set buffer after Pause.
+func (c *Cache) Resume() {
+	if c == nil {
+		return
+	}
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	if c.paused && atomic.LoadInt32(&c.closed) == 0 {
+		c.paused = false
+		c.startProcessing()
+	}
+}
+
+// stopProcessing blocks until the processItems goroutine has returned, unless
+// it's already stopped because the cache is paused. procMu must be held.
+func (c *Cache) stopProcessing() {
+	if !c.paused {
+		c.stop <- struct{}{}
+		<-c.done
+	}
+}
+
+// startProcessing starts the processItems goroutine, unless the cache is
+// paused. procMu must be held.
+func (c *Cache) startProcessing() {
+	if !c.paused {
+		c.done = make(chan struct{})
+		go c.processItems(c.setBuf, c.done)
+	}
+}
+
+// Healthy returns false if items are waiting in the Set buffer but the
+// goroutine processing them hasn't made progress for longer than maxStale, such
+// as when it's blocked by a slow OnEvict callback. This surfaces stalls before
+// the buffer fills up and Sets start being dropped.
+func (c *Cache) Healthy(maxStale time.Duration) bool {
+	if c == nil || len(c.setBuf) == 0 {
+		return true
+	}
+	last := time.Unix(0, atomic.LoadInt64(&c.heartbeat))
+	return time.Since(last) <= maxStale
+}
+
+// processItems is run by goroutines processing the Set buffer. It closes done
+// when it returns. With more than one Set worker, it dispatches the items to
+// the workers instead, and stops them before returning.
+func (c *Cache) processItems(setBuf chan *item, done chan struct{}) {
+	defer close(done)
+	var workers []chan *item
+	if c.setWorkers > 1 {
+		var wg sync.WaitGroup
+		workers = make([]chan *item, c.setWorkers)
+		for n := range workers {
+			workers[n] = make(chan *item, setWorkerBufSize)
+			wg.Add(1)
+			go func(items chan *item) {
+				defer wg.Done()
+				c.processSetWorker(items)
+			}(workers[n])
+		}
+		defer func() {
+			// the workers process whatever is left in their buffers first
+			for _, items := range workers {
+				close(items)
+			}
+			wg.Wait()
+		}()
+	}
+	for {
+		atomic.StoreInt64(&c.heartbeat, time.Now().UnixNano())
+		select {
+		case i := <-setBuf:
+			atomic.StoreInt64(&c.heartbeat, time.Now().UnixNano())
+			if workers != nil {
+				c.dispatchItem(workers, i)
+				continue
+			}
+			c.processItem(i)
+			if len(setBuf) == 0 {
+				c.checkEmpty()
+			}
+		case <-c.reclaim:
+			// release half of the cost currently held
+			c.evict(c.policy.Trim(c.policy.Used() / 2))
+			c.checkEmpty()
+		case <-c.sweep:
+			c.evict(c.policy.Expired(time.Now().UnixNano()))
+			c.checkEmpty()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// processSetWorker processes the items dispatched to a Set worker until its
+// buffer is closed.
+func (c *Cache) processSetWorker(items chan *item) {
+	for i := range items {
+		atomic.StoreInt64(&c.heartbeat, time.Now().UnixNano())
+		c.processItem(i)
+		if len(items) == 0 {
+			c.checkEmpty()
+		}
+	}
+}
+
+// dispatchItem passes the item to a Set worker chosen by its key hash, so all
+// items of a key are processed in order by the same worker. Items waited on by
+// Wait are passed to every worker, and only done once all of them are.
+func (c *Cache) dispatchItem(workers []chan *item, i *item) {
+	if i.flag != itemWait {
+		workers[i.keyHash%uint64(len(workers))] <- i
+		return
+	}
+	waits := make([]chan int64, len(workers))
+	for n, items := range workers {
+		waits[n] = make(chan int64)
+		items <- &item{flag: itemWait, costCh: waits[n]}
+	}
+	for _, wait := range waits {
+		<-wait
+	}
+	c.processItem(i)
+}
+
+// processItem applies a single item taken from the Set buffer to the policy and
+// the hashmap.
+func (c *Cache) processItem(i *item) {
+	// deferred first so it runs last, once the channels are closed
+	defer c.recoverCallback()
+	if i.costCh != nil {
+		defer close(i.costCh)
+	}
+	if i.victimsCh != nil {
+		defer close(i.victimsCh)
+	}
+	if i.flag == itemWait {
+		return
+	}
+	if c.mirror != nil {
+		c.mirrorItem(i)
+	}
+	if i.flag == itemUpdate && c.skipNoopUpdates && c.isNoopUpdate(i) {
+		if cost := c.policy.Cost(i.keyHash); cost != -1 {
+			i.deliverCost(cost)
+			i.deliverVictims(nil)
+		}
+		return
+	}
+	// calculate item cost value if new or update
+	if i.cost == 0 && i.flag != itemDelete {
+		i.cost = c.valueCost(i.value)
+	}
+	if i.flag != itemDelete {
+		i.cost += c.keyCost(i.key)
+		c.Metrics.add(costThroughput, i.keyHash, uint64(i.cost))
+		if c.maxCostPerItem > 0 && i.cost > c.maxCostPerItem {
+			c.rejectOversized(i)
+			return
+		}
+	}
+	switch i.flag {
+	case itemNew, itemWarm:
+		add := c.policy.Add
+		if i.flag == itemWarm {
+			add = c.policy.Warm
+		}
+		victims, added := add(i.keyHash, i.cost)
+		if added {
+			// item was accepted by the policy, so add to the hashmap (unless
+			// it's there already, which could overwrite a later update)
+			if !i.stored {
+				c.store.Set(i.keyHash, i.key, i.value, i.expiration)
+			}
+			c.setAlt(i)
+			// always set, since an expired key that wasn't swept yet is
+			// updated by Add and its old expiration has to be cleared
+			c.policy.SetExpiration(i.keyHash, i.expiration)
+			if c.onAdmit != nil {
+				c.onAdmit(i.keyHash, i.value, i.cost)
+			}
+			i.deliverCost(i.cost)
+			i.deliverVictims(victims)
+		} else if i.stored {
+			c.store.Del(i.keyHash, i.key)
+		}
+		c.evict(victims)
+	case itemUpdate:
+		c.policy.Update(i.keyHash, i.cost)
+		c.policy.SetExpiration(i.keyHash, i.expiration)
+		if c.policy.Has(i.keyHash) {
+			c.setAlt(i)
+			i.deliverCost(i.cost)
+			i.deliverVictims(nil)
+		}
+	case itemDelete:
+		cost := c.policy.Cost(i.keyHash)
+		c.policy.Del(i.keyHash)
+		// the value is usually deleted from the hashmap by Del already, in
+		// which case it's passed along in the item
+		if deleted, ok := c.store.Del(i.keyHash, i.key); ok {
+			i.value = deleted.value
+		}
+		c.delAlt(i.keyHash)
+		if cost != -1 && (c.onEvict != nil || c.evictBatcher != nil) {
+			c.evicted(&item{keyHash: i.keyHash, key: i.key, value: i.value,
+				cost: cost}, EvictDel)
+		}
+		if shadow := c.shadow.Load().(*shadowStore).store; shadow != nil {
+			shadow.Del(i.keyHash, i.key)
+		}
+	}
 }
 
-type itemFlag byte
-
-const (
-	itemNew itemFlag = iota
-	itemDelete
-	itemUpdate
-)
-
-// item is passed to setBuf so items can eventually be added to the cache
-type item struct {
-	flag    itemFlag
-	key     interface{}
-	keyHash uint64
-	value   interface{}
-	cost    int64
+// evict deletes the victims (already removed from the policy) from the hashmap
+// and passes them on to the eviction callbacks.
+func (c *Cache) evict(victims []*item) {
+	var now int64
+	for _, victim := range victims {
+		// force delete with no collision checking because we
+		// don't have access to the original, unhashed key (the store only
+		// returns it with Config.StoreKeys)
+		deleted, _ := c.store.Del(victim.keyHash, nil)
+		victim.key, victim.value = deleted.key, deleted.value
+		c.delAlt(victim.keyHash)
+		if c.onEvict == nil && c.evictBatcher == nil && c.onLargeEvict == nil {
+			continue
+		}
+		reason := EvictCapacity
+		if victim.expiration != 0 {
+			if now == 0 {
+				now = time.Now().UnixNano()
+			}
+			if victim.expiration <= now {
+				reason = EvictExpired
+			}
+		}
+		if c.onEvict != nil || c.evictBatcher != nil {
+			c.evicted(victim, reason)
+		}
+		if c.onLargeEvict != nil && reason == EvictCapacity &&
+			victim.cost > c.largeEvictThreshold {
+			c.onLargeEvict(victim.keyHash, victim.value, victim.cost)
+		}
+	}
 }
 
-// NewCache returns a new Cache instance and any configuration errors, if any.
-func NewCache(config *Config) (*Cache, error) {
-	switch {
-	case config.NumCounters == 0:
-		return nil, errors.New("NumCounters can't be zero.")
-	case config.MaxCost == 0:
-		return nil, errors.New("MaxCost can't be zero.")
-	case config.BufferItems == 0:
-		return nil, errors.New("BufferItems can't be zero.")
+// evictAll passes every item in the cache to the eviction callbacks, as they're
+// about to be cleared. Expired items the sweeper hasn't gotten to yet are
+// skipped.
+func (c *Cache) evictAll() {
+	alts := make(map[uint64]struct{}, len(c.altKeys))
+	for _, altHash := range c.altKeys {
+		alts[altHash] = struct{}{}
 	}
-	policy := newPolicy(config.NumCounters, config.MaxCost)
-	cache := &Cache{
-		store:     newStore(config.Hashes),
-		policy:    policy,
-		getBuf:    newRingBuffer(policy, config.BufferItems),
-		setBuf:    make(chan *item, setBufSize),
-		onEvict:   config.OnEvict,
-		keyToHash: config.KeyToHash,
-		stop:      make(chan struct{}),
-		cost:      config.Cost,
+	victims := make([]*item, 0)
+	c.store.Range(func(i storeItem) bool {
+		if _, ok := alts[i.keyHash]; ok {
+			return true
+		}
+		if cost := c.policy.Cost(i.keyHash); cost != -1 {
+			victims = append(victims, &item{keyHash: i.keyHash, key: i.key,
+				value: i.value, cost: cost})
+		}
+		return true
+	})
+	// Range holds the shard locks, so the callbacks only run once it returns
+	// in case they Set or Del keys of the cache
+	for _, victim := range victims {
+		c.evicted(victim, EvictClear)
 	}
-	if cache.keyToHash == nil {
-		cache.keyToHash = z.KeyToHash
+}
+
+// setAlt indexes the item's value under its alternate key, replacing any
+// alternate key previously Set for the same key.
+func (c *Cache) setAlt(i *item) {
+	if i.altKey == nil {
+		c.delAlt(i.keyHash)
+		return
 	}
-	if config.Metrics {
-		cache.collectMetrics()
+	c.procStateMu.Lock()
+	defer c.procStateMu.Unlock()
+	if altHash, ok := c.altKeys[i.keyHash]; ok && altHash != i.altHash {
+		c.store.Del(altHash, nil)
 	}
-	// NOTE: benchmarks seem to show that performance decreases the more
-	//       goroutines we have running cache.processItems(), so 1 should
-	//       usually be sufficient
-	go cache.processItems()
-	return cache, nil
+	c.store.Set(i.altHash, i.altKey, i.value, i.expiration)
+	c.altKeys[i.keyHash] = i.altHash
 }
 
-// Get returns the value (if any) and a boolean representing whether the
-// value was found or not. The value can be nil and the boolean can be true at
-// the same time.
-func (c *Cache) Get(key interface{}) (interface{}, bool) {
-	if c == nil || key == nil {
-		return nil, false
+// delAlt deletes the alternate key index entry of the key hash, if it has one.
+func (c *Cache) delAlt(keyHash uint64) {
+	c.procStateMu.Lock()
+	defer c.procStateMu.Unlock()
+	if altHash, ok := c.altKeys[keyHash]; ok {
+		c.store.Del(altHash, nil)
+		delete(c.altKeys, keyHash)
 	}
-	hashed := z.KeyToHash(key, 0)
-	c.getBuf.Push(hashed)
-	value, ok := c.store.Get(hashed, key)
-	if ok {
-		c.Metrics.add(hit, hashed, 1)
-	} else {
-		c.Metrics.add(miss, hashed, 1)
+}
+
+// evicted passes the victim to onEvict, either directly or through the
+// evictPool, and to the evictBatcher.
+func (c *Cache) evicted(victim *item, reason EvictReason) {
+	newItem := func() *Item {
+		return &Item{
+			Key:         victim.keyHash,
+			OriginalKey: victim.key,
+			Value:       victim.value,
+			Cost:        victim.cost,
+			Reason:      reason,
+		}
+	}
+	if c.evictBatcher != nil {
+		if !c.evictBatcher.Push(newItem()) {
+			c.Metrics.add(dropEvicts, victim.keyHash, 1)
+		}
+	}
+	if c.onEvict == nil {
+		return
+	}
+	if c.evictPool == nil {
+		c.onEvict(newItem())
+		return
+	}
+	if !c.evictPool.Push(newItem()) {
+		c.Metrics.add(dropEvicts, victim.keyHash, 1)
 	}
-	return value, ok
 }
 
-// Set attempts to add the key-value item to the cache. If it returns false,
-// then the Set was dropped and the key-value item isn't added to the cache. If
-// it returns true, there's still a chance it could be dropped by the policy if
-// its determined that the key-value item isn't worth keeping, but otherwise the
-// item will be added and other items will be evicted in order to make room.
-//
-// To dynamically evaluate the items cost using the Config.Coster function, set
-// the cost parameter to 0 and Coster will be ran when needed in order to find
-// the items true cost.
-func (c *Cache) Set(key, value interface{}, cost int64) bool {
-	if c == nil || key == nil {
-		return false
+// gcSentinel is an object whose finalizer is used to get notified of garbage
+// collection cycles.
+type gcSentinel struct {
+	cache *Cache
+}
+
+// watchMemory arranges for checkMemory to be called after the next garbage
+// collection cycle.
+func (c *Cache) watchMemory() {
+	runtime.SetFinalizer(&gcSentinel{cache: c}, func(s *gcSentinel) {
+		s.cache.checkMemory()
+	})
+}
+
+// checkMemory signals processItems to reclaim items if the heap is above the
+// soft memory limit, and keeps watching until the cache is closed.
+func (c *Cache) checkMemory() {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return
 	}
-	i := &item{
-		flag:    itemNew,
-		key:     key,
-		keyHash: z.KeyToHash(key, 0),
-		value:   value,
-		cost:    cost,
+	stats := &runtime.MemStats{}
+	runtime.ReadMemStats(stats)
+	if stats.HeapAlloc > c.softMemoryLimit {
+		select {
+		case c.reclaim <- struct{}{}:
+		default:
+			// reclaim already pending
+		}
 	}
-	// attempt to immediately update hashmap value and set flag to update so the
-	// cost is eventually updated
-	if c.store.Update(i.keyHash, i.key, i.value) {
-		i.flag = itemUpdate
+	c.watchMemory()
+}
+
+// sweepExpired periodically signals processItems to purge expired items, so
+// they don't hold on to memory until they're evicted, until the cache is
+// closed.
+func (c *Cache) sweepExpired() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case c.sweep <- struct{}{}:
+			default:
+				// sweep already pending
+			}
+		case <-c.closing:
+			return
+		}
 	}
-	// attempt to send item to policy
-	select {
-	case c.setBuf <- i:
-		return true
-	default:
-		c.Metrics.add(dropSets, i.keyHash, 1)
-		return false
+}
+
+// recordRates periodically snapshots the counters of m for Metrics.Rates, until
+// the cache is closed.
+func (c *Cache) recordRates(m *Metrics) {
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.record()
+		case <-c.closing:
+			return
+		}
 	}
 }
 
-// Del deletes the key-value item from the cache if it exists.
-func (c *Cache) Del(key interface{}) {
-	if c == nil || key == nil {
+// checkEmpty calls onFirstItem or onEmpty if the cache's emptiness changed since
+// the last check.
+func (c *Cache) checkEmpty() {
+	if c.onFirstItem == nil && c.onEmpty == nil {
 		return
 	}
-	c.setBuf <- &item{
-		flag:    itemDelete,
-		key:     key,
-		keyHash: z.KeyToHash(key, 0),
+	c.procStateMu.Lock()
+	defer c.procStateMu.Unlock()
+	empty := c.policy.Len() == 0
+	if empty == c.empty {
+		return
+	}
+	c.empty = empty
+	if empty && c.onEmpty != nil {
+		c.onEmpty()
+	} else if !empty && c.onFirstItem != nil {
+		c.onFirstItem()
 	}
 }
 
-// Close stops all goroutines and closes all channels.
-func (c *Cache) Close() {
-	// block until processItems goroutine is returned
-	c.stop <- struct{}{}
-	close(c.stop)
-	close(c.setBuf)
-	c.policy.Close()
+// rejectOversized drops an item over Config.MaxCostPerItem. If it updates an
+// existing key, the key is removed, since its new value is already stored.
+func (c *Cache) rejectOversized(i *item) {
+	c.Metrics.add(rejectOversize, i.keyHash, 1)
+	switch {
+	case i.flag == itemUpdate:
+		c.policy.Del(i.keyHash)
+		c.store.Del(i.keyHash, i.key)
+		c.delAlt(i.keyHash)
+	case i.stored:
+		c.store.Del(i.keyHash, i.key)
+	}
 }
 
-// Clear empties the hashmap and zeroes all policy counters. Note that this is
-// not an atomic operation (but that shouldn't be a problem as it's assumed that
-// Set/Get calls won't be occurring until after this).
-func (c *Cache) Clear() {
-	// block until processItems goroutine is returned
-	c.stop <- struct{}{}
-	// swap out the setBuf channel
-	c.setBuf = make(chan *item, setBufSize)
-	// clear value hashmap and policy data
-	c.policy.Clear()
-	c.store.Clear()
-	// only reset metrics if they're enabled
-	if c.Metrics != nil {
-		c.Metrics.Clear()
+// guardCallbacks wraps the event callbacks so panics in them are recovered by
+// recoverCallback, instead of killing the goroutine they run on.
+func (c *Cache) guardCallbacks() {
+	if onEvict := c.onEvict; onEvict != nil {
+		c.onEvict = func(i *Item) {
+			defer c.recoverCallback()
+			onEvict(i)
+		}
+	}
+	if onAdmit := c.onAdmit; onAdmit != nil {
+		c.onAdmit = func(key uint64, value interface{}, cost int64) {
+			defer c.recoverCallback()
+			onAdmit(key, value, cost)
+		}
+	}
+	if onLargeEvict := c.onLargeEvict; onLargeEvict != nil {
+		c.onLargeEvict = func(key uint64, value interface{}, cost int64) {
+			defer c.recoverCallback()
+			onLargeEvict(key, value, cost)
+		}
+	}
+	if onFirstItem := c.onFirstItem; onFirstItem != nil {
+		c.onFirstItem = func() {
+			defer c.recoverCallback()
+			onFirstItem()
+		}
+	}
+	if onEmpty := c.onEmpty; onEmpty != nil {
+		c.onEmpty = func() {
+			defer c.recoverCallback()
+			onEmpty()
+		}
 	}
-	// restart processItems goroutine
-	go c.processItems()
 }
 
-// processItems is ran by goroutines processing the Set buffer.
-func (c *Cache) processItems() {
-	for {
+// recoverCallback recovers from a panic in a callback, counting it and passing
+// it to Config.OnPanic. It must be deferred directly.
+func (c *Cache) recoverCallback() {
+	if r := recover(); r != nil {
+		c.Metrics.add(callbackPanics, 0, 1)
+		if c.onPanic != nil {
+			c.onPanic(r)
+		}
+	}
+}
+
+// mirrorItem forwards the Set or Del to the mirror cache without blocking.
+func (c *Cache) mirrorItem(i *item) {
+	var sent bool
+	if i.flag == itemDelete {
+		// a DelByHash without the key can only be forwarded by its hash
+		del := &item{flag: itemDelete, keyHash: i.keyHash}
+		if i.key != nil {
+			del = c.mirror.delItem(i.key)
+		}
 		select {
-		case i := <-c.setBuf:
-			// calculate item cost value if new or update
-			if i.cost == 0 && c.cost != nil && i.flag != itemDelete {
-				i.cost = c.cost(i.value)
-			}
-			switch i.flag {
-			case itemNew:
-				victims, added := c.policy.Add(i.keyHash, i.cost);
-				if added {
-					// item was accepted by the policy, so add to the hashmap
-					c.store.Set(i.keyHash, i.key, i.value)
-				}
-				// delete victims
-				for _, victim := range victims {
-					// TODO: make Get-Delete atomic
-					if c.onEvict != nil {
-						// force get with no collision checking because
-						// we don't have access to the victim's key
-						victim.value, _ = c.store.Get(victim.keyHash, nil)
-						c.onEvict(victim.keyHash, victim.value, victim.cost)
-					}
-					// force delete with no collision checking because we
-					// don't have access to the original, unhashed key
-					c.store.Del(victim.keyHash, nil)
-				}
-			case itemUpdate:
-				c.policy.Update(i.keyHash, i.cost)
-			case itemDelete:
-				c.policy.Del(i.keyHash)
-				c.store.Del(i.keyHash, i.key)
-			}
-		case <-c.stop:
-			return
+		case c.mirror.setBuf <- del:
+			sent = true
+		default:
 		}
+	} else if i.altKey != nil {
+		sent = c.mirror.SetWithAltKey(i.key, i.altKey, i.value, i.cost)
+	} else if i.expiration != 0 {
+		ttl := time.Until(time.Unix(0, i.expiration))
+		// an item that already expired is as good as forwarded
+		sent = ttl <= 0 || c.mirror.SetWithTTL(i.key, i.value, i.cost, ttl)
+	} else {
+		sent = c.mirror.Set(i.key, i.value, i.cost)
+	}
+	if !sent {
+		c.Metrics.add(dropMirrors, i.keyHash, 1)
+	}
+}
+
+// isNoopUpdate returns true if the update neither changes the stored value nor
+// the cost recorded by the policy.
+func (c *Cache) isNoopUpdate(i *item) bool {
+	if !c.valueEqual(i.prev, i.value) {
+		return false
+	}
+	if i.cost == 0 {
+		// compute the cost now (so it isn't computed again if the update
+		// goes through), since the recorded cost may have been passed to Set
+		i.cost = c.valueCost(i.value)
+	}
+	return i.cost+c.keyCost(i.key) == c.policy.Cost(i.keyHash)
+}
+
+// keyCost returns the estimated size of the key if Config.IncludeKeyCost is
+// set, and 0 otherwise.
+func (c *Cache) keyCost(key interface{}) int64 {
+	if !c.includeKeyCost {
+		return 0
+	}
+	switch k := key.(type) {
+	case string:
+		return int64(len(k))
+	case []byte:
+		return int64(len(k))
+	default:
+		return 8
 	}
 }
 
-// collectMetrics just creates a new *Metrics instance and adds the pointers
-// to the cache and policy instances.
-func (c *Cache) collectMetrics() {
-	c.Metrics = newMetrics()
+// collectMetrics just creates a new *Metrics instance, passing events to sink
+// if not nil, and adds the pointers to the cache and policy instances.
+func (c *Cache) collectMetrics(sink MetricsSink) {
+	if sink != nil {
+		c.Metrics = &Metrics{sink: sink}
+	} else {
+		c.Metrics = newMetrics()
+	}
 	c.policy.CollectMetrics(c.Metrics)
 }
 
+// MetricsSink receives cache events as they happen, for Config.MetricsSink.
+// Its methods are called from the goroutines calling Get and processing Sets,
+// so they must be safe for concurrent use and fast, as they hold those up.
+type MetricsSink interface {
+	// IncrHit is called for every Get hit.
+	IncrHit()
+	// IncrMiss is called for every Get miss.
+	IncrMiss()
+	// IncrAdd is called for every key added, with its cost.
+	IncrAdd(cost int64)
+	// IncrUpdate is called for every key updated.
+	IncrUpdate()
+	// IncrEvict is called for every key evicted, with its cost.
+	IncrEvict(cost int64)
+	// IncrDropSet is called for every Set dropped because the Set buffer was
+	// full.
+	IncrDropSet()
+	// IncrRejectSet is called for every Set rejected by the policy.
+	IncrRejectSet()
+}
+
+// sinkAdd passes the metric to the sink. Metrics the sink doesn't have a method
+// for, and the key counts that go along with costs, are ignored.
+func (p *Metrics) sinkAdd(t metricType, delta uint64) {
+	switch t {
+	case hit:
+		p.sink.IncrHit()
+	case miss:
+		p.sink.IncrMiss()
+	case costAdd:
+		p.sink.IncrAdd(int64(delta))
+	case keyUpdate:
+		p.sink.IncrUpdate()
+	case costEvict:
+		p.sink.IncrEvict(int64(delta))
+	case dropSets:
+		p.sink.IncrDropSet()
+	case rejectSets:
+		p.sink.IncrRejectSet()
+	}
+}
+
 type metricType int
 
 const (
@@ -325,6 +2883,22 @@ const (
 	// floor.
 	dropGets
 	keepGets
+	// The following keeps track of evictions not passed to an async OnEvict.
+	dropEvicts
+	// The following keeps track of hits served by the ClearWithShadow shadow.
+	staleHit
+	// The following keeps track of Sets and Dels not forwarded to the mirror.
+	dropMirrors
+	// The following keeps track of the cost of all Sets processed, whether
+	// they were admitted or not.
+	costThroughput
+	// The following keeps track of Sets rejected because of a Clear.
+	clearSets
+	// The following keeps track of Sets rejected for exceeding MaxCostPerItem
+	// or MaxCost.
+	rejectOversize
+	// The following keeps track of panics recovered from callbacks.
+	callbackPanics
 	// This should be the final enum. Other enums should be set before this.
 	doNotUse
 )
@@ -353,6 +2927,20 @@ func stringFor(t metricType) string {
 		return "gets-dropped"
 	case keepGets:
 		return "gets-kept"
+	case dropEvicts:
+		return "evictions-dropped"
+	case staleHit:
+		return "stale-hit"
+	case dropMirrors:
+		return "mirrors-dropped"
+	case costThroughput:
+		return "cost-throughput"
+	case clearSets:
+		return "sets-rejected-on-clear"
+	case rejectOversize:
+		return "sets-rejected-oversize"
+	case callbackPanics:
+		return "callback-panics"
 	default:
 		return "unidentified"
 	}
@@ -362,6 +2950,21 @@ func stringFor(t metricType) string {
 // instance.
 type Metrics struct {
 	all [doNotUse][]*uint64
+	// sink, if not nil, is passed the metrics instead of the counters above
+	sink MetricsSink
+	// resets is the number of times each counter was zeroed, so Rates can tell
+	// a Clear apart from a counter wrapping around
+	resets [doNotUse]uint64
+	// rateMu guards snapshots, the snapshots taken for Rates (oldest first)
+	rateMu    sync.Mutex
+	snapshots []metricsSnapshot
+}
+
+// metricsSnapshot is the value of every counter at a point in time.
+type metricsSnapshot struct {
+	at       time.Time
+	counters [doNotUse]uint64
+	resets   [doNotUse]uint64
 }
 
 func newMetrics() *Metrics {
@@ -380,6 +2983,10 @@ func (p *Metrics) add(t metricType, hash, delta uint64) {
 	if p == nil {
 		return
 	}
+	if p.sink != nil {
+		p.sinkAdd(t, delta)
+		return
+	}
 	valp := p.all[t]
 	// Avoid false sharing by padding at least 64 bytes of space between two
 	// atomic counters which would be incremented.
@@ -411,6 +3018,12 @@ func (p *Metrics) Misses() uint64 {
 	return p.get(miss)
 }
 
+// StaleHits is the number of Get calls where a value was found in the contents
+// kept by ClearWithShadow.
+func (p *Metrics) StaleHits() uint64 {
+	return p.get(staleHit)
+}
+
 // KeysAdded is the total number of Set calls where a new key-value item was
 // added.
 func (p *Metrics) KeysAdded() uint64 {
@@ -459,6 +3072,12 @@ func (p *Metrics) GetsKept() uint64 {
 	return p.get(keepGets)
 }
 
+// EvictionsDropped is the number of evictions that weren't passed to OnEvict
+// or OnEvictBatch because the OnEvictAsync or batching queue was full.
+func (p *Metrics) EvictionsDropped() uint64 {
+	return p.get(dropEvicts)
+}
+
 // Ratio is the number of Hits over all accesses (Hits + Misses). This is the
 // percentage of successful Get calls.
 func (p *Metrics) Ratio() float64 {
@@ -472,14 +3091,180 @@ func (p *Metrics) Ratio() float64 {
 	return float64(hits) / float64(hits+misses)
 }
 
+// SetsRejectedOnClear is the number of Set calls rejected because the cache
+// was being cleared, with Config.RejectSetsOnClear.
+func (p *Metrics) SetsRejectedOnClear() uint64 {
+	return p.get(clearSets)
+}
+
+// SetsRejectedOversize is the number of Sets rejected because their cost
+// exceeded Config.MaxCostPerItem or MaxCost, which aren't counted by
+// SetsRejected.
+func (p *Metrics) SetsRejectedOversize() uint64 {
+	return p.get(rejectOversize)
+}
+
+// CallbackPanics is the number of panics recovered from callbacks such as
+// Config.Cost and Config.OnEvict (see Config.OnPanic).
+func (p *Metrics) CallbackPanics() uint64 {
+	return p.get(callbackPanics)
+}
+
+// MirrorsDropped is the number of Sets and Dels that weren't forwarded to
+// Config.Mirror because its buffer was full.
+func (p *Metrics) MirrorsDropped() uint64 {
+	return p.get(dropMirrors)
+}
+
+// ThroughputCost is the sum of the costs of all Sets processed, including the
+// ones rejected by the policy (unlike CostAdded). It measures the offered load
+// in cost units, which helps with capacity planning.
+func (p *Metrics) ThroughputCost() uint64 {
+	return p.get(costThroughput)
+}
+
+// UpdateRatio is the number of Sets that updated an existing key over all Sets
+// processed by the policy (KeysUpdated / (KeysAdded + KeysUpdated)). A high
+// ratio means the cache is mostly refreshing keys it already holds, while a low
+// ratio along with many evictions suggests the cache is thrashing.
+func (p *Metrics) UpdateRatio() float64 {
+	if p == nil {
+		return 0.0
+	}
+	added, updated := p.get(keyAdd), p.get(keyUpdate)
+	if added == 0 && updated == 0 {
+		return 0.0
+	}
+	return float64(updated) / float64(added+updated)
+}
+
+// EvictionsPerAdd is the average number of keys evicted for each key added
+// (KeysEvicted / KeysAdded). A value near 0 means the cache rarely has to evict
+// to make room, while a value near or above 1 means it's churning and MaxCost
+// is likely too small for the working set.
+func (p *Metrics) EvictionsPerAdd() float64 {
+	if p == nil {
+		return 0.0
+	}
+	added := p.get(keyAdd)
+	if added == 0 {
+		return 0.0
+	}
+	return float64(p.get(keyEvict)) / float64(added)
+}
+
+// RateStats holds the per-second rate of change of the most commonly graphed
+// counters, as measured by Metrics.Rates.
+type RateStats struct {
+	// Hits is the number of Get hits per second.
+	Hits float64
+	// Misses is the number of Get misses per second.
+	Misses float64
+	// Evictions is the number of keys evicted per second.
+	Evictions float64
+	// SetsDropped is the number of Set calls dropped per second.
+	SetsDropped float64
+}
+
+// Rates returns the per-second rates of the counters over the last window,
+// without blocking: the counters are snapshotted every second in the
+// background, and the rates are computed since the newest snapshot at least
+// over old. Snapshots are only kept for a minute, so longer windows (and
+// windows reaching back before the cache was created) are cut short.
+func (p *Metrics) Rates(over time.Duration) RateStats {
+	if p == nil {
+		return RateStats{}
+	}
+	cur := p.snapshot()
+	p.rateMu.Lock()
+	defer p.rateMu.Unlock()
+	if len(p.snapshots) == 0 {
+		return RateStats{}
+	}
+	prev := p.snapshots[0]
+	for i := len(p.snapshots) - 1; i >= 0; i-- {
+		if cur.at.Sub(p.snapshots[i].at) >= over {
+			prev = p.snapshots[i]
+			break
+		}
+	}
+	return rates(prev, cur)
+}
+
+// snapshot returns the current value of every counter.
+func (p *Metrics) snapshot() metricsSnapshot {
+	s := metricsSnapshot{at: time.Now()}
+	for i := range s.counters {
+		s.resets[i] = atomic.LoadUint64(&p.resets[i])
+		s.counters[i] = p.get(metricType(i))
+	}
+	return s
+}
+
+// record keeps a snapshot of the counters for Rates, dropping the oldest one
+// once there are rateSnapshots.
+func (p *Metrics) record() {
+	s := p.snapshot()
+	p.rateMu.Lock()
+	defer p.rateMu.Unlock()
+	if len(p.snapshots) == rateSnapshots {
+		p.snapshots = append(p.snapshots[:0], p.snapshots[1:]...)
+	}
+	p.snapshots = append(p.snapshots, s)
+}
+
+// rates computes the per-second rates between two snapshots.
+func rates(prev, cur metricsSnapshot) RateStats {
+	elapsed := cur.at.Sub(prev.at)
+	if elapsed <= 0 {
+		return RateStats{}
+	}
+	secs := elapsed.Seconds()
+	rate := func(t metricType) float64 {
+		// a counter that was zeroed by Clear in between the snapshots counted
+		// everything it holds now in the window
+		if cur.resets[t] != prev.resets[t] {
+			return float64(cur.counters[t]) / secs
+		}
+		// otherwise the difference is right even if the counter wrapped
+		// around
+		return float64(cur.counters[t]-prev.counters[t]) / secs
+	}
+	return RateStats{
+		Hits:        rate(hit),
+		Misses:      rate(miss),
+		Evictions:   rate(keyEvict),
+		SetsDropped: rate(dropSets),
+	}
+}
+
 func (p *Metrics) Clear() {
 	if p == nil {
 		return
 	}
 	for i := 0; i < doNotUse; i++ {
-		for j := range p.all[i] {
-			atomic.StoreUint64(p.all[i][j], 0)
-		}
+		p.clearType(metricType(i))
+	}
+}
+
+// ResetHitMiss zeroes the Hits, Misses and StaleHits counters (and so Ratio),
+// leaving the others untouched. This lets the hit ratio be measured over a
+// window, such as a benchmarking phase, without resetting the cumulative
+// eviction and cost counters.
+func (p *Metrics) ResetHitMiss() {
+	if p == nil {
+		return
+	}
+	p.clearType(hit)
+	p.clearType(miss)
+	p.clearType(staleHit)
+}
+
+// clearType zeroes the counter of a single metric type.
+func (p *Metrics) clearType(t metricType) {
+	atomic.AddUint64(&p.resets[t], 1)
+	for j := range p.all[t] {
+		atomic.StoreUint64(p.all[t][j], 0)
 	}
 }
 
@@ -496,3 +3281,65 @@ func (p *Metrics) String() string {
 	fmt.Fprintf(&buf, "hit-ratio: %.2f", p.Ratio())
 	return buf.String()
 }
+
+// MarshalJSON encodes the most commonly used counters, along with the hit
+// ratio, as a JSON object with stable field names: hits, misses, keysAdded,
+// keysUpdated, keysEvicted, costAdded, costEvicted, setsDropped, setsRejected,
+// getsDropped, getsKept and ratio. A nil Metrics is encoded as null.
+func (p *Metrics) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+	fields := [...]struct {
+		name string
+		t    metricType
+	}{
+		{"hits", hit},
+		{"misses", miss},
+		{"keysAdded", keyAdd},
+		{"keysUpdated", keyUpdate},
+		{"keysEvicted", keyEvict},
+		{"costAdded", costAdd},
+		{"costEvicted", costEvict},
+		{"setsDropped", dropSets},
+		{"setsRejected", rejectSets},
+		{"getsDropped", dropGets},
+		{"getsKept", keepGets},
+	}
+	b := make([]byte, 0, 256)
+	b = append(b, '{')
+	for _, f := range fields {
+		b = append(b, '"')
+		b = append(b, f.name...)
+		b = append(b, '"', ':')
+		b = strconv.AppendUint(b, p.get(f.t), 10)
+		b = append(b, ',')
+	}
+	b = append(b, `"ratio":`...)
+	b = strconv.AppendFloat(b, p.Ratio(), 'g', -1, 64)
+	b = append(b, '}')
+	return b, nil
+}
+
+// WriteOpenMetrics writes every counter to w in the OpenMetrics text format,
+// with each metric name prefixed by prefix (e.g. "ristretto" turns the
+// keys-added counter into ristretto_keys_added). It's meant for pushing metrics
+// to text protocol endpoints without depending on a Prometheus client.
+func (p *Metrics) WriteOpenMetrics(w io.Writer, prefix string) error {
+	if p == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	for i := 0; i < doNotUse; i++ {
+		t := metricType(i)
+		name := strings.Replace(stringFor(t), "-", "_", -1)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		fmt.Fprintf(&buf, "# TYPE %s counter\n", name)
+		fmt.Fprintf(&buf, "%s_total{} %d\n", name, p.get(t))
+	}
+	buf.WriteString("# EOF\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -1,7 +1,17 @@
 package ristretto
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -49,10 +59,10 @@ func TestCacheProcessItems(t *testing.T) {
 		Cost: func(value interface{}) int64 {
 			return int64(value.(int))
 		},
-		OnEvict: func(key uint64, value interface{}, cost int64) {
+		OnEvict: func(item *Item) {
 			m.Lock()
 			defer m.Unlock()
-			evicted[key] = struct{}{}
+			evicted[item.Key] = struct{}{}
 		},
 	})
 	if err != nil {
@@ -128,13 +138,149 @@ func TestCacheProcessItems(t *testing.T) {
 		t.Fatal("cache processItems not evicting or calling OnEvict")
 	}
 	m.Unlock()
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatal("cache processItems didn't stop")
-		}
-	}()
 	c.Close()
-	c.setBuf <- &item{flag: itemNew}
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("cache processItems didn't stop")
+	}
+}
+
+func TestCacheOnEvictAsync(t *testing.T) {
+	if _, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		OnEvictConcurrency: -1,
+	}); err == nil {
+		t.Fatal("OnEvictConcurrency can't be negative")
+	}
+	var evicted int64
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            1,
+		BufferItems:        64,
+		OnEvictAsync:       true,
+		OnEvictConcurrency: 2,
+		OnEvict: func(item *Item) {
+			atomic.AddInt64(&evicted, 1)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	if c.evictPool == nil {
+		t.Fatal("async onEvict should start an evict pool")
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+		time.Sleep(wait / 5)
+	}
+	c.Close()
+	if atomic.LoadInt64(&evicted) == 0 {
+		t.Fatal("async onEvict not being called")
+	}
+}
+
+func TestCacheHealthy(t *testing.T) {
+	block := make(chan struct{})
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Cost: func(value interface{}) int64 {
+			<-block
+			return 1
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	if !c.Healthy(wait) {
+		t.Fatal("idle cache should be healthy")
+	}
+	// the first item blocks processItems, so the second stays buffered
+	c.Set(1, 1, 0)
+	c.Set(2, 2, 0)
+	time.Sleep(wait * 2)
+	if c.Healthy(wait) {
+		t.Fatal("stalled cache should be unhealthy")
+	}
+	if !c.Healthy(time.Minute) {
+		t.Fatal("cache shouldn't be unhealthy before maxStale")
+	}
+	close(block)
+	time.Sleep(wait)
+	if !c.Healthy(wait) {
+		t.Fatal("cache should be healthy after processing resumes")
+	}
+	c = nil
+	if !c.Healthy(wait) {
+		t.Fatal("nil cache has nothing to stall")
+	}
+}
+
+func TestCacheOnEvictBatch(t *testing.T) {
+	if _, err := NewCache(&Config{
+		NumCounters:    100,
+		MaxCost:        10,
+		BufferItems:    64,
+		EvictBatchSize: -1,
+	}); err == nil {
+		t.Fatal("EvictBatchSize can't be negative")
+	}
+	if _, err := NewCache(&Config{
+		NumCounters:      100,
+		MaxCost:          10,
+		BufferItems:      64,
+		EvictBatchWindow: -1,
+	}); err == nil {
+		t.Fatal("EvictBatchWindow can't be negative")
+	}
+	var evicted int64
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     1,
+		BufferItems: 64,
+		OnEvictBatch: func(items []*Item) {
+			atomic.AddInt64(&evicted, int64(len(items)))
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+		time.Sleep(wait / 5)
+	}
+	c.Close()
+	if atomic.LoadInt64(&evicted) == 0 {
+		t.Fatal("onEvictBatch not being called")
+	}
+}
+
+func TestCacheSoftMemoryLimit(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:     100,
+		MaxCost:         100,
+		BufferItems:     64,
+		SoftMemoryLimit: 1,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	for i := 0; i < 10 && c.policy.Used() == 10; i++ {
+		runtime.GC()
+		time.Sleep(wait)
+	}
+	if used := c.policy.Used(); used > 5 {
+		t.Fatal("items not reclaimed under memory pressure")
+	}
+	c.Close()
 }
 
 func TestCacheGet(t *testing.T) {
@@ -147,7 +293,7 @@ func TestCacheGet(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	c.store.Set(1, z.KeyToHash(1, 0), 1)
+	c.store.Set(1, z.KeyToHash(1, 0), 1, 0)
 	if val, ok := c.Get(1); val == nil || !ok {
 		t.Fatal("get should be successful")
 	}
@@ -164,196 +310,192 @@ func TestCacheGet(t *testing.T) {
 	}
 }
 
-func TestCacheSet(t *testing.T) {
+func TestCacheRecostOnGet(t *testing.T) {
 	c, err := NewCache(&Config{
 		NumCounters: 100,
-		MaxCost:     10,
+		MaxCost:     100,
 		BufferItems: 64,
-		Metrics:     true,
+		RecostOnGet: true,
+		Cost: func(value interface{}) int64 {
+			return int64(len(*value.(*[]int)))
+		},
 	})
 	if err != nil {
 		panic(err)
 	}
-	if c.Set(1, 1, 1) {
-		time.Sleep(wait)
-		if val, ok := c.Get(1); val == nil || val.(int) != 1 || !ok {
-			t.Fatal("set/get returned wrong value")
-		}
-	} else {
-		if val, ok := c.Get(1); val != nil || ok {
-			t.Fatal("set was dropped but value still added")
-		}
-	}
-	c.Set(1, 2, 2)
-	val, ok := c.store.Get(1, z.KeyToHash(1, 0))
-	if val == nil || val.(int) != 2 || !ok {
-		t.Fatal("set/update was unsuccessful")
-	}
-	c.stop <- struct{}{}
-	for i := 0; i < setBufSize; i++ {
-		c.setBuf <- &item{
-			flag:    itemUpdate,
-			key:     1,
-			keyHash: z.KeyToHash(1, 0),
-			value:   1,
-			cost:    1,
-		}
-	}
-	if c.Set(2, 2, 1) {
-		t.Fatal("set should be dropped with full setBuf")
+	value := []int{1}
+	c.Set(1, &value, 0)
+	c.Wait()
+	if c.policy.Cost(z.KeyToHash(1, 0)) != 1 {
+		t.Fatal("cost function not used on set")
 	}
-	if c.Metrics.SetsDropped() != 1 {
-		t.Fatal("set should track dropSets")
+	value = append(value, 2, 3)
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("get should be successful")
 	}
-	close(c.setBuf)
-	close(c.stop)
-	c = nil
-	if c.Set(1, 1, 1) {
-		t.Fatal("set shouldn't be successful with nil cache")
+	if c.policy.Cost(z.KeyToHash(1, 0)) != 3 {
+		t.Fatal("get didn't recompute cost")
 	}
 }
 
-func TestCacheDel(t *testing.T) {
+func TestCacheGetByPrefix(t *testing.T) {
 	c, err := NewCache(&Config{
 		NumCounters: 100,
 		MaxCost:     10,
 		BufferItems: 64,
+		StoreKeys:   true,
 	})
 	if err != nil {
 		panic(err)
 	}
-	c.Set(1, 1, 1)
-	c.Del(1)
-	time.Sleep(wait)
-	if val, ok := c.Get(1); val != nil || ok {
-		t.Fatal("del didn't delete")
+	c.Set("user/1/name", "a", 1)
+	c.Set("user/1/mail", "b", 1)
+	c.Set("user/2/name", "c", 1)
+	c.Set(3, "d", 1)
+	c.Wait()
+	found := c.GetByPrefix("user/1/")
+	if len(found) != 2 || found["user/1/name"] != "a" || found["user/1/mail"] != "b" {
+		t.Fatal("get by prefix returned wrong items")
+	}
+	if len(c.GetByPrefix("")) != 3 {
+		t.Fatal("empty prefix should match every string key")
 	}
 	c = nil
-	defer func() {
-		if r := recover(); r != nil {
-			t.Fatal("del panic with nil cache")
-		}
-	}()
-	c.Del(1)
+	if c.GetByPrefix("user") != nil {
+		t.Fatal("get by prefix should return nil with nil cache")
+	}
 }
 
-func TestCacheClear(t *testing.T) {
+func TestCacheValueEncoder(t *testing.T) {
+	xor := func(b []byte) ([]byte, error) {
+		out := make([]byte, len(b))
+		for i := range b {
+			out[i] = b[i] ^ 0xff
+		}
+		return out, nil
+	}
 	c, err := NewCache(&Config{
-		NumCounters: 100,
-		MaxCost:     10,
-		BufferItems: 64,
-		Metrics:     true,
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		Metrics:      true,
+		ValueEncoder: xor,
+		ValueDecoder: xor,
 	})
 	if err != nil {
 		panic(err)
 	}
-	for i := 0; i < 10; i++ {
-		c.Set(i, i, 1)
+	c.Set(1, []byte("abc"), 1)
+	c.Set(2, "abc", 1)
+	c.Wait()
+	if val, _ := c.store.Get(z.KeyToHash(1, 0), 1); string(val.([]byte)) == "abc" {
+		t.Fatal("value wasn't encoded")
 	}
-	time.Sleep(wait)
-	if c.Metrics.KeysAdded() != 10 {
-		t.Fatal("range of sets not being processed")
+	if val, ok := c.Get(1); !ok || string(val.([]byte)) != "abc" {
+		t.Fatal("value wasn't decoded")
 	}
-	c.Clear()
-	if c.Metrics.KeysAdded() != 0 {
-		t.Fatal("clear didn't reset metrics")
+	if val, ok := c.Get(2); !ok || val.(string) != "abc" {
+		t.Fatal("non-[]byte values should be stored as is")
 	}
-	for i := 0; i < 10; i++ {
-		if val, ok := c.Get(i); val != nil || ok {
-			t.Fatal("clear didn't delete values")
-		}
+	c.valueDecoder = func(b []byte) ([]byte, error) {
+		return nil, errors.New("bad value")
+	}
+	if _, ok := c.Get(1); ok {
+		t.Fatal("value that fails to decode should be a miss")
+	}
+	c.valueEncoder = c.valueDecoder
+	if c.Set(3, []byte("abc"), 1) {
+		t.Fatal("set should fail if the value can't be encoded")
 	}
 }
 
-func TestCacheMetrics(t *testing.T) {
+func TestCacheWouldEvict(t *testing.T) {
 	c, err := NewCache(&Config{
 		NumCounters: 100,
 		MaxCost:     10,
 		BufferItems: 64,
-		Metrics:     true,
 	})
 	if err != nil {
 		panic(err)
 	}
-	for i := 0; i < 10; i++ {
-		c.Set(i, i, 1)
+	c.Set(1, 1, 6)
+	c.Wait()
+	if c.WouldEvict(4) {
+		t.Fatal("item that fits shouldn't cause evictions")
 	}
-	time.Sleep(wait)
-	m := c.Metrics
-	if m.KeysAdded() != 10 {
-		t.Fatal("metrics exporting incorrect fields")
+	if !c.WouldEvict(5) {
+		t.Fatal("item that doesn't fit should cause evictions")
+	}
+	c = nil
+	if c.WouldEvict(5) {
+		t.Fatal("nil cache shouldn't evict")
 	}
 }
 
-func TestMetrics(t *testing.T) {
-	newMetrics()
-}
-
-func TestMetricsAddGet(t *testing.T) {
-	m := newMetrics()
-	m.add(hit, 1, 1)
-	m.add(hit, 2, 2)
-	m.add(hit, 3, 3)
-	if m.Hits() != 6 {
-		t.Fatal("add/get error")
+func TestCacheCounterSaturation(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 1,
+	})
+	if err != nil {
+		panic(err)
 	}
-	m = nil
-	m.add(hit, 1, 1)
-	if m.Hits() != 0 {
-		t.Fatal("get with nil struct should return 0")
+	if c.CounterSaturation() != 0 {
+		t.Fatal("saturation should be 0 without any gets")
 	}
-}
-
-func TestMetricsRatio(t *testing.T) {
-	m := newMetrics()
-	if m.Ratio() != 0 {
-		t.Fatal("ratio with no hits or misses should be 0")
+	for i := 0; i < 50 && c.CounterSaturation() == 0; i++ {
+		c.Get(1)
+		time.Sleep(wait / 10)
 	}
-	m.add(hit, 1, 1)
-	m.add(hit, 2, 2)
-	m.add(miss, 1, 1)
-	m.add(miss, 2, 2)
-	if m.Ratio() != 0.5 {
-		t.Fatal("ratio incorrect")
+	if c.CounterSaturation() == 0 {
+		t.Fatal("repeated gets should saturate counters")
 	}
-	m = nil
-	if m.Ratio() != 0.0 {
-		t.Fatal("ratio with a nil struct should return 0")
+	c = nil
+	if c.CounterSaturation() != 0 {
+		t.Fatal("saturation should be 0 with nil cache")
 	}
 }
 
-func TestMetricsString(t *testing.T) {
-	m := newMetrics()
-	m.add(hit, 1, 1)
-	m.add(miss, 1, 1)
-	m.add(keyAdd, 1, 1)
-	m.add(keyUpdate, 1, 1)
-	m.add(keyEvict, 1, 1)
-	m.add(costAdd, 1, 1)
-	m.add(costEvict, 1, 1)
-	m.add(dropSets, 1, 1)
-	m.add(rejectSets, 1, 1)
-	m.add(dropGets, 1, 1)
-	m.add(keepGets, 1, 1)
-	if m.Hits() != 1 || m.Misses() != 1 || m.Ratio() != 0.5 || m.KeysAdded() != 1 ||
-		m.KeysUpdated() != 1 || m.KeysEvicted() != 1 || m.CostAdded() != 1 ||
-		m.CostEvicted() != 1 || m.SetsDropped() != 1 || m.SetsRejected() != 1 ||
-		m.GetsDropped() != 1 || m.GetsKept() != 1 {
-		t.Fatal("Metrics wrong value(s)")
+func TestCacheKeyHash(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		KeyToHash: func(key interface{}, seed uint8) uint64 {
+			return uint64(key.(int)) + 1000
+		},
+	})
+	if err != nil {
+		panic(err)
 	}
-	if len(m.String()) == 0 {
-		t.Fatal("Metrics.String() empty")
+	if hash, ok := c.KeyHash(1); !ok || hash != 1001 {
+		t.Fatal("key hash should use the configured KeyToHash")
 	}
-	m = nil
-	if len(m.String()) != 0 {
-		t.Fatal("Metrics.String() should be empty with nil struct")
+	if _, ok := c.KeyHash("a"); ok {
+		t.Fatal("key hash should fail for keys KeyToHash doesn't support")
 	}
-	if stringFor(doNotUse) != "unidentified" {
-		t.Fatal("stringFor() not handling doNotUse type")
+	if _, ok := c.KeyHash(nil); ok {
+		t.Fatal("key hash should fail for nil keys")
+	}
+	c, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if _, ok := c.KeyHash(1.5); ok {
+		t.Fatal("key hash should fail for unsupported key types")
+	}
+	c = nil
+	if _, ok := c.KeyHash(1); ok {
+		t.Fatal("key hash should fail with nil cache")
 	}
 }
 
-func TestCacheMetricsClear(t *testing.T) {
+func TestCacheFlushGets(t *testing.T) {
 	c, err := NewCache(&Config{
 		NumCounters: 100,
 		MaxCost:     10,
@@ -363,21 +505,3187 @@ func TestCacheMetricsClear(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	c.Set(1, 1, 1)
-	stop := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-stop:
-				return
-			default:
-				c.Get(1)
-			}
+	// the pool may drop buffers (always a possibility with -race), so retry
+	for i := 0; i < 100 && c.Metrics.GetsKept() == 0; i++ {
+		c.Get(1)
+		c.FlushGets()
+	}
+	if c.Metrics.GetsKept() == 0 {
+		t.Fatal("flush didn't push gets to the policy")
+	}
+	// an empty buffer handed back by the previous flush mustn't stop the next
+	// one early
+	for i := 0; i < 100; i++ {
+		kept := c.Metrics.GetsKept()
+		c.Get(2)
+		c.FlushGets()
+		c.FlushGets()
+		c.Get(3)
+		c.FlushGets()
+		c.FlushGets()
+		time.Sleep(wait)
+		if c.Metrics.GetsKept() >= kept+2 {
+			break
 		}
-	}()
-	time.Sleep(wait)
-	c.Clear()
+		if i == 99 {
+			t.Fatal("consecutive flushes didn't push gets to the policy")
+		}
+	}
+	c = nil
+	c.FlushGets()
+}
+
+func TestCacheIncludeKeyCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:    100,
+		MaxCost:        100,
+		BufferItems:    64,
+		IncludeKeyCost: true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set("key", 1, 1)
+	c.Set([]byte("key2"), 1, 1)
+	c.Set(3, 1, 1)
+	c.Wait()
+	if c.policy.Cost(z.KeyToHash("key", 0)) != 4 ||
+		c.policy.Cost(z.KeyToHash([]byte("key2"), 0)) != 5 ||
+		c.policy.Cost(z.KeyToHash(3, 0)) != 9 {
+		t.Fatal("key cost not included")
+	}
+	c.Set("key", 1, 2)
+	c.Wait()
+	if c.policy.Cost(z.KeyToHash("key", 0)) != 5 {
+		t.Fatal("key cost not included in update")
+	}
+}
+
+func TestCacheDisableGetBuffer(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:      100,
+		MaxCost:          10,
+		DisableGetBuffer: true,
+		Metrics:          true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if c.getBuf != nil {
+		t.Fatal("get buffer shouldn't be allocated")
+	}
+	c.Set(1, 1, 1)
+	c.Wait()
+	for i := 0; i < 100; i++ {
+		if _, ok := c.Get(1); !ok {
+			t.Fatal("get should work without a get buffer")
+		}
+	}
+	c.FlushGets()
+	if c.Metrics.GetsKept() != 0 || c.Metrics.GetsDropped() != 0 {
+		t.Fatal("gets shouldn't be recorded by the policy")
+	}
+}
+
+func TestCacheCloneValue(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		CloneValue: func(value interface{}) interface{} {
+			return append([]int(nil), value.([]int)...)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, []int{1, 2}, 1)
+	c.Wait()
+	val, ok := c.Get(1)
+	if !ok {
+		t.Fatal("get should be successful")
+	}
+	val.([]int)[0] = 10
+	if val, _ := c.Get(1); val.([]int)[0] != 1 {
+		t.Fatal("get should return a copy of the value")
+	}
+}
+
+func TestCacheSet(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if c.Set(1, 1, 1) {
+		time.Sleep(wait)
+		if val, ok := c.Get(1); val == nil || val.(int) != 1 || !ok {
+			t.Fatal("set/get returned wrong value")
+		}
+	} else {
+		if val, ok := c.Get(1); val != nil || ok {
+			t.Fatal("set was dropped but value still added")
+		}
+	}
+	c.Set(1, 2, 2)
+	val, ok := c.store.Get(1, z.KeyToHash(1, 0))
+	if val == nil || val.(int) != 2 || !ok {
+		t.Fatal("set/update was unsuccessful")
+	}
+	c.stop <- struct{}{}
+	for i := 0; i < setBufSize; i++ {
+		c.setBuf <- &item{
+			flag:    itemUpdate,
+			key:     1,
+			keyHash: z.KeyToHash(1, 0),
+			value:   1,
+			cost:    1,
+		}
+	}
+	if c.Set(2, 2, 1) {
+		t.Fatal("set should be dropped with full setBuf")
+	}
+	if c.Metrics.SetsDropped() != 1 {
+		t.Fatal("set should track dropSets")
+	}
+	close(c.setBuf)
+	close(c.stop)
+	c = nil
+	if c.Set(1, 1, 1) {
+		t.Fatal("set shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheSkipNoopUpdates(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:     100,
+		MaxCost:         10,
+		BufferItems:     64,
+		Metrics:         true,
+		SkipNoopUpdates: true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, []byte("a"), 1)
+	c.Wait()
+	c.Set(1, []byte("a"), 1)
+	c.Wait()
+	if c.Metrics.KeysUpdated() != 0 {
+		t.Fatal("noop update should be skipped")
+	}
+	c.Set(1, []byte("a"), 2)
+	c.Wait()
+	if c.Metrics.KeysUpdated() != 1 {
+		t.Fatal("update with a new cost shouldn't be skipped")
+	}
+	c.Set(1, []byte("b"), 2)
+	c.Wait()
+	if c.Metrics.KeysUpdated() != 2 {
+		t.Fatal("update with a new value shouldn't be skipped")
+	}
+	if !valuesEqual(1, 1) || valuesEqual([]byte("a"), "a") {
+		t.Fatal("valuesEqual comparing incorrectly")
+	}
+	c, err = NewCache(&Config{
+		NumCounters:     100,
+		MaxCost:         10,
+		BufferItems:     64,
+		Metrics:         true,
+		SkipNoopUpdates: true,
+		Cost:            func(interface{}) int64 { return 1 },
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 5)
+	c.Wait()
+	c.Set(1, 1, 0)
+	c.Wait()
+	if c.policy.Cost(z.KeyToHash(1, 0)) != 1 {
+		t.Fatal("update to a new computed cost shouldn't be skipped")
+	}
+	c.Set(1, 1, 0)
+	c.Wait()
+	if c.Metrics.KeysUpdated() != 1 {
+		t.Fatal("update to the same computed cost should be skipped")
+	}
+}
+
+func TestCacheSetWithRetry(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if !c.SetWithRetry(1, 1, 1, 3, time.Millisecond) {
+		t.Fatal("set with retry should be successful")
+	}
+	c.stop <- struct{}{}
+	for len(c.setBuf) < setBufSize {
+		c.setBuf <- &item{flag: itemUpdate, keyHash: 1}
+	}
+	if c.SetWithRetry(2, 2, 1, 3, time.Millisecond) {
+		t.Fatal("set with retry should be dropped with full setBuf")
+	}
+	if c.Metrics.SetsDropped() != 1 {
+		t.Fatal("set with retry should track dropSets once")
+	}
+	// free up a slot while SetWithRetry is backing off
+	go func() {
+		time.Sleep(wait)
+		<-c.setBuf
+	}()
+	if !c.SetWithRetry(3, 3, 1, 10, time.Millisecond) {
+		t.Fatal("set with retry should succeed once there's room")
+	}
+	c = nil
+	if c.SetWithRetry(1, 1, 1, 3, time.Millisecond) {
+		t.Fatal("set with retry shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheMirror(t *testing.T) {
+	mirror, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+		Mirror:      mirror,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Set(2, 2, 1)
+	c.Wait()
+	mirror.Wait()
+	if val, ok := mirror.Get(1); !ok || val.(int) != 1 {
+		t.Fatal("set not mirrored")
+	}
+	c.Del(2)
+	c.Wait()
+	mirror.Wait()
+	if _, ok := mirror.Get(2); ok {
+		t.Fatal("del not mirrored")
+	}
+	mirror.Pause()
+	for len(mirror.setBuf) < setBufSize {
+		mirror.setBuf <- &item{flag: itemDelete, keyHash: 1}
+	}
+	c.Set(3, 3, 1)
+	c.Del(3)
+	c.Wait()
+	if c.Metrics.MirrorsDropped() != 2 {
+		t.Fatal("mirroring shouldn't block when the mirror is full")
+	}
+}
+
+func TestCacheDel(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Del(1)
+	time.Sleep(wait)
+	if val, ok := c.Get(1); val != nil || ok {
+		t.Fatal("del didn't delete")
+	}
+	c.Set(2, 2, 1)
+	c.Wait()
+	if val, ok := c.Del(2); !ok || val.(int) != 2 {
+		t.Fatal("del should return the deleted value")
+	}
+	if _, ok := c.Get(2); ok {
+		t.Fatal("del should delete the value right away")
+	}
+	if _, ok := c.Del(2); ok {
+		t.Fatal("del should only return the value once")
+	}
+	c.Wait()
+	if c.policy.Has(z.KeyToHash(2, 0)) {
+		t.Fatal("del didn't delete from the policy")
+	}
+	c = nil
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatal("del panic with nil cache")
+		}
+	}()
+	if _, ok := c.Del(1); ok {
+		t.Fatal("del shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheClear(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+	}
+	time.Sleep(wait)
+	if c.Metrics.KeysAdded() != 10 {
+		t.Fatal("range of sets not being processed")
+	}
+	done := c.done
+	c.Clear()
+	select {
+	case <-done:
+	default:
+		t.Fatal("clear didn't wait for processItems to return")
+	}
+	if c.Metrics.KeysAdded() != 0 {
+		t.Fatal("clear didn't reset metrics")
+	}
+	for i := 0; i < 10; i++ {
+		if val, ok := c.Get(i); val != nil || ok {
+			t.Fatal("clear didn't delete values")
+		}
+	}
+}
+
+func TestCacheClearDrain(t *testing.T) {
+	var cleared []int
+	c, err := NewCache(&Config{
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		DrainOnClear: true,
+		OnEvict: func(item *Item) {
+			if item.Reason == EvictClear {
+				cleared = append(cleared, item.Value.(int))
+			}
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(0, 0, 1)
+	c.Wait()
+	// pause so the items stay buffered until Clear is called
+	c.Pause()
+	// the update is written to the hashmap right away, so it has to reach the
+	// policy before the hashmap is cleared
+	c.Set(0, 10, 1)
+	for i := 1; i < 5; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Clear()
+	sort.Ints(cleared)
+	if len(cleared) != 5 || cleared[0] != 1 || cleared[4] != 10 {
+		t.Fatal("clear didn't drain buffered items before clearing")
+	}
+	for i := 0; i < 5; i++ {
+		if c.Has(i) {
+			t.Fatal("drained items should be cleared")
+		}
+	}
+	c.Resume()
+}
+
+func TestCacheClearConcurrent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:   1000,
+		MaxCost:       100,
+		BufferItems:   64,
+		SetBufferSize: 16,
+		Metrics:       true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := (g*1000 + i) % 200
+				c.Set(key, key, 1)
+				c.SetWithTTL(key+200, key, 1, time.Minute)
+				if val, ok := c.Get(key); ok && val.(int) != key {
+					t.Error("get returned the wrong value during clear")
+				}
+				c.Del(key + 200)
+			}
+		}(g)
+	}
+	for i := 0; i < 20; i++ {
+		c.Clear()
+	}
+	close(stop)
+	wg.Wait()
+	c.Clear()
+	c.Set(1, 1, 1)
+	c.Wait()
+	if val, ok := c.Get(1); !ok || val.(int) != 1 {
+		t.Fatal("sets should be applied after clear")
+	}
+	c.Close()
+}
+
+func TestCacheOnFirstItemOnEmpty(t *testing.T) {
+	var first, empty int32
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		OnFirstItem: func() { atomic.AddInt32(&first, 1) },
+		OnEmpty:     func() { atomic.AddInt32(&empty, 1) },
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Set(2, 2, 1)
+	c.Wait()
+	if atomic.LoadInt32(&first) != 1 || atomic.LoadInt32(&empty) != 0 {
+		t.Fatal("onFirstItem should be called once")
+	}
+	c.Del(1)
+	c.Wait()
+	if atomic.LoadInt32(&empty) != 0 {
+		t.Fatal("onEmpty called while cache isn't empty")
+	}
+	c.Del(2)
+	c.Wait()
+	if atomic.LoadInt32(&empty) != 1 {
+		t.Fatal("onEmpty should be called once the cache is empty")
+	}
+	c.Set(3, 3, 1)
+	c.Wait()
+	c.Clear()
+	if atomic.LoadInt32(&first) != 2 || atomic.LoadInt32(&empty) != 2 {
+		t.Fatal("clear should call onEmpty")
+	}
+}
+
+func TestCacheClearWithShadow(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 3; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	c.ClearWithShadow()
+	if c.policy.Len() != 0 {
+		t.Fatal("clear with shadow didn't clear the policy")
+	}
+	c.Set(0, 10, 1)
+	c.Del(2)
+	c.Wait()
+	if val, ok := c.Get(0); !ok || val.(int) != 10 {
+		t.Fatal("new value should be preferred over the shadow")
+	}
+	if val, ok := c.Get(1); !ok || val.(int) != 1 {
+		t.Fatal("get should fall back to the shadow")
+	}
+	if _, ok := c.Get(2); ok {
+		t.Fatal("del should delete from the shadow")
+	}
+	if c.Metrics.StaleHits() != 1 || c.Metrics.Hits() != 1 {
+		t.Fatal("shadow hits should be counted as stale hits")
+	}
+	c.DropShadow()
+	if _, ok := c.Get(1); ok {
+		t.Fatal("drop shadow didn't drop the shadow")
+	}
+	c = nil
+	c.DropShadow()
+}
+
+func TestCachePause(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Wait()
+	c.Pause()
+	c.Pause()
+	c.Set(2, 2, 1)
+	time.Sleep(wait)
+	if _, ok := c.Get(2); ok {
+		t.Fatal("set shouldn't be processed while paused")
+	}
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("get should work while paused")
+	}
+	c.Clear()
+	c.Set(3, 3, 1)
+	time.Sleep(wait)
+	if _, ok := c.Get(3); ok {
+		t.Fatal("clear shouldn't resume processing")
+	}
+	c.Resume()
+	c.Resume()
+	time.Sleep(wait)
+	if _, ok := c.Get(3); !ok {
+		t.Fatal("resume should process buffered sets")
+	}
+	c.Pause()
+	c.Close()
+	c = nil
+	c.Pause()
+	c.Resume()
+}
+
+func TestCacheMetrics(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+	}
+	time.Sleep(wait)
+	m := c.Metrics
+	if m.KeysAdded() != 10 {
+		t.Fatal("metrics exporting incorrect fields")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	newMetrics()
+}
+
+func TestMetricsAddGet(t *testing.T) {
+	m := newMetrics()
+	m.add(hit, 1, 1)
+	m.add(hit, 2, 2)
+	m.add(hit, 3, 3)
+	if m.Hits() != 6 {
+		t.Fatal("add/get error")
+	}
+	m = nil
+	m.add(hit, 1, 1)
+	if m.Hits() != 0 {
+		t.Fatal("get with nil struct should return 0")
+	}
+}
+
+func TestMetricsRatio(t *testing.T) {
+	m := newMetrics()
+	if m.Ratio() != 0 {
+		t.Fatal("ratio with no hits or misses should be 0")
+	}
+	m.add(hit, 1, 1)
+	m.add(hit, 2, 2)
+	m.add(miss, 1, 1)
+	m.add(miss, 2, 2)
+	if m.Ratio() != 0.5 {
+		t.Fatal("ratio incorrect")
+	}
+	m = nil
+	if m.Ratio() != 0.0 {
+		t.Fatal("ratio with a nil struct should return 0")
+	}
+}
+
+func TestMetricsUpdateRatio(t *testing.T) {
+	m := newMetrics()
+	if m.UpdateRatio() != 0 {
+		t.Fatal("update ratio with no sets should be 0")
+	}
+	m.add(keyAdd, 1, 1)
+	m.add(keyUpdate, 1, 3)
+	if m.UpdateRatio() != 0.75 {
+		t.Fatal("update ratio incorrect")
+	}
+	m = nil
+	if m.UpdateRatio() != 0.0 {
+		t.Fatal("update ratio with a nil struct should return 0")
+	}
+}
+
+func TestMetricsEvictionsPerAdd(t *testing.T) {
+	m := newMetrics()
+	if m.EvictionsPerAdd() != 0 {
+		t.Fatal("evictions per add with no adds should be 0")
+	}
+	m.add(keyAdd, 1, 4)
+	m.add(keyEvict, 1, 2)
+	if m.EvictionsPerAdd() != 0.5 {
+		t.Fatal("evictions per add incorrect")
+	}
+	m = nil
+	if m.EvictionsPerAdd() != 0.0 {
+		t.Fatal("evictions per add with a nil struct should return 0")
+	}
+}
+
+func TestMetricsRates(t *testing.T) {
+	m := newMetrics()
+	prev := m.snapshot()
+	m.add(hit, 1, 20)
+	m.add(miss, 1, 10)
+	m.add(keyEvict, 1, 4)
+	m.add(dropSets, 1, 2)
+	cur := m.snapshot()
+	cur.at = prev.at.Add(2 * time.Second)
+	r := rates(prev, cur)
+	if r.Hits != 10 || r.Misses != 5 || r.Evictions != 2 || r.SetsDropped != 1 {
+		t.Fatal("rates computed incorrectly")
+	}
+	prev = m.snapshot()
+	m.Clear()
+	m.add(hit, 1, 3)
+	cur = m.snapshot()
+	cur.at = prev.at.Add(time.Second)
+	if r := rates(prev, cur); r.Hits != 3 {
+		t.Fatal("rates not handling cleared counters")
+	}
+	// a counter wrapping around isn't mistaken for a Clear
+	prev.counters[hit] = math.MaxUint64 - 1
+	prev.resets = cur.resets
+	if r := rates(prev, cur); r.Hits != 5 {
+		t.Fatal("rates not handling wrapped counters")
+	}
+	if r := rates(prev, prev); r.Hits != 0 {
+		t.Fatal("rates with no elapsed time should be 0")
+	}
+	if r := m.Rates(time.Second); r.Hits != 0 {
+		t.Fatal("rates should be 0 without snapshots")
+	}
+	// snapshots are normally taken in the background every second
+	m.record()
+	m.snapshots[0].at = m.snapshots[0].at.Add(-2 * time.Second)
+	m.record()
+	m.add(hit, 1, 4)
+	start := time.Now()
+	r = m.Rates(time.Second)
+	if time.Since(start) >= time.Second || r.Hits <= 1 || r.Hits > 2 {
+		t.Fatal("rates should be computed from the snapshots without waiting")
+	}
+	if r := m.Rates(time.Hour); r.Hits <= 1 || r.Hits > 2 {
+		t.Fatal("rates should fall back to the oldest snapshot")
+	}
+	for i := 0; i < 2*rateSnapshots; i++ {
+		m.record()
+	}
+	if len(m.snapshots) != rateSnapshots {
+		t.Fatal("rates should only keep a minute of snapshots")
+	}
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Metrics.rateMu.Lock()
+	if len(c.Metrics.snapshots) == 0 {
+		t.Fatal("cache should snapshot the metrics for rates")
+	}
+	c.Metrics.rateMu.Unlock()
+	c.Close()
+	m = nil
+	if r := m.Rates(time.Millisecond); r.Hits != 0 {
+		t.Fatal("rates with a nil struct should be 0")
+	}
+}
+
+func TestMetricsResetHitMiss(t *testing.T) {
+	m := newMetrics()
+	m.add(hit, 1, 3)
+	m.add(miss, 1, 1)
+	m.add(staleHit, 1, 1)
+	m.add(keyEvict, 1, 2)
+	m.add(costEvict, 1, 5)
+	m.ResetHitMiss()
+	if m.Hits() != 0 || m.Misses() != 0 || m.StaleHits() != 0 || m.Ratio() != 0 {
+		t.Fatal("ResetHitMiss should zero hits and misses")
+	}
+	if m.KeysEvicted() != 2 || m.CostEvicted() != 5 {
+		t.Fatal("ResetHitMiss shouldn't zero the other counters")
+	}
+	m = nil
+	m.ResetHitMiss()
+}
+
+func TestMetricsMarshalJSON(t *testing.T) {
+	m := newMetrics()
+	m.add(hit, 1, 3)
+	m.add(miss, 1, 1)
+	m.add(keyAdd, 1, 2)
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]float64
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 12 || fields["hits"] != 3 || fields["misses"] != 1 ||
+		fields["keysAdded"] != 2 || fields["setsRejected"] != 0 ||
+		fields["ratio"] != 0.75 {
+		t.Fatal("Metrics.MarshalJSON() wrong fields")
+	}
+	m = nil
+	if b, err := json.Marshal(m); err != nil || string(b) != "null" {
+		t.Fatal("nil Metrics should be encoded as null")
+	}
+}
+
+func TestMetricsString(t *testing.T) {
+	m := newMetrics()
+	m.add(hit, 1, 1)
+	m.add(miss, 1, 1)
+	m.add(keyAdd, 1, 1)
+	m.add(keyUpdate, 1, 1)
+	m.add(keyEvict, 1, 1)
+	m.add(costAdd, 1, 1)
+	m.add(costEvict, 1, 1)
+	m.add(dropSets, 1, 1)
+	m.add(rejectSets, 1, 1)
+	m.add(dropGets, 1, 1)
+	m.add(keepGets, 1, 1)
+	m.add(dropEvicts, 1, 1)
+	m.add(staleHit, 1, 1)
+	m.add(dropMirrors, 1, 1)
+	m.add(costThroughput, 1, 1)
+	if m.Hits() != 1 || m.Misses() != 1 || m.Ratio() != 0.5 || m.KeysAdded() != 1 ||
+		m.KeysUpdated() != 1 || m.KeysEvicted() != 1 || m.CostAdded() != 1 ||
+		m.CostEvicted() != 1 || m.SetsDropped() != 1 || m.SetsRejected() != 1 ||
+		m.GetsDropped() != 1 || m.GetsKept() != 1 || m.EvictionsDropped() != 1 ||
+		m.StaleHits() != 1 || m.MirrorsDropped() != 1 || m.ThroughputCost() != 1 {
+		t.Fatal("Metrics wrong value(s)")
+	}
+	if len(m.String()) == 0 {
+		t.Fatal("Metrics.String() empty")
+	}
+	m = nil
+	if len(m.String()) != 0 {
+		t.Fatal("Metrics.String() should be empty with nil struct")
+	}
+	if stringFor(doNotUse) != "unidentified" {
+		t.Fatal("stringFor() not handling doNotUse type")
+	}
+}
+
+func TestMetricsWriteOpenMetrics(t *testing.T) {
+	m := newMetrics()
+	m.add(keyAdd, 1, 3)
+	var buf bytes.Buffer
+	if err := m.WriteOpenMetrics(&buf, "ristretto"); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "# TYPE ristretto_keys_added counter\n") ||
+		!strings.Contains(out, "\nristretto_keys_added_total{} 3\n") {
+		t.Fatal("WriteOpenMetrics missing keys added counter")
+	}
+	if strings.Count(out, "# TYPE ") != doNotUse || !strings.HasSuffix(out, "# EOF\n") {
+		t.Fatal("WriteOpenMetrics wrong format")
+	}
+	m = nil
+	buf.Reset()
+	if err := m.WriteOpenMetrics(&buf, "ristretto"); err != nil || buf.Len() != 0 {
+		t.Fatal("WriteOpenMetrics should write nothing with nil struct")
+	}
+}
+
+func TestCacheMetricsClear(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.Get(1)
+			}
+		}
+	}()
+	time.Sleep(wait)
+	c.Clear()
 	stop <- struct{}{}
 	c.Metrics = nil
 	c.Metrics.Clear()
 }
+
+func TestCacheGetFresh(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	var loads int32
+	loader := func(value int) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			atomic.AddInt32(&loads, 1)
+			return value, nil
+		}
+	}
+	if value, ok := c.GetFresh(1, time.Hour, loader(1)); !ok || value.(int) != 1 {
+		t.Fatal("get fresh should load the value on a miss")
+	}
+	c.Wait()
+	if value, ok := c.Get(1); !ok || value.(int) != 1 {
+		t.Fatal("get fresh should set the loaded value")
+	}
+	if value, ok := c.GetFresh(1, time.Hour, loader(2)); !ok || value.(int) != 1 {
+		t.Fatal("get fresh should return the fresh value")
+	}
+	if atomic.LoadInt32(&loads) != 1 {
+		t.Fatal("get fresh shouldn't reload a fresh value")
+	}
+	if value, ok := c.GetFresh(1, 0, loader(2)); !ok || value.(int) != 1 {
+		t.Fatal("get fresh should return the stale value right away")
+	}
+	time.Sleep(wait)
+	if atomic.LoadInt32(&loads) != 2 {
+		t.Fatal("get fresh should reload a stale value")
+	}
+	if value, ok := c.Get(1); !ok || value.(int) != 2 {
+		t.Fatal("get fresh should set the reloaded value")
+	}
+	if _, ok := c.GetFresh(2, time.Hour, func() (interface{}, error) {
+		return nil, errors.New("load failed")
+	}); ok {
+		t.Fatal("get fresh should miss when the loader fails")
+	}
+	c = nil
+	if _, ok := c.GetFresh(1, time.Hour, loader(1)); ok {
+		t.Fatal("get fresh shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheSetWithAltKey(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if !c.SetWithAltKey(1, "one", 1, 2) {
+		t.Fatal("set with alt key should be successful")
+	}
+	c.Wait()
+	if value, ok := c.Get(1); !ok || value.(int) != 1 {
+		t.Fatal("get by primary key failed")
+	}
+	if value, ok := c.Get("one"); !ok || value.(int) != 1 {
+		t.Fatal("get by alt key failed")
+	}
+	if c.policy.Used() != 2 || c.policy.Len() != 1 {
+		t.Fatal("alt key value cost should be accounted once")
+	}
+	c.SetWithAltKey(1, "uno", 2, 2)
+	c.Wait()
+	if _, ok := c.Get("one"); ok {
+		t.Fatal("replaced alt key should be removed")
+	}
+	if value, ok := c.Get("uno"); !ok || value.(int) != 2 {
+		t.Fatal("get by new alt key failed")
+	}
+	c.Del(1)
+	c.Wait()
+	if _, ok := c.Get("uno"); ok {
+		t.Fatal("alt key should be removed with its primary key")
+	}
+	c.SetWithAltKey(2, "two", 2, 2)
+	c.Wait()
+	// trim half the cost from the processItems goroutine
+	c.reclaim <- struct{}{}
+	time.Sleep(wait)
+	if _, ok := c.Get("two"); ok {
+		t.Fatal("alt key should be evicted with its primary key")
+	}
+	if c.SetWithAltKey(3, nil, 3, 1) {
+		t.Fatal("set with nil alt key shouldn't be successful")
+	}
+	c = nil
+	if c.SetWithAltKey(1, "one", 1, 1) {
+		t.Fatal("set with alt key shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheFingerprint(t *testing.T) {
+	newCache := func() *Cache {
+		c, err := NewCache(&Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return c
+	}
+	a, b := newCache(), newCache()
+	if a.Fingerprint() != 0 {
+		t.Fatal("empty cache should have a zero fingerprint")
+	}
+	for i := 0; i < 3; i++ {
+		a.Set(i, i, int64(i+1))
+		b.Set(2-i, 2-i, int64(3-i))
+	}
+	time.Sleep(wait)
+	if a.Fingerprint() == 0 || a.Fingerprint() != b.Fingerprint() {
+		t.Fatal("caches with the same contents should have the same fingerprint")
+	}
+	b.Set(0, 0, 2)
+	time.Sleep(wait)
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Fatal("fingerprint should change with an item's cost")
+	}
+	a = nil
+	if a.Fingerprint() != 0 {
+		t.Fatal("nil cache should have a zero fingerprint")
+	}
+}
+
+func TestCacheEffectiveConfig(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:      100,
+		MaxCost:          10,
+		BufferItems:      64,
+		OnEvict:          func(item *Item) {},
+		OnEvictAsync:     true,
+		OnEvictBatch:     func(items []*Item) {},
+		DisableGetBuffer: true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	config := c.EffectiveConfig()
+	if config.NumCounters != 100 || config.MaxCost != 10 {
+		t.Fatal("effective config should keep the configured values")
+	}
+	if config.KeyToHash == nil || config.ValueEqual == nil {
+		t.Fatal("effective config should have the default functions")
+	}
+	if config.OnEvictConcurrency != runtime.GOMAXPROCS(0) ||
+		config.EvictBatchSize != evictBatchSize ||
+		config.EvictBatchWindow != evictBatchWindow {
+		t.Fatal("effective config should have the default eviction settings")
+	}
+	if config.BufferItems != 0 {
+		t.Fatal("effective config shouldn't have ignored settings")
+	}
+	c.Close()
+	c = nil
+	if c.EffectiveConfig().MaxCost != 0 {
+		t.Fatal("nil cache should have an empty effective config")
+	}
+}
+
+func TestCacheAutoCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		AutoCost:    true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, make([]byte, 100), 0)
+	c.Wait()
+	if cost := c.policy.Cost(z.KeyToHash(1, 0)); cost != autoCost([]byte(nil))+100 {
+		t.Fatal("auto cost wasn't used for cost 0")
+	}
+	c.Set(2, "a", 5)
+	c.Wait()
+	if c.policy.Cost(z.KeyToHash(2, 0)) != 5 {
+		t.Fatal("auto cost shouldn't override an explicit cost")
+	}
+	if autoCost(nil) != 0 || autoCost(int64(1)) != 8 ||
+		autoCost("abc") != autoCost("")+3 ||
+		autoCost([]int64{1, 2}) != autoCost([]int64(nil))+16 ||
+		autoCost([2]int32{}) != 8 ||
+		autoCost(map[int32]int32{1: 1}) != autoCost(map[int32]int32{})+8 {
+		t.Fatal("auto cost estimated wrong sizes")
+	}
+	var p *int64
+	if autoCost(p) != 8 || autoCost(new(int64)) != 16 {
+		t.Fatal("auto cost estimated wrong pointer sizes")
+	}
+}
+
+func TestCacheLenCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		LenCost:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, make([]byte, 100), 0)
+	c.Set(2, "abc", 0)
+	c.Set(3, 3, 0)
+	c.Set(4, "abc", 5)
+	c.Wait()
+	if c.policy.Cost(z.KeyToHash(1, 0)) != 100 ||
+		c.policy.Cost(z.KeyToHash(2, 0)) != 3 {
+		t.Fatal("len cost wasn't used for cost 0")
+	}
+	if c.policy.Cost(z.KeyToHash(3, 0)) != 1 {
+		t.Fatal("len cost should fall back to 1")
+	}
+	if c.policy.Cost(z.KeyToHash(4, 0)) != 5 {
+		t.Fatal("len cost shouldn't override an explicit cost")
+	}
+	if _, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		AutoCost:    true,
+		LenCost:     true,
+	}); err == nil {
+		t.Fatal("AutoCost and LenCost together should be an error")
+	}
+}
+
+func TestCacheSetWaitCapacity(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if !c.SetWaitCapacity(1, 1, 8, wait) {
+		t.Fatal("set wait capacity should succeed when there's room")
+	}
+	time.Sleep(wait)
+	if c.SetWaitCapacity(2, 2, 4, wait) {
+		t.Fatal("set wait capacity should time out when there's no room")
+	}
+	// free up room while SetWaitCapacity is waiting
+	go func() {
+		time.Sleep(wait)
+		c.Del(1)
+	}()
+	if !c.SetWaitCapacity(2, 2, 4, time.Second) {
+		t.Fatal("set wait capacity should succeed once there's room")
+	}
+	c = nil
+	if c.SetWaitCapacity(1, 1, 1, wait) {
+		t.Fatal("set wait capacity shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheWriteAgeRange(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if _, _, ok := c.WriteAgeRange(); ok {
+		t.Fatal("write age range should fail for an empty cache")
+	}
+	before := time.Now()
+	c.Set(1, 1, 1)
+	time.Sleep(wait)
+	c.Set(2, 2, 1)
+	c.Wait()
+	oldest, newest, ok := c.WriteAgeRange()
+	if !ok || oldest.Before(before) || !newest.After(oldest) ||
+		newest.After(time.Now()) {
+		t.Fatal("write age range returned wrong times")
+	}
+	c = nil
+	if _, _, ok := c.WriteAgeRange(); ok {
+		t.Fatal("write age range shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheNil(t *testing.T) {
+	var c *Cache
+	loader := func() (interface{}, error) { return 1, nil }
+	if _, ok := c.Get(1); ok {
+		t.Fatal("nil cache get should miss")
+	}
+	if _, ok := c.GetFresh(1, wait, loader); ok {
+		t.Fatal("nil cache get fresh should miss")
+	}
+	if c.Set(1, 1, 1) || c.SetWithAltKey(1, 2, 1, 1) ||
+		c.SetWithRetry(1, 1, 1, 1, 0) || c.SetWaitCapacity(1, 1, 1, 0) {
+		t.Fatal("nil cache sets should be dropped")
+	}
+	if c.WouldEvict(1) || c.CounterSaturation() != 0 || c.Fingerprint() != 0 ||
+		c.GetByPrefix("") != nil ||
+		c.EffectiveConfig().MaxCost != 0 {
+		t.Fatal("nil cache should return zero values")
+	}
+	if _, _, ok := c.WriteAgeRange(); ok {
+		t.Fatal("nil cache shouldn't have a write age range")
+	}
+	if !c.Healthy(0) {
+		t.Fatal("nil cache should be healthy")
+	}
+	c.Del(1)
+	c.FlushGets()
+	c.Pause()
+	c.Resume()
+	c.Clear()
+	c.ClearWithShadow()
+	c.DropShadow()
+	c.Close()
+	var m *Metrics
+	if m.Hits() != 0 || m.Ratio() != 0 || m.UpdateRatio() != 0 ||
+		m.Rates(0) != (RateStats{}) || m.String() != "" {
+		t.Fatal("nil metrics should return zero values")
+	}
+	m.Clear()
+}
+
+func TestCacheMaxLifetime(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		MaxLifetime: 5 * wait,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Wait()
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("cache shouldn't be cleared before max lifetime")
+	}
+	time.Sleep(10 * wait)
+	if _, ok := c.Get(1); ok {
+		t.Fatal("cache should be cleared after max lifetime")
+	}
+	// the timer restarts after every clear
+	c.Set(2, 2, 1)
+	c.Wait()
+	if _, ok := c.Get(2); !ok {
+		t.Fatal("cache shouldn't be cleared right after the last clear")
+	}
+	c.Close()
+	time.Sleep(10 * wait)
+}
+
+func TestCacheMerge(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	add := func(existing interface{}) interface{} {
+		if existing == nil {
+			return 1
+		}
+		return existing.(int) + 1
+	}
+	if !c.Merge(1, add, 1) {
+		t.Fatal("merge of a missing key should be successful")
+	}
+	time.Sleep(wait)
+	if value, ok := c.Get(1); !ok || value.(int) != 1 {
+		t.Fatal("merge of a missing key should set the merged value")
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Merge(1, add, 1)
+		}()
+	}
+	wg.Wait()
+	if value, ok := c.Get(1); !ok || value.(int) != 11 {
+		t.Fatal("concurrent merges shouldn't lose updates")
+	}
+	// merged items are built like Set's
+	c, err = NewCache(&Config{
+		NumCounters:    100,
+		MaxCost:        100,
+		BufferItems:    64,
+		DefaultTTL:     time.Hour,
+		IncludeKeyCost: true,
+		ValueEncoder: func(b []byte) ([]byte, error) {
+			return append([]byte("encoded "), b...), nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Merge(1, func(interface{}) interface{} {
+		return []byte("value")
+	}, 1)
+	c.Wait()
+	if item, ok := c.store.GetItem(z.KeyToHash(1, 0), 1); !ok ||
+		string(item.value.([]byte)) != "encoded value" || item.expiration == 0 {
+		t.Fatal("merge should encode the value and set the default ttl")
+	}
+	if c.policy.Cost(z.KeyToHash(1, 0)) != 1+c.keyCost(1) {
+		t.Fatal("merge should include the key cost")
+	}
+	c.SetWithTTL(2, 2, 1, 0)
+	c.Wait()
+	c.Merge(2, add, 1)
+	c.Wait()
+	if ttl, ok := c.GetTTL(2); !ok || ttl <= 0 {
+		t.Fatal("merge should set the default ttl of existing keys")
+	}
+	c.Close()
+	if c.Merge(3, add, 1) {
+		t.Fatal("merge shouldn't be successful once the cache is closed")
+	}
+	c = nil
+	if c.Merge(1, add, 1) {
+		t.Fatal("merge shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheEvictionCandidates(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 1; i <= 3; i++ {
+		c.Set(i, i, int64(i))
+	}
+	c.Wait()
+	for i := 0; i < 3; i++ {
+		c.policy.Push([]uint64{z.KeyToHash(1, 0), z.KeyToHash(3, 0)})
+	}
+	time.Sleep(wait)
+	entries := c.EvictionCandidates(2)
+	if len(entries) != 2 || entries[0].Key != z.KeyToHash(2, 0) ||
+		entries[0].Value.(int) != 2 || entries[0].Cost != 2 || entries[0].Hits != 0 {
+		t.Fatal("eviction candidates should start with the least accessed item")
+	}
+	if len(c.EvictionCandidates(10)) != 3 || c.EvictionCandidates(0) != nil {
+		t.Fatal("eviction candidates returned wrong number of items")
+	}
+	if c.policy.Len() != 3 {
+		t.Fatal("eviction candidates shouldn't evict")
+	}
+	c = nil
+	if c.EvictionCandidates(1) != nil {
+		t.Fatal("nil cache shouldn't have eviction candidates")
+	}
+}
+
+func TestCacheSetWithTTL(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		DefaultTTL:  2 * wait,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.SetWithTTL(2, 2, 1, 0)
+	c.SetWithTTL(3, 3, 1, time.Hour)
+	if c.SetWithTTL(4, 4, 1, -1) {
+		t.Fatal("set with negative ttl should be dropped")
+	}
+	time.Sleep(wait)
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("item shouldn't expire before the default ttl")
+	}
+	time.Sleep(2 * wait)
+	if _, ok := c.Get(1); ok {
+		t.Fatal("item should expire after the default ttl")
+	}
+	if _, ok := c.Get(2); !ok {
+		t.Fatal("item set with a ttl of 0 shouldn't expire")
+	}
+	if _, ok := c.Get(3); !ok {
+		t.Fatal("item set with a ttl should override the default ttl")
+	}
+	c = nil
+	if c.SetWithTTL(1, 1, 1, time.Hour) {
+		t.Fatal("set with ttl shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheThroughputCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 5)
+	// too big for the cache, so it's rejected
+	c.Set(2, 2, 20)
+	c.Wait()
+	if c.Metrics.ThroughputCost() != 25 || c.Metrics.CostAdded() != 5 {
+		t.Fatal("throughput cost should include rejected sets")
+	}
+}
+
+func TestCacheGetValid(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	positive := func(value interface{}) bool {
+		return value.(int) > 0
+	}
+	c.Set(1, 1, 1)
+	c.Set(2, -1, 1)
+	c.Wait()
+	if value, ok := c.GetValid(1, positive); !ok || value.(int) != 1 {
+		t.Fatal("get valid should return a valid value")
+	}
+	if _, ok := c.GetValid(2, positive); ok {
+		t.Fatal("get valid shouldn't return an invalid value")
+	}
+	time.Sleep(wait)
+	if _, ok := c.Get(2); ok || c.policy.Has(z.KeyToHash(2, 0)) {
+		t.Fatal("get valid should delete an invalid value")
+	}
+	if _, ok := c.GetValid(3, positive); ok {
+		t.Fatal("get valid should miss a missing key")
+	}
+	if c.Metrics.Hits() != 1 || c.Metrics.Misses() != 3 {
+		t.Fatal("get valid should count an invalid value as a miss")
+	}
+	c = nil
+	if _, ok := c.GetValid(1, positive); ok {
+		t.Fatal("get valid shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheMapValues(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 1; i <= 3; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	c.MapValues(func(key, value interface{}) interface{} {
+		return key.(int) * value.(int)
+	})
+	for i := 1; i <= 3; i++ {
+		if value, ok := c.Get(i); !ok || value.(int) != i*i {
+			t.Fatal("map values didn't replace values")
+		}
+	}
+	if c.policy.Used() != 3 {
+		t.Fatal("map values shouldn't change costs")
+	}
+	c = nil
+	c.MapValues(func(key, value interface{}) interface{} { return value })
+}
+
+func TestCacheSetWithComputedCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Cost: func(value interface{}) int64 {
+			return int64(value.(int))
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	if cost, ok := <-c.SetWithComputedCost(1, 3); !ok || cost != 3 {
+		t.Fatal("set with computed cost should deliver the computed cost")
+	}
+	if cost, ok := <-c.SetWithComputedCost(1, 4); !ok || cost != 4 {
+		t.Fatal("set with computed cost should deliver the updated cost")
+	}
+	if _, ok := <-c.SetWithComputedCost(2, 20); ok {
+		t.Fatal("set with computed cost shouldn't deliver a rejected cost")
+	}
+	c.Close()
+	c = nil
+	if _, ok := <-c.SetWithComputedCost(1, 1); ok {
+		t.Fatal("set with computed cost shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheCollisionCount(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:     100,
+		MaxCost:         10,
+		BufferItems:     64,
+		StoreKeys:       true,
+		CountCollisions: true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Wait()
+	c.Get(1)
+	if c.CollisionCount() != 0 {
+		t.Fatal("get of the same key shouldn't count a collision")
+	}
+	// store a different key under the hash of key 2
+	c.store.Set(z.KeyToHash(2, 0), 3, 3, 0)
+	if _, ok := c.Get(2); ok || c.CollisionCount() != 1 {
+		t.Fatal("get should count and miss a collision")
+	}
+	c = nil
+	if c.CollisionCount() != 0 {
+		t.Fatal("nil cache shouldn't count collisions")
+	}
+}
+
+func TestCacheStoredKeyCollision(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		StoreKeys:   true,
+		KeyToHash: func(key interface{}, seed uint8) uint64 {
+			if k, ok := key.([]int); ok {
+				return uint64(len(k))
+			}
+			return z.KeyToHash(key, seed)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	// store a different key under the hash of key 2
+	c.store.Set(z.KeyToHash(2, 0), 3, 3, 0)
+	if _, ok := c.Get(2); ok || c.Has(2) {
+		t.Fatal("stored keys should tell collisions apart without counting them")
+	}
+	// keys that can't be compared are only told apart by their hashes
+	c.Set([]int{1}, 1, 1)
+	c.Wait()
+	if value, ok := c.Get([]int{2}); !ok || value.(int) != 1 {
+		t.Fatal("get shouldn't compare keys that can't be compared")
+	}
+}
+
+func TestCacheSweepExpired(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.SetWithTTL(1, 1, 1, wait)
+	c.Set(2, 2, 1)
+	time.Sleep(2 * wait)
+	// stand in for the sweeper goroutine
+	c.sweep <- struct{}{}
+	time.Sleep(wait)
+	if c.policy.Has(z.KeyToHash(1, 0)) || c.policy.Used() != 1 {
+		t.Fatal("sweep should purge expired items from the policy")
+	}
+	shard := c.store.(*shardedMap).shards[z.KeyToHash(1, 0)%numShards]
+	shard.RLock()
+	_, ok := shard.data[z.KeyToHash(1, 0)]
+	shard.RUnlock()
+	if ok {
+		t.Fatal("sweep should purge expired items from the hashmap")
+	}
+	if _, ok := c.Get(2); !ok {
+		t.Fatal("sweep shouldn't purge items without ttl")
+	}
+	c.Close()
+}
+
+func TestCacheWarmMap(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	// a hot item that admission would keep over new items
+	c.Set(0, 0, 8)
+	c.Wait()
+	for i := 0; i < 5; i++ {
+		c.policy.Push([]uint64{z.KeyToHash(0, 0)})
+	}
+	time.Sleep(wait)
+	c.WarmMap(map[interface{}]ValueCost{
+		1: {Value: 1, Cost: 5},
+		2: {Value: 2, Cost: 5},
+		3: {Value: 3, Cost: 20},
+	})
+	// no need to wait, items are applied before WarmMap returns
+	for i := 1; i <= 2; i++ {
+		if value, ok := c.Get(i); !ok || value.(int) != i {
+			t.Fatal("warm map should bypass admission")
+		}
+	}
+	if _, ok := c.Get(3); ok {
+		t.Fatal("warm map shouldn't add items bigger than the cache")
+	}
+	if c.policy.Used() != 10 {
+		t.Fatal("warm map should evict to make room")
+	}
+	c.Close()
+	c = nil
+	c.WarmMap(map[interface{}]ValueCost{1: {Value: 1, Cost: 1}})
+}
+
+func TestCacheGetTTL(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.SetWithTTL(2, 2, 1, time.Hour)
+	c.SetWithTTL(3, 3, 1, wait)
+	time.Sleep(wait / 2)
+	if ttl, ok := c.GetTTL(1); !ok || ttl != 0 {
+		t.Fatal("item without ttl should have a ttl of 0")
+	}
+	if ttl, ok := c.GetTTL(2); !ok || ttl <= 0 || ttl > time.Hour {
+		t.Fatal("item with ttl should have the remaining ttl")
+	}
+	if _, ok := c.GetTTL(4); ok {
+		t.Fatal("get ttl shouldn't find missing items")
+	}
+	time.Sleep(wait)
+	if _, ok := c.GetTTL(3); ok {
+		t.Fatal("get ttl shouldn't find expired items")
+	}
+	if c.Metrics.Hits() != 0 || c.Metrics.Misses() != 0 {
+		t.Fatal("get ttl shouldn't count as an access")
+	}
+	c = nil
+	if _, ok := c.GetTTL(1); ok {
+		t.Fatal("get ttl shouldn't find items in nil cache")
+	}
+}
+
+func TestCacheEvictReason(t *testing.T) {
+	m := &sync.Mutex{}
+	reasons := make(map[int]EvictReason)
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		OnEvict: func(item *Item) {
+			m.Lock()
+			defer m.Unlock()
+			reasons[item.Value.(int)] = item.Reason
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.SetWithTTL(1, 1, 1, wait)
+	c.Set(2, 2, 1)
+	c.Set(3, 3, 1)
+	time.Sleep(wait)
+	c.Del(2)
+	time.Sleep(wait)
+	c.sweep <- struct{}{}
+	time.Sleep(wait)
+	c.Clear()
+	m.Lock()
+	if reasons[1] != EvictExpired || reasons[2] != EvictDel ||
+		reasons[3] != EvictClear {
+		t.Fatal("evicted items should have the right reason")
+	}
+	m.Unlock()
+	if EvictCapacity.String() != "capacity" {
+		t.Fatal("evict reason string incorrect")
+	}
+}
+
+func TestCacheClearOnEvictSet(t *testing.T) {
+	var c *Cache
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		StoreKeys:   true,
+		OnEvict: func(item *Item) {
+			if item.Reason == EvictClear {
+				c.Set(item.OriginalKey, item.Value, 1)
+				c.Del(item.OriginalKey)
+			}
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Set(2, 2, 1)
+	c.Wait()
+	done := make(chan struct{})
+	go func() {
+		c.Clear()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("clear shouldn't deadlock when OnEvict sets or deletes keys")
+	}
+}
+
+func TestCacheWait(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	for i := 0; i < 10; i++ {
+		if _, ok := c.Get(i); !ok {
+			t.Fatal("wait should apply buffered sets")
+		}
+	}
+	c.Del(0)
+	c.Wait()
+	if _, ok := c.Get(0); ok {
+		t.Fatal("wait should apply buffered dels")
+	}
+	c.Close()
+	c.Wait()
+	c = nil
+	c.Wait()
+}
+
+type testMetricsSink struct {
+	hits, misses, adds, evicts, costEvicted int64
+}
+
+func (s *testMetricsSink) IncrHit()  { atomic.AddInt64(&s.hits, 1) }
+func (s *testMetricsSink) IncrMiss() { atomic.AddInt64(&s.misses, 1) }
+func (s *testMetricsSink) IncrAdd(cost int64) {
+	atomic.AddInt64(&s.adds, 1)
+}
+func (s *testMetricsSink) IncrUpdate() {}
+func (s *testMetricsSink) IncrEvict(cost int64) {
+	atomic.AddInt64(&s.evicts, 1)
+	atomic.AddInt64(&s.costEvicted, cost)
+}
+func (s *testMetricsSink) IncrDropSet()   {}
+func (s *testMetricsSink) IncrRejectSet() {}
+
+func TestCacheMetricsSink(t *testing.T) {
+	sink := &testMetricsSink{}
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     2,
+		BufferItems: 64,
+		Metrics:     true,
+		MetricsSink: sink,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 2)
+	c.Wait()
+	c.Get(1)
+	c.Get(2)
+	c.WarmMap(map[interface{}]ValueCost{3: {Value: 3, Cost: 2}})
+	if atomic.LoadInt64(&sink.hits) != 1 || atomic.LoadInt64(&sink.misses) != 1 {
+		t.Fatal("sink should be passed hits and misses")
+	}
+	if atomic.LoadInt64(&sink.adds) != 2 || atomic.LoadInt64(&sink.evicts) != 1 ||
+		atomic.LoadInt64(&sink.costEvicted) != 2 {
+		t.Fatal("sink should be passed adds and evictions")
+	}
+	if c.Metrics.Hits() != 0 || c.Metrics.KeysAdded() != 0 {
+		t.Fatal("metrics shouldn't be kept with a sink")
+	}
+}
+
+func TestCacheRejectSetsOnClear(t *testing.T) {
+	block := make(chan struct{})
+	c, err := NewCache(&Config{
+		NumCounters:       100,
+		MaxCost:           10,
+		BufferItems:       64,
+		Metrics:           true,
+		RejectSetsOnClear: true,
+		Cost: func(value interface{}) int64 {
+			<-block
+			return 1
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	// the first item blocks processItems, so Clear blocks until it's released
+	c.Set(1, 1, 0)
+	time.Sleep(wait)
+	cleared := make(chan struct{})
+	go func() {
+		c.Clear()
+		close(cleared)
+	}()
+	time.Sleep(wait)
+	if c.Set(2, 2, 1) {
+		t.Fatal("set should be rejected while clearing")
+	}
+	close(block)
+	<-cleared
+	if !c.Set(3, 3, 1) {
+		t.Fatal("set should be accepted once clear is done")
+	}
+	if c.Metrics.SetsRejectedOnClear() != 1 {
+		t.Fatal("sets rejected on clear should be counted")
+	}
+}
+
+func TestCacheLen(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 5; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	if c.Len() != 5 {
+		t.Fatal("len should count stored items")
+	}
+	c.Del(0)
+	c.Set(5, 5, 7)
+	c.Wait()
+	if c.Len() >= 5 || c.Len() != c.policy.Len() {
+		t.Fatal("len should reflect deletions and evictions")
+	}
+	c.Clear()
+	if c.Len() != 0 {
+		t.Fatal("len should be 0 after clear")
+	}
+	c = nil
+	if c.Len() != 0 {
+		t.Fatal("len should be 0 with nil cache")
+	}
+}
+
+func TestCacheNextReset(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if c.NextReset() != 100 {
+		t.Fatal("next reset should start at NumCounters")
+	}
+	c.policy.Push([]uint64{1, 2, 3})
+	time.Sleep(wait)
+	if c.NextReset() != 97 {
+		t.Fatal("next reset should count down with increments")
+	}
+	keys := make([]uint64, 97)
+	c.policy.Push(keys)
+	time.Sleep(wait)
+	if c.NextReset() != 100 {
+		t.Fatal("next reset should start over after a reset")
+	}
+	c = nil
+	if c.NextReset() != 0 {
+		t.Fatal("next reset should be 0 with nil cache")
+	}
+}
+
+func TestCacheCurrentCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 2)
+	c.Set(2, 2, 3)
+	c.Wait()
+	if c.CurrentCost() != 5 {
+		t.Fatal("current cost should be the sum of item costs")
+	}
+	c.Set(1, 1, 4)
+	c.Del(2)
+	c.Wait()
+	if c.CurrentCost() != 4 {
+		t.Fatal("current cost should follow updates and deletions")
+	}
+	c = nil
+	if c.CurrentCost() != 0 {
+		t.Fatal("current cost should be 0 with nil cache")
+	}
+}
+
+func TestCacheOnAdmit(t *testing.T) {
+	var admitted, admittedCost int64
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		OnAdmit: func(key uint64, value interface{}, cost int64) {
+			atomic.AddInt64(&admitted, 1)
+			atomic.AddInt64(&admittedCost, cost)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 2)
+	c.Set(2, 2, 3)
+	c.Set(3, 3, 11)
+	c.Wait()
+	// updates aren't admissions
+	c.Set(1, 1, 1)
+	c.Wait()
+	if atomic.LoadInt64(&admitted) != 2 || atomic.LoadInt64(&admittedCost) != 5 {
+		t.Fatal("on admit should be called for admitted items only")
+	}
+}
+
+func TestCacheUpdateMaxCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	c.UpdateMaxCost(4)
+	if c.CurrentCost() != 4 || c.Len() != 4 {
+		t.Fatal("update max cost should evict down to the new max cost")
+	}
+	if c.EffectiveConfig().MaxCost != 4 {
+		t.Fatal("effective config should have the new max cost")
+	}
+	c.UpdateMaxCost(20)
+	for i := 10; i < 20; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	if c.CurrentCost() != 14 {
+		t.Fatal("update max cost should make room for more items")
+	}
+	c.Close()
+	c.UpdateMaxCost(10)
+	c = nil
+	c.UpdateMaxCost(10)
+}
+
+func TestCacheHas(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 1,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Wait()
+	for i := 0; i < 10; i++ {
+		if !c.Has(1) || c.Has(2) {
+			t.Fatal("has should find stored keys only")
+		}
+	}
+	time.Sleep(wait)
+	if c.Metrics.Hits() != 0 || c.Metrics.Misses() != 0 ||
+		c.policy.NextReset() != 100 {
+		t.Fatal("has shouldn't count as an access")
+	}
+	c = nil
+	if c.Has(1) {
+		t.Fatal("has shouldn't find keys in nil cache")
+	}
+}
+
+func TestCacheGetSnapshot(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	keys := []interface{}{1, 2, 3, nil}
+	for _, key := range keys[:3] {
+		c.Set(key, 0, 1)
+	}
+	c.Wait()
+	// updates to the keys shouldn't make them look missing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := 1; v < 1000; v++ {
+			for _, key := range keys[:3] {
+				c.Set(key, v, 1)
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		snapshot, ok := c.GetSnapshot(keys)
+		if !ok || len(snapshot) != 3 {
+			t.Fatal("get snapshot should return every key found")
+		}
+	}
+	<-done
+	snapshot, _ := c.GetSnapshot([]interface{}{1, 4})
+	if len(snapshot) != 1 || snapshot[1] != 999 {
+		t.Fatal("get snapshot should leave out missing keys")
+	}
+	// a key locked for longer than the deadline can't be part of a snapshot
+	shard := c.store.(*shardedMap).shards[z.KeyToHash(2, 0)%numShards]
+	shard.Lock()
+	if _, ok := c.GetSnapshot(keys); ok {
+		t.Fatal("get snapshot should fail past the deadline")
+	}
+	shard.Unlock()
+	c = nil
+	if _, ok := c.GetSnapshot(keys); ok {
+		t.Fatal("get snapshot shouldn't be successful with nil cache")
+	}
+}
+
+func TestCachePeek(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 1,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Wait()
+	for i := 0; i < 10; i++ {
+		if value, ok := c.Peek(1); !ok || value.(int) != 1 {
+			t.Fatal("peek should return stored values")
+		}
+		if _, ok := c.Peek(2); ok {
+			t.Fatal("peek shouldn't find missing keys")
+		}
+	}
+	time.Sleep(wait)
+	if c.Metrics.Hits() != 0 || c.Metrics.Misses() != 0 ||
+		c.policy.NextReset() != 100 {
+		t.Fatal("peek shouldn't count as an access")
+	}
+	c = nil
+	if _, ok := c.Peek(1); ok {
+		t.Fatal("peek shouldn't find keys in nil cache")
+	}
+}
+
+type testSizer []byte
+
+func (s testSizer) Size() int64 { return int64(len(s)) }
+
+func TestCacheSizer(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, testSizer("abc"), 0)
+	c.Set(2, testSizer("abc"), 5)
+	c.Set(3, 3, 0)
+	c.Wait()
+	if c.policy.Cost(z.KeyToHash(1, 0)) != 3 {
+		t.Fatal("sizer values should cost their size")
+	}
+	if c.policy.Cost(z.KeyToHash(2, 0)) != 5 {
+		t.Fatal("sizer shouldn't override the cost passed to set")
+	}
+	if c.policy.Cost(z.KeyToHash(3, 0)) != 0 {
+		t.Fatal("values that aren't sizers should cost 0")
+	}
+	c.Close()
+	c, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     100,
+		BufferItems: 64,
+		Cost: func(value interface{}) int64 {
+			return 1
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, testSizer("abc"), 0)
+	c.Wait()
+	if c.policy.Cost(z.KeyToHash(1, 0)) != 1 {
+		t.Fatal("cost function should take precedence over sizer")
+	}
+}
+
+func TestCacheMaxConcurrentLoads(t *testing.T) {
+	if _, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		MaxConcurrentLoads: -1,
+	}); err == nil {
+		t.Fatal("MaxConcurrentLoads can't be negative")
+	}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		MaxConcurrentLoads: 2,
+	})
+	if err != nil {
+		panic(err)
+	}
+	var running, maxRunning int32
+	release := make(chan struct{})
+	loader := func() (interface{}, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+		return 1, nil
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			c.GetFresh(key, time.Hour, loader)
+		}(i)
+	}
+	time.Sleep(wait)
+	// loaders waiting for a slot stop waiting once their context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := c.GetFreshContext(ctx, 5, time.Hour, loader); ok {
+		t.Fatal("get fresh shouldn't load once the context is done")
+	}
+	close(release)
+	wg.Wait()
+	if atomic.LoadInt32(&maxRunning) != 2 {
+		t.Fatal("loaders should be limited to MaxConcurrentLoads")
+	}
+}
+
+func TestCacheSetWithVictims(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     4,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 4; i++ {
+		if added, victims := c.SetWithVictims(i, i, 1); !added || len(victims) != 0 {
+			t.Fatal("set with victims should add items without evicting")
+		}
+	}
+	// hits for the incoming key so it's admitted
+	c.policy.Push([]uint64{z.KeyToHash(4, 0), z.KeyToHash(4, 0)})
+	time.Sleep(wait)
+	added, victims := c.SetWithVictims(4, 4, 2)
+	if !added || len(victims) != 2 {
+		t.Fatal("set with victims should return the evicted keys")
+	}
+	for _, victim := range victims {
+		if c.policy.Has(victim) {
+			t.Fatal("set with victims returned keys that weren't evicted")
+		}
+	}
+	if added, _ := c.SetWithVictims(5, 5, 5); added {
+		t.Fatal("set with victims should return false for rejected items")
+	}
+	c.Close()
+	if added, _ := c.SetWithVictims(1, 1, 1); added {
+		t.Fatal("set with victims shouldn't be successful with closed cache")
+	}
+	c = nil
+	if added, _ := c.SetWithVictims(1, 1, 1); added {
+		t.Fatal("set with victims shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheSetIfAbsent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	var inserted int32
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(value int) {
+			defer wg.Done()
+			if c.SetIfAbsent(1, value, 1) {
+				atomic.AddInt32(&inserted, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&inserted) != 1 {
+		t.Fatal("only one set if absent should insert the key")
+	}
+	// visible right away
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("set if absent should insert the value right away")
+	}
+	c.Set(2, 2, 1)
+	c.Wait()
+	if c.SetIfAbsent(2, 3, 1) {
+		t.Fatal("set if absent shouldn't replace existing keys")
+	}
+	if value, _ := c.Get(2); value.(int) != 2 {
+		t.Fatal("set if absent shouldn't update existing keys")
+	}
+	if c.SetIfAbsent(3, 3, 11) {
+		c.Wait()
+		if _, ok := c.Get(3); ok {
+			t.Fatal("set if absent items rejected by the policy should be removed")
+		}
+	}
+	c.Wait()
+	if !c.policy.Has(z.KeyToHash(1, 0)) {
+		t.Fatal("set if absent items should be added to the policy")
+	}
+	c = nil
+	if c.SetIfAbsent(1, 1, 1) {
+		t.Fatal("set if absent shouldn't be successful with nil cache")
+	}
+}
+
+func TestCacheAddExpiredUnswept(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.SetWithTTL(1, "old", 1, wait)
+	c.SetWithTTL(2, "old", 1, wait)
+	c.Wait()
+	time.Sleep(2 * wait)
+	// the keys expired but haven't been swept, so the policy still has them
+	if !c.SetIfAbsent(1, "new", 1) {
+		t.Fatal("expired key should be absent")
+	}
+	c.Merge(2, func(interface{}) interface{} { return "new" }, 1)
+	c.Wait()
+	// stand in for the sweeper goroutine
+	c.sweep <- struct{}{}
+	time.Sleep(wait)
+	if val, ok := c.Get(1); !ok || val.(string) != "new" {
+		t.Fatal("SetIfAbsent on an expired key shouldn't keep its expiration")
+	}
+	if val, ok := c.Get(2); !ok || val.(string) != "new" {
+		t.Fatal("Merge on an expired key shouldn't keep its expiration")
+	}
+}
+
+func TestCacheOnLargeEvict(t *testing.T) {
+	var large int64
+	c, err := NewCache(&Config{
+		NumCounters:         100,
+		MaxCost:             10,
+		BufferItems:         64,
+		LargeEvictThreshold: 3,
+		OnLargeEvict: func(key uint64, value interface{}, cost int64) {
+			if cost <= 3 {
+				t.Error("on large evict called for a small item")
+			}
+			atomic.AddInt64(&large, 1)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 4)
+	c.Set(2, 2, 3)
+	c.Set(3, 3, 3)
+	c.Wait()
+	c.UpdateMaxCost(1)
+	if atomic.LoadInt64(&large) != 1 {
+		t.Fatal("on large evict should be called for large evictions")
+	}
+	c.Set(4, 4, 1)
+	c.Wait()
+	c.Del(4)
+	c.Wait()
+	if atomic.LoadInt64(&large) != 1 {
+		t.Fatal("on large evict should only be called for evictions")
+	}
+}
+
+func TestCacheGetOrSet(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	var computed int32
+	release := make(chan struct{})
+	compute := func() interface{} {
+		atomic.AddInt32(&computed, 1)
+		<-release
+		return 1
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, cached := c.GetOrSet(1, 1, compute); cached || value.(int) != 1 {
+				t.Error("get or set should return the computed value")
+			}
+		}()
+	}
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	if atomic.LoadInt32(&computed) != 1 {
+		t.Fatal("get or set should only compute once per key")
+	}
+	if value, cached := c.GetOrSet(1, 1, compute); !cached || value.(int) != 1 {
+		t.Fatal("get or set should return cached values")
+	}
+	c.Wait()
+	if !c.policy.Has(z.KeyToHash(1, 0)) {
+		t.Fatal("get or set should add the computed value to the policy")
+	}
+	c = nil
+	if value, cached := c.GetOrSet(1, 1, compute); cached || value.(int) != 1 {
+		t.Fatal("get or set should compute with nil cache")
+	}
+}
+
+func TestCacheEstimatedMemory(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     1000,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	empty := c.EstimatedMemory()
+	if empty <= 0 {
+		t.Fatal("estimated memory should include the counters")
+	}
+	c.Set(1, 1, 100)
+	c.Set(2, 2, 200)
+	c.Wait()
+	if c.EstimatedMemory() < empty+300 {
+		t.Fatal("estimated memory should include the cost of items")
+	}
+	c.Del(1)
+	c.Del(2)
+	c.Wait()
+	if c.EstimatedMemory() != empty {
+		t.Fatal("estimated memory should go back down after deletions")
+	}
+	c = nil
+	if c.EstimatedMemory() != 0 {
+		t.Fatal("estimated memory should be 0 with nil cache")
+	}
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	var loaded int32
+	release := make(chan struct{})
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Loader: func(key interface{}) (interface{}, int64, error) {
+			atomic.AddInt32(&loaded, 1)
+			<-release
+			if key.(int) == 2 {
+				return nil, 0, errors.New("load failed")
+			}
+			return key.(int) * 10, 2, nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := c.GetOrLoad(1); err != nil || value.(int) != 10 {
+				t.Error("get or load should return the loaded value")
+			}
+		}()
+	}
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	if atomic.LoadInt32(&loaded) != 1 {
+		t.Fatal("get or load should only call the loader once per key")
+	}
+	c.Wait()
+	if value, err := c.GetOrLoad(1); err != nil || value.(int) != 10 {
+		t.Fatal("get or load should return cached values")
+	}
+	if c.policy.Cost(z.KeyToHash(1, 0)) != 2 {
+		t.Fatal("get or load should use the cost returned by the loader")
+	}
+	if _, err := c.GetOrLoad(2); err == nil {
+		t.Fatal("get or load should return loader errors")
+	}
+	if _, err := c.GetOrLoad(2); err == nil ||
+		atomic.LoadInt32(&loaded) != 3 {
+		t.Fatal("get or load shouldn't cache loader errors")
+	}
+	c, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if _, err := c.GetOrLoad(1); err == nil {
+		t.Fatal("get or load should fail without a loader")
+	}
+	c = nil
+	if _, err := c.GetOrLoad(1); err == nil {
+		t.Fatal("get or load should fail with nil cache")
+	}
+}
+
+func TestCacheGetOrLoadPanic(t *testing.T) {
+	var panics int32
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		MaxConcurrentLoads: 1,
+		Loader: func(key interface{}) (interface{}, int64, error) {
+			if atomic.AddInt32(&panics, 1) == 1 {
+				panic("load panicked")
+			}
+			return key.(int) * 10, 1, nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != "load panicked" {
+				t.Fatal("get or load should pass on the loader's panic")
+			}
+		}()
+		c.GetOrLoad(1)
+	}()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if value, err := c.GetOrLoad(1); err != nil || value.(int) != 10 {
+			t.Error("get or load should load again after a panic")
+		}
+		if value, _ := c.GetOrSet(2, 1, func() interface{} {
+			return 20
+		}); value.(int) != 20 {
+			t.Error("get or set should compute after a panic")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a loader panic shouldn't block later loads of the key")
+	}
+}
+
+func TestCacheNumSetWorkers(t *testing.T) {
+	if _, err := NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		NumSetWorkers: -1,
+	}); err == nil {
+		t.Fatal("negative NumSetWorkers should be rejected")
+	}
+	c, err := NewCache(&Config{
+		NumCounters:   1000,
+		MaxCost:       1000,
+		BufferItems:   64,
+		NumSetWorkers: 4,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 100; i++ {
+		c.SetWithAltKey(i, i+1000, i, 1)
+		if i%2 == 0 {
+			c.Del(i)
+		}
+	}
+	c.Wait()
+	for i := 0; i < 100; i++ {
+		_, ok := c.Get(i)
+		if ok != (i%2 == 1) {
+			t.Fatal("sets and dels of a key should be applied in order")
+		}
+		if ok && !c.policy.Has(z.KeyToHash(i, 0)) {
+			t.Fatal("set workers should add items to the policy")
+		}
+	}
+	if c.policy.Len() != 50 {
+		t.Fatal("deleted items should be removed from the policy")
+	}
+	c.Clear()
+	c.Set(1, 1, 1)
+	c.Wait()
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("set workers should be restarted after clear")
+	}
+	c.Close()
+	c, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if c.EffectiveConfig().NumSetWorkers != 1 {
+		t.Fatal("there should be 1 set worker by default")
+	}
+}
+
+func BenchmarkCacheSetWorkers(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			c, err := NewCache(&Config{
+				NumCounters:   1e6,
+				MaxCost:       1e5,
+				BufferItems:   64,
+				Metrics:       true,
+				NumSetWorkers: workers,
+			})
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			var next uint64
+			b.SetBytes(1)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := atomic.AddUint64(&next, 1) % 1e6
+					c.Set(key, key, 1)
+				}
+			})
+			c.Wait()
+			b.ReportMetric(float64(c.Metrics.SetsDropped())/float64(b.N),
+				"drops/op")
+		})
+	}
+}
+
+func TestCacheSetBufferSize(t *testing.T) {
+	if _, err := NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		SetBufferSize: -1,
+	}); err == nil {
+		t.Fatal("negative SetBufferSize should be rejected")
+	}
+	c, err := NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		SetBufferSize: 2,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if cap(c.setBuf) != 2 {
+		t.Fatal("set buffer should have the configured size")
+	}
+	c.Pause()
+	c.Set(1, 1, 1)
+	c.Set(2, 2, 1)
+	if c.Set(3, 3, 1) {
+		t.Fatal("sets should be dropped once the set buffer is full")
+	}
+	c.Resume()
+	c, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if cap(c.setBuf) != setBufSize || c.EffectiveConfig().SetBufferSize != setBufSize {
+		t.Fatal("set buffer should have the default size")
+	}
+}
+
+func TestCacheSetBlocking(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		SetBufferSize: 1,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Pause()
+	if !c.SetBlocking(1, 1, 1) {
+		t.Fatal("blocking set should buffer the item")
+	}
+	done := make(chan struct{})
+	go func() {
+		c.SetBlocking(2, 2, 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("blocking set should wait for room in the set buffer")
+	case <-time.After(wait):
+	}
+	c.Resume()
+	<-done
+	c.Wait()
+	if _, ok := c.Get(2); !ok {
+		t.Fatal("blocking set shouldn't be dropped")
+	}
+	c.Close()
+	if c.SetBlocking(3, 3, 1) {
+		t.Fatal("blocking set should fail on a closed cache")
+	}
+	c = nil
+	if c.SetBlocking(1, 1, 1) {
+		t.Fatal("blocking set should fail with nil cache")
+	}
+}
+
+func TestCacheKeyToHash(t *testing.T) {
+	type key struct {
+		a, b uint32
+	}
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Hashes:      2,
+		// z.KeyToHash panics on struct keys, so this must be used throughout
+		KeyToHash: func(k interface{}, seed uint8) uint64 {
+			k2 := k.(key)
+			return (uint64(k2.a)<<32 | uint64(k2.b)) + uint64(seed)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	if !c.Set(key{1, 2}, 3, 1) {
+		t.Fatal("set should use the configured key to hash function")
+	}
+	c.Wait()
+	if value, ok := c.Get(key{1, 2}); !ok || value.(int) != 3 {
+		t.Fatal("get should find what set stored")
+	}
+	if _, ok := c.Get(key{2, 1}); ok {
+		t.Fatal("get should miss on other keys")
+	}
+	if !c.policy.Has(c.keyToHash(key{1, 2}, 0)) {
+		t.Fatal("set should add the configured key hash to the policy")
+	}
+	if _, ok := c.Del(key{1, 2}); !ok {
+		t.Fatal("del should use the configured key to hash function")
+	}
+	if _, ok := c.Get(key{1, 2}); ok {
+		t.Fatal("del should delete what set stored")
+	}
+}
+
+func TestCacheGetByHash(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Hashes:      2,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Wait()
+	if value, ok := c.GetByHash(c.keyToHash(1, 0), 1); !ok || value.(int) != 1 {
+		t.Fatal("get by hash should find the key")
+	}
+	if _, ok := c.GetByHash(c.keyToHash(1, 0), 2); ok {
+		t.Fatal("get by hash should check the key for collisions")
+	}
+	if value, ok := c.GetByHash(c.keyToHash(1, 0), nil); !ok || value.(int) != 1 {
+		t.Fatal("get by hash should skip collision checks without the key")
+	}
+	if c.Metrics.Hits() != 2 || c.Metrics.Misses() != 1 {
+		t.Fatal("get by hash should record hits and misses")
+	}
+	c = nil
+	if _, ok := c.GetByHash(1, 1); ok {
+		t.Fatal("get by hash should miss with nil cache")
+	}
+}
+
+func TestCacheSetDelByHash(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Hashes:      2,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if !c.SetByHash(c.keyToHash(1, 0), 1, 1, 1) {
+		t.Fatal("set by hash should buffer the item")
+	}
+	c.Wait()
+	if value, ok := c.Get(1); !ok || value.(int) != 1 {
+		t.Fatal("set by hash should be found by get")
+	}
+	if _, ok := c.DelByHash(c.keyToHash(1, 0), 2); ok {
+		t.Fatal("del by hash should check the key for collisions")
+	}
+	if value, ok := c.DelByHash(c.keyToHash(1, 0), 1); !ok || value.(int) != 1 {
+		t.Fatal("del by hash should return the deleted value")
+	}
+	c.Wait()
+	if _, ok := c.Get(1); ok || c.policy.Has(c.keyToHash(1, 0)) {
+		t.Fatal("del by hash should delete the key")
+	}
+	c.SetByHash(c.keyToHash(2, 0), 2, 2, 1)
+	c.Wait()
+	if _, ok := c.DelByHash(c.keyToHash(2, 0), nil); !ok {
+		t.Fatal("del by hash should skip collision checks without the key")
+	}
+	c = nil
+	if c.SetByHash(1, 1, 1, 1) {
+		t.Fatal("set by hash should fail with nil cache")
+	}
+	if _, ok := c.DelByHash(1, 1); ok {
+		t.Fatal("del by hash should fail with nil cache")
+	}
+}
+
+func TestCacheSetMany(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		SetBufferSize: 3,
+		Metrics:       true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	items := []KeyValueCost{{1, 1, 1}, {2, 2, 1}, {nil, 0, 1}, {3, 3, 1}}
+	if c.SetMany(items) != 3 {
+		t.Fatal("set many should buffer every item with a key")
+	}
+	c.Wait()
+	for i := 1; i <= 3; i++ {
+		if value, ok := c.Get(i); !ok || value.(int) != i {
+			t.Fatal("set many should set every item")
+		}
+	}
+	c.Pause()
+	items = append(items, KeyValueCost{4, 4, 1}, KeyValueCost{5, 5, 1})
+	if c.SetMany(items) != 3 || c.Metrics.SetsDropped() != 2 {
+		t.Fatal("set many should drop items once the set buffer is full")
+	}
+	c.Resume()
+	c = nil
+	if c.SetMany(items) != 0 {
+		t.Fatal("set many should set nothing with nil cache")
+	}
+}
+
+func TestCacheGetMany(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Set(2, 2, 1)
+	c.Wait()
+	values := c.GetMany([]interface{}{1, 2, 3, nil})
+	if len(values) != 2 || values[1].(int) != 1 || values[2].(int) != 2 {
+		t.Fatal("get many should return the values of the keys found")
+	}
+	if _, ok := values[3]; ok {
+		t.Fatal("get many should leave out missing keys")
+	}
+	if c.Metrics.Hits() != 2 || c.Metrics.Misses() != 1 {
+		t.Fatal("get many should record hits and misses for every key")
+	}
+	c = nil
+	if c.GetMany([]interface{}{1}) != nil {
+		t.Fatal("get many should return nil with nil cache")
+	}
+}
+
+func TestCacheForEach(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.SetWithAltKey(2, 20, 2, 2)
+	c.Wait()
+	seen := make(map[uint64]int64)
+	c.ForEach(func(key uint64, value interface{}, cost int64) bool {
+		if value.(int) != int(key) {
+			t.Fatal("for each should pass the value of the key")
+		}
+		seen[key] = cost
+		return true
+	})
+	if len(seen) != 2 || seen[1] != 1 || seen[2] != 2 {
+		t.Fatal("for each should visit every item once with its cost")
+	}
+	calls := 0
+	c.ForEach(func(key uint64, value interface{}, cost int64) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Fatal("for each should stop when fn returns false")
+	}
+	c = nil
+	c.ForEach(func(key uint64, value interface{}, cost int64) bool {
+		t.Fatal("for each shouldn't call fn with nil cache")
+		return true
+	})
+}
+
+func TestCacheEstimateFrequency(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 1,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if c.EstimateFrequency(1) != 0 {
+		t.Fatal("estimate should be 0 before any access")
+	}
+	for i := 0; i < 3; i++ {
+		c.Get(1)
+		time.Sleep(wait)
+	}
+	if c.EstimateFrequency(1) < 3 {
+		t.Fatal("estimate should count the accesses")
+	}
+	if c.EstimateFrequency(nil) != 0 {
+		t.Fatal("estimate should be 0 with nil key")
+	}
+	c = nil
+	if c.EstimateFrequency(1) != 0 {
+		t.Fatal("estimate should be 0 with nil cache")
+	}
+}
+
+func TestCacheCloseTwice(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		SetBufferSize: 1,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 1)
+	c.Wait()
+	c.Pause()
+	c.SetBlocking(2, 2, 1)
+	done := make(chan bool)
+	go func() {
+		done <- c.SetBlocking(3, 3, 1)
+	}()
+	time.Sleep(wait)
+	c.Close()
+	if <-done {
+		t.Fatal("blocking set should fail once the cache is closed")
+	}
+	c.Close()
+	if c.Set(1, 1, 1) {
+		t.Fatal("set should fail after close")
+	}
+	if c.SetBlocking(1, 1, 1) {
+		t.Fatal("blocking set should fail after close")
+	}
+	if _, ok := c.Get(1); ok {
+		t.Fatal("get should miss after close")
+	}
+	if _, ok := c.Del(1); ok {
+		t.Fatal("del should fail after close")
+	}
+	c.Wait()
+	c.Clear()
+	c.Pause()
+	c.Resume()
+}
+
+func TestCacheSwap(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if prev, had := c.Swap(1, 1, 1); had || prev != nil {
+		t.Fatal("swap should report an absent key")
+	}
+	c.Wait()
+	if val, ok := c.Get(1); !ok || val.(int) != 1 {
+		t.Fatal("swap should set an absent key")
+	}
+	if prev, had := c.Swap(1, 2, 1); !had || prev.(int) != 1 {
+		t.Fatal("swap should return the previous value")
+	}
+	if val, ok := c.Get(1); !ok || val.(int) != 2 {
+		t.Fatal("swap should replace the value right away")
+	}
+	var wg sync.WaitGroup
+	seen := make([]int32, 101)
+	for i := 3; i < 103; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			prev, had := c.Swap(1, i, 1)
+			if !had {
+				t.Error("concurrent swap should find the key")
+				return
+			}
+			atomic.AddInt32(&seen[prev.(int)-2], 1)
+		}(i)
+	}
+	wg.Wait()
+	last, _ := c.Get(1)
+	for v, n := range seen {
+		if n > 1 || (n == 0) != (v+2 == last.(int)) {
+			t.Fatal("every value should be swapped out exactly once")
+		}
+	}
+	c = nil
+	if _, had := c.Swap(1, 1, 1); had {
+		t.Fatal("swap should fail with nil cache")
+	}
+}
+
+func TestCacheMaxCostPerItem(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:    100,
+		MaxCost:        100,
+		MaxCostPerItem: 10,
+		BufferItems:    64,
+		Metrics:        true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 10)
+	c.Set(2, 2, 11)
+	c.Set(3, 3, 101)
+	c.Wait()
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("item within MaxCostPerItem should be admitted")
+	}
+	if _, ok := c.Get(2); ok {
+		t.Fatal("item over MaxCostPerItem should be rejected")
+	}
+	c.Set(1, 1, 20)
+	c.Wait()
+	if _, ok := c.Get(1); ok {
+		t.Fatal("update over MaxCostPerItem should remove the key")
+	}
+	if c.Metrics.SetsRejectedOversize() != 3 || c.Metrics.SetsRejected() != 0 {
+		t.Fatal("oversized items should be counted separately")
+	}
+	if _, err := NewCache(&Config{
+		NumCounters:    100,
+		MaxCost:        100,
+		MaxCostPerItem: -1,
+		BufferItems:    64,
+	}); err == nil {
+		t.Fatal("negative MaxCostPerItem should be an error")
+	}
+	c, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, 1, 11)
+	c.Wait()
+	if c.Metrics.SetsRejectedOversize() != 1 {
+		t.Fatal("items over MaxCost should be counted as oversized")
+	}
+}
+
+func TestCacheMaxItems(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		MaxItems:    5,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 20; i++ {
+		c.Set(i, i, 1)
+		c.Wait()
+	}
+	if n := c.Len(); n > 5 || n == 0 {
+		t.Fatal("cache should hold at most MaxItems items")
+	}
+	if _, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		MaxItems:    -1,
+		BufferItems: 64,
+	}); err == nil {
+		t.Fatal("negative MaxItems should be an error")
+	}
+}
+
+func TestCacheCallbackPanics(t *testing.T) {
+	var recovered int32
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+		Cost: func(value interface{}) int64 {
+			if value == nil {
+				panic("nil value")
+			}
+			return 1
+		},
+		OnEvict: func(item *Item) {
+			if item.Value.(int) == 2 {
+				panic("bad value")
+			}
+		},
+		OnPanic: func(interface{}) {
+			atomic.AddInt32(&recovered, 1)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(1, nil, 0)
+	c.Wait()
+	if _, ok := c.Get(1); ok {
+		t.Fatal("item whose cost panicked should be dropped")
+	}
+	c.Set(2, 2, 0)
+	c.Wait()
+	c.Del(2)
+	c.Set(3, 3, 0)
+	c.Wait()
+	if _, ok := c.Get(3); !ok {
+		t.Fatal("sets should still be processed after a callback panicked")
+	}
+	if c.Metrics.CallbackPanics() != 2 || atomic.LoadInt32(&recovered) != 2 {
+		t.Fatal("callback panics should be counted and passed to OnPanic")
+	}
+}
+
+func TestCacheOnEvictOriginalKey(t *testing.T) {
+	var mu sync.Mutex
+	keys := make(map[EvictReason]interface{})
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     1,
+		BufferItems: 64,
+		StoreKeys:   true,
+		OnEvict: func(item *Item) {
+			mu.Lock()
+			keys[item.Reason] = item.OriginalKey
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set("a", 1, 1)
+	c.Wait()
+	// make b more frequent than a, so it's admitted in its place
+	for i := 0; i < 10; i++ {
+		c.policy.Push([]uint64{z.KeyToHash("b", 0)})
+	}
+	time.Sleep(wait)
+	c.Set("b", 2, 1)
+	c.Wait()
+	c.Del("b")
+	c.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if keys[EvictCapacity] != "a" {
+		t.Fatal("evicted item should carry its original key")
+	}
+	if keys[EvictDel] != "b" {
+		t.Fatal("deleted item should carry its original key")
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// evictBufSize is the number of evicted items that can be queued for the
+	// OnEvict workers (or the OnEvictBatch batcher) before further evictions
+	// are dropped.
+	evictBufSize = 1024
+	// evictBatchSize is the default Config.EvictBatchSize.
+	evictBatchSize = 64
+	// evictBatchWindow is the default Config.EvictBatchWindow.
+	evictBatchWindow = 100 * time.Millisecond
+)
+
+// EvictReason is the reason an item was removed from the cache, as passed to
+// eviction callbacks.
+type EvictReason int
+
+const (
+	// EvictCapacity is for items evicted to make room for other items, or
+	// because of memory pressure.
+	EvictCapacity EvictReason = iota
+	// EvictExpired is for items whose TTL passed.
+	EvictExpired
+	// EvictDel is for items deleted with Del.
+	EvictDel
+	// EvictClear is for items removed by Clear.
+	EvictClear
+)
+
+// String returns a string representation of the EvictReason.
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	case EvictDel:
+		return "del"
+	case EvictClear:
+		return "clear"
+	default:
+		return "unknown"
+	}
+}
+
+// Item is a key-value item passed to eviction callbacks.
+type Item struct {
+	// Key is the hashed key of the item.
+	Key uint64
+	// OriginalKey is the key the item was Set with, if it's known: items
+	// evicted, expired or cleared only have it with Config.StoreKeys, while
+	// items deleted with Del always do. Write-back caches can use it to tell
+	// which record to flush.
+	OriginalKey interface{}
+	// Value is the value of the item.
+	Value interface{}
+	// Cost is the cost the item was admitted with.
+	Cost int64
+	// Reason is why the item was removed from the cache.
+	Reason EvictReason
+}
+
+// evictPool runs the OnEvict callback on a fixed number of worker goroutines,
+// so slow callbacks don't hold up the processing of Sets.
+type evictPool struct {
+	onEvict func(*Item)
+	items   chan *Item
+	wg      sync.WaitGroup
+}
+
+func newEvictPool(onEvict func(*Item), workers int) *evictPool {
+	p := &evictPool{
+		onEvict: onEvict,
+		items:   make(chan *Item, evictBufSize),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.processItems()
+	}
+	return p
+}
+
+func (p *evictPool) processItems() {
+	defer p.wg.Done()
+	for i := range p.items {
+		p.onEvict(i)
+	}
+}
+
+// Push queues the evicted item for the workers. It returns false if the queue
+// is full and the item was dropped.
+func (p *evictPool) Push(i *Item) bool {
+	select {
+	case p.items <- i:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close blocks until all queued items have been passed to OnEvict and the
+// workers have returned.
+func (p *evictPool) Close() {
+	close(p.items)
+	p.wg.Wait()
+}
+
+// evictBatcher aggregates evicted items and passes them to OnEvictBatch once
+// enough have accumulated or the batch window has passed, whichever is first.
+type evictBatcher struct {
+	onEvict func([]*Item)
+	items   chan *Item
+	size    int
+	window  time.Duration
+	done    chan struct{}
+}
+
+func newEvictBatcher(onEvict func([]*Item), size int,
+	window time.Duration) *evictBatcher {
+	b := &evictBatcher{
+		onEvict: onEvict,
+		items:   make(chan *Item, evictBufSize),
+		size:    size,
+		window:  window,
+		done:    make(chan struct{}),
+	}
+	go b.processItems()
+	return b
+}
+
+func (b *evictBatcher) processItems() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.window)
+	defer ticker.Stop()
+	batch := make([]*Item, 0, b.size)
+	flush := func() {
+		if len(batch) > 0 {
+			b.onEvict(batch)
+			batch = make([]*Item, 0, b.size)
+		}
+	}
+	for {
+		select {
+		case i, ok := <-b.items:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, i); len(batch) >= b.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Push queues the evicted item for the next batch. It returns false if the
+// queue is full and the item was dropped.
+func (b *evictBatcher) Push(i *Item) bool {
+	select {
+	case b.items <- i:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close flushes any pending items and blocks until the batcher has returned.
+func (b *evictBatcher) Close() {
+	close(b.items)
+	<-b.done
+}
@@ -0,0 +1,60 @@
+package ristretto
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvictPool(t *testing.T) {
+	var calls int64
+	block := make(chan struct{})
+	p := newEvictPool(func(item *Item) {
+		<-block
+		atomic.AddInt64(&calls, item.Cost)
+	}, 2)
+	pushed := int64(0)
+	for i := 0; i < evictBufSize+10; i++ {
+		if p.Push(&Item{Key: uint64(i), Cost: 1}) {
+			pushed++
+		}
+	}
+	if pushed == evictBufSize+10 {
+		t.Fatal("push should drop items once the queue is full")
+	}
+	close(block)
+	p.Close()
+	if atomic.LoadInt64(&calls) != pushed {
+		t.Fatal("close didn't wait for queued items")
+	}
+}
+
+func TestEvictBatcher(t *testing.T) {
+	batches := make(chan []*Item, 10)
+	b := newEvictBatcher(func(items []*Item) {
+		batches <- items
+	}, 2, time.Hour)
+	b.Push(&Item{Key: 1})
+	b.Push(&Item{Key: 2})
+	if batch := <-batches; len(batch) != 2 {
+		t.Fatal("batch not flushed once full")
+	}
+	b.Push(&Item{Key: 3})
+	b.Close()
+	if batch := <-batches; len(batch) != 1 || batch[0].Key != 3 {
+		t.Fatal("close didn't flush pending items")
+	}
+	b = newEvictBatcher(func(items []*Item) {
+		batches <- items
+	}, 100, wait)
+	b.Push(&Item{Key: 4})
+	select {
+	case batch := <-batches:
+		if len(batch) != 1 {
+			t.Fatal("window flushed wrong items")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch not flushed after window")
+	}
+	b.Close()
+}
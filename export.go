@@ -0,0 +1,335 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// exportMagic starts every blob returned by Export.
+	exportMagic = "ristretto"
+	// exportVersion is the version of the Export format, which is bumped
+	// whenever exportedCache changes incompatibly.
+	exportVersion uint16 = 1
+	// snapshotMagic starts every snapshot written by Snapshot.
+	snapshotMagic = "ristretto-snapshot"
+	// snapshotVersion is the version of the Snapshot format, which is bumped
+	// whenever snapshotItem changes incompatibly.
+	snapshotVersion uint16 = 1
+)
+
+// snapshotItem is what Snapshot encodes (with gob) for every item, after the
+// header.
+type snapshotItem struct {
+	Key   interface{}
+	Value interface{}
+	Cost  int64
+	// Expiration is the UnixNano time the item expires at, or 0 if it never
+	// does.
+	Expiration int64
+}
+
+// exportedCache is what Export encodes (with gob) after the header.
+type exportedCache struct {
+	// NumCounters and Hashes must match for the counters to be usable.
+	NumCounters int64
+	Hashes      uint8
+	Items       []exportedItem
+	Counters    *policyCounters
+}
+
+// exportedItem is an item in the cache, along with its policy metadata.
+type exportedItem struct {
+	// KeyHash is only used to tell if the key still hashes the same, as it's
+	// hashed again on Import.
+	KeyHash    uint64
+	Key        interface{}
+	Value      interface{}
+	Cost       int64
+	Updated    int64
+	Expiration int64
+}
+
+// Export returns the entire state of the cache (values with their costs and
+// TTLs, and the frequency counters) as a single blob, so a warm cache can be
+// kept in a KV store or object storage between restarts and restored with
+// Import.
+//
+// It requires Config.StoreKeys, since keys are hashed again on Import: the
+// default KeyToHash uses a different seed for strings and []byte in every
+// process. Keys and values are encoded with encoding/gob, so types other than
+// the basic ones have to be registered with gob.Register. Processing of Sets
+// is stopped meanwhile, but Sets that update existing keys concurrently may or
+// may not be included. Alternate keys aren't exported.
+func (c *Cache) Export() ([]byte, error) {
+	if c == nil {
+		return nil, errors.New("Cache is nil.")
+	}
+	if !c.config.StoreKeys {
+		return nil, errors.New("Export requires Config.StoreKeys.")
+	}
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return nil, errors.New("Cache is closed.")
+	}
+	// block until processItems goroutine is returned
+	c.stopProcessing()
+	defer c.startProcessing()
+	counters := c.policy.Counters()
+	if counters == nil {
+		return nil, errors.New("Export isn't supported with a custom Policy.")
+	}
+	exported := &exportedCache{
+		NumCounters: c.config.NumCounters,
+		Hashes:      c.config.Hashes,
+		Counters:    counters,
+	}
+	c.store.Range(func(i storeItem) bool {
+		// alternate keys aren't known to the policy
+		cost := c.policy.Cost(i.keyHash)
+		if cost == -1 {
+			return true
+		}
+		exported.Items = append(exported.Items, exportedItem{
+			KeyHash:    i.keyHash,
+			Key:        i.key,
+			Value:      i.value,
+			Cost:       cost,
+			Updated:    i.updated,
+			Expiration: i.expiration,
+		})
+		return true
+	})
+	var buf bytes.Buffer
+	buf.WriteString(exportMagic)
+	binary.Write(&buf, binary.BigEndian, exportVersion)
+	if err := gob.NewEncoder(&buf).Encode(exported); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Import replaces the contents of the cache with the state returned by Export,
+// which has to come from a cache with the same NumCounters and Hashes. Every
+// item that hasn't expired since is added under its key hashed again,
+// bypassing admission as with WarmMap. The frequency counters are indexed by
+// key hash, so they're only restored if every key still hashes the same (such
+// as integer keys with the default KeyToHash). If the blob can't be imported,
+// an error is returned and the cache is left untouched.
+//
+// Processing of Sets is stopped meanwhile, and Sets still in the buffer are
+// applied after the import.
+func (c *Cache) Import(data []byte) error {
+	if c == nil {
+		return errors.New("Cache is nil.")
+	}
+	if !bytes.HasPrefix(data, []byte(exportMagic)) {
+		return errors.New("Data isn't an exported cache.")
+	}
+	r := bytes.NewReader(data[len(exportMagic):])
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version != exportVersion {
+		return fmt.Errorf("Export version %d isn't supported.", version)
+	}
+	exported := &exportedCache{}
+	if err := gob.NewDecoder(r).Decode(exported); err != nil {
+		return err
+	}
+	if counters := exported.Counters; counters == nil ||
+		len(counters.Rows) != cmDepth || len(counters.Seeds) != cmDepth {
+		return errors.New("Exported cache is missing its counters.")
+	}
+	if exported.NumCounters != c.config.NumCounters ||
+		exported.Hashes != c.config.Hashes {
+		return errors.New("NumCounters and Hashes must match the exported cache.")
+	}
+	rehashed := false
+	for j := range exported.Items {
+		i := &exported.Items[j]
+		if i.Key == nil {
+			return errors.New("Exported cache is missing its keys.")
+		}
+		keyHash := c.keyToHash(i.Key, 0)
+		rehashed = rehashed || keyHash != i.KeyHash
+		i.KeyHash = keyHash
+	}
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return errors.New("Cache is closed.")
+	}
+	// block until processItems goroutine is returned
+	c.stopProcessing()
+	c.policy.Clear()
+	c.store.Clear()
+	c.altKeys = make(map[uint64]uint64)
+	now := time.Now().UnixNano()
+	for _, i := range exported.Items {
+		if i.Expiration != 0 && now >= i.Expiration {
+			continue
+		}
+		victims, added := c.policy.Warm(i.KeyHash, i.Cost)
+		if added {
+			hashes := make([]uint64, c.config.Hashes)
+			for j := uint8(1); j < c.config.Hashes; j++ {
+				hashes[j-1] = c.keyToHash(i.Key, j)
+			}
+			if !c.config.StoreKeys {
+				i.Key = nil
+			}
+			c.store.SetItem(storeItem{
+				keyHash:    i.KeyHash,
+				hashes:     hashes,
+				key:        i.Key,
+				value:      i.Value,
+				updated:    i.Updated,
+				expiration: i.Expiration,
+			})
+			if i.Expiration != 0 {
+				c.policy.SetExpiration(i.KeyHash, i.Expiration)
+			}
+		}
+		c.evict(victims)
+	}
+	if !rehashed {
+		c.policy.SetCounters(exported.Counters)
+	}
+	c.checkEmpty()
+	c.startProcessing()
+	return nil
+}
+
+// Snapshot writes the items in the cache (keys, values, costs and TTLs) to w,
+// so the working set can be persisted across restarts and reloaded with Load.
+// It requires Config.StoreKeys, since items are loaded by their original keys.
+//
+// The format is the magic string "ristretto-snapshot", a big-endian uint16
+// version (currently 1), and then a gob-encoded snapshotItem for every item
+// until the end of the stream. Keys and values are encoded with encoding/gob,
+// so types other than the basic ones have to be registered with gob.Register.
+// Values are written as returned by Get, so after ValueDecoder.
+//
+// The items are collected one shard at a time before any is written, so
+// concurrent writes may or may not be included. Unlike Export, the frequency
+// counters aren't included.
+func (c *Cache) Snapshot(w io.Writer) error {
+	if c == nil {
+		return errors.New("Cache is nil.")
+	}
+	if !c.config.StoreKeys {
+		return errors.New("Snapshot requires Config.StoreKeys.")
+	}
+	var items []snapshotItem
+	c.store.Range(func(i storeItem) bool {
+		// alternate keys aren't known to the policy
+		cost := c.policy.Cost(i.keyHash)
+		if cost == -1 || i.key == nil {
+			return true
+		}
+		value := i.value
+		if c.valueDecoder != nil {
+			decoded, ok := c.decode(value)
+			if !ok {
+				return true
+			}
+			value = decoded
+		}
+		items = append(items, snapshotItem{
+			Key:   i.key,
+			Value: value,
+			// the key's cost is added again when it's loaded
+			Cost:       cost - c.keyCost(i.key),
+			Expiration: i.expiration,
+		})
+		return true
+	})
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, snapshotVersion); err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(w)
+	for _, i := range items {
+		if err := enc.Encode(&i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads a snapshot written by Snapshot from r and Sets every item that
+// hasn't expired since, with its cost and remaining TTL. Unlike Import, the
+// items go through the Set buffer and the admission policy like any other Set,
+// so the cache's MaxCost is respected (and the items may be rejected), but
+// they're never dropped because the buffer is full: Load waits for room in it
+// instead. Call Wait to wait for the loaded items to be applied.
+//
+// The contents of the cache aren't cleared first. If the snapshot can't be
+// read, the items read up to that point are still Set and the error is
+// returned.
+func (c *Cache) Load(r io.Reader) error {
+	if c == nil {
+		return errors.New("Cache is nil.")
+	}
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil ||
+		string(magic) != snapshotMagic {
+		return errors.New("Data isn't a snapshot.")
+	}
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("Snapshot version %d isn't supported.", version)
+	}
+	dec := gob.NewDecoder(r)
+	for {
+		var i snapshotItem
+		if err := dec.Decode(&i); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var ttl time.Duration
+		if i.Expiration != 0 {
+			if ttl = time.Until(time.Unix(0, i.Expiration)); ttl <= 0 {
+				continue
+			}
+		}
+		if i.Key == nil {
+			continue
+		}
+		if item := c.setItem(i.Key, i.Value, i.Cost, ttl); item != nil &&
+			!c.push(item) {
+			return errors.New("Cache is closed.")
+		}
+	}
+}
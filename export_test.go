@@ -0,0 +1,189 @@
+package ristretto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+func TestCacheExport(t *testing.T) {
+	newCache := func() *Cache {
+		c, err := NewCache(&Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+			StoreKeys:   true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return c
+	}
+	c := newCache()
+	c.Set(1, "a", 1)
+	c.SetWithTTL(2, []byte("b"), 2, time.Hour)
+	c.SetWithTTL(3, 3, 3, wait)
+	c.Wait()
+	c.policy.Push(make([]uint64, 10))
+	time.Sleep(wait)
+	data, err := c.Export()
+	if err != nil {
+		panic(err)
+	}
+	c.Close()
+	time.Sleep(wait)
+	c = newCache()
+	c.Set(4, 4, 1)
+	c.Wait()
+	if err := c.Import(data); err != nil {
+		panic(err)
+	}
+	if value, ok := c.Get(1); !ok || value.(string) != "a" {
+		t.Fatal("import should restore values")
+	}
+	if ttl, ok := c.GetTTL(2); !ok || ttl <= 0 {
+		t.Fatal("import should restore ttls")
+	}
+	if c.Has(3) || c.Has(4) {
+		t.Fatal("import should replace the contents and skip expired items")
+	}
+	if c.CurrentCost() != 3 || c.policy.Counters().Incrs < 10 {
+		t.Fatal("import should restore costs and counters")
+	}
+	// the format is versioned
+	data[len(exportMagic)+1]++
+	if err := c.Import(data); err == nil {
+		t.Fatal("import should fail with a different version")
+	}
+	if err := c.Import([]byte("garbage")); err == nil {
+		t.Fatal("import should fail with invalid data")
+	}
+	if !c.Has(1) {
+		t.Fatal("failed import shouldn't change the cache")
+	}
+	c.Close()
+	c = nil
+	if _, err := c.Export(); err == nil {
+		t.Fatal("export should fail with nil cache")
+	}
+}
+
+func TestCacheExportRehash(t *testing.T) {
+	newCache := func(keyToHash func(interface{}, uint8) uint64) *Cache {
+		c, err := NewCache(&Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+			StoreKeys:   true,
+			Hashes:      2,
+			KeyToHash:   keyToHash,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return c
+	}
+	c := newCache(nil)
+	c.Set("a", 1, 1)
+	c.Set([]byte("b"), 2, 1)
+	c.Wait()
+	c.policy.Push(make([]uint64, 10))
+	time.Sleep(wait)
+	data, err := c.Export()
+	if err != nil {
+		panic(err)
+	}
+	c.Close()
+	// like the default KeyToHash after a restart, with a different seed
+	c = newCache(func(key interface{}, seed uint8) uint64 {
+		return z.KeyToHash(key, seed) ^ 0xdead
+	})
+	if err := c.Import(data); err != nil {
+		panic(err)
+	}
+	if value, ok := c.Get("a"); !ok || value.(int) != 1 {
+		t.Fatal("import should hash keys again")
+	}
+	if value, ok := c.Get([]byte("b")); !ok || value.(int) != 2 {
+		t.Fatal("import should hash keys again")
+	}
+	if c.policy.Counters().Incrs >= 10 {
+		t.Fatal("import shouldn't restore counters for keys hashed differently")
+	}
+	c, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if _, err := c.Export(); err == nil {
+		t.Fatal("export should require stored keys")
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	newCache := func(maxCost int64) *Cache {
+		c, err := NewCache(&Config{
+			NumCounters: 100,
+			MaxCost:     maxCost,
+			BufferItems: 64,
+			StoreKeys:   true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return c
+	}
+	c := newCache(10)
+	c.Set(1, "a", 1)
+	c.SetWithTTL("b", []byte("b"), 2, time.Hour)
+	c.SetWithTTL(3, 3, 3, wait)
+	c.Wait()
+	time.Sleep(wait * 2)
+	var buf bytes.Buffer
+	if err := c.Snapshot(&buf); err != nil {
+		panic(err)
+	}
+	data := buf.Bytes()
+	c = newCache(10)
+	if err := c.Load(bytes.NewReader(data)); err != nil {
+		panic(err)
+	}
+	c.Wait()
+	if value, ok := c.Get(1); !ok || value.(string) != "a" {
+		t.Fatal("load should set the snapshotted values")
+	}
+	if ttl, ok := c.GetTTL("b"); !ok || ttl <= 0 || ttl > time.Hour {
+		t.Fatal("load should keep ttls")
+	}
+	if c.Has(3) || c.CurrentCost() != 3 {
+		t.Fatal("load should skip expired items and keep costs")
+	}
+	// loaded items go through admission, so they can't exceed MaxCost
+	c = newCache(2)
+	if err := c.Load(bytes.NewReader(data)); err != nil {
+		panic(err)
+	}
+	c.Wait()
+	if c.CurrentCost() > 2 {
+		t.Fatal("load should respect MaxCost")
+	}
+	if err := c.Load(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Fatal("load should fail with invalid data")
+	}
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if err := c.Snapshot(&buf); err == nil {
+		t.Fatal("snapshot should require StoreKeys")
+	}
+}
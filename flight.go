@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"context"
+	"sync"
+)
+
+// call is an in-flight (or completed) loader call of a flightGroup.
+type call struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+	// panicked is true if fn panicked, with the value passed to panic in
+	// value, so that the panic is passed on to every caller waiting for it
+	panicked bool
+}
+
+// result returns the results of the call, panicking again if fn panicked.
+func (c *call) result() (interface{}, error) {
+	if c.panicked {
+		panic(c.value)
+	}
+	return c.value, c.err
+}
+
+// flightGroup makes sure only one loader runs at a time for any given key
+// hash, so concurrent misses (or refreshes) of the same key don't all hit the
+// backing store.
+type flightGroup struct {
+	sync.Mutex
+	calls map[uint64]*call
+	// slots, if not nil, bounds how many calls run at once across all keys
+	slots chan struct{}
+}
+
+// limit makes at most n calls run at once, across all keys. The rest wait for
+// a slot in the order they're made (roughly).
+func (g *flightGroup) limit(n int) {
+	g.slots = make(chan struct{}, n)
+}
+
+// Do runs fn for the key hash, unless there's already a call in flight for it,
+// in which case it waits for that call and returns its results instead. If the
+// context is done while waiting for a slot to run fn, the call fails with the
+// context's error. If fn panics, the panic is passed on to the caller running
+// it and to every caller waiting for it.
+func (g *flightGroup) Do(ctx context.Context, keyHash uint64,
+	fn func() (interface{}, error)) (interface{}, error) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[uint64]*call)
+	}
+	if c, ok := g.calls[keyHash]; ok {
+		g.Unlock()
+		c.wg.Wait()
+		return c.result()
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[keyHash] = c
+	g.Unlock()
+	g.run(ctx, keyHash, c, fn)
+	return c.result()
+}
+
+// Start runs fn for the key hash in a new goroutine, unless there's already a
+// call in flight for it. It returns false if fn wasn't started. As with any
+// goroutine, a panic in fn crashes the program, once the callers waiting for
+// it with Do have been released.
+func (g *flightGroup) Start(keyHash uint64, fn func() (interface{}, error)) bool {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[uint64]*call)
+	}
+	if _, ok := g.calls[keyHash]; ok {
+		g.Unlock()
+		return false
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[keyHash] = c
+	g.Unlock()
+	go func() {
+		g.run(context.Background(), keyHash, c, fn)
+		c.result()
+	}()
+	return true
+}
+
+// run calls fn for the call once there's a slot for it, and then releases the
+// slot and the callers waiting for it, even if fn panics.
+func (g *flightGroup) run(ctx context.Context, keyHash uint64, c *call,
+	fn func() (interface{}, error)) {
+	defer func() {
+		c.wg.Done()
+		g.Lock()
+		delete(g.calls, keyHash)
+		g.Unlock()
+	}()
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+			defer func() { <-g.slots }()
+		case <-ctx.Done():
+			c.err = ctx.Err()
+			return
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			c.value, c.err, c.panicked = r, nil, true
+		}
+	}()
+	c.value, c.err = fn()
+}
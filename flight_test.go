@@ -0,0 +1,100 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := &flightGroup{}
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 1, nil
+	}
+	if !g.Start(1, fn) {
+		t.Fatal("start should run fn when nothing is in flight")
+	}
+	if g.Start(1, fn) {
+		t.Fatal("start shouldn't run fn while a call is in flight")
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := g.Do(context.Background(), 1, fn); err != nil || value.(int) != 1 {
+				t.Error("do returned wrong result")
+			}
+		}()
+	}
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatal("fn should only run once per flight")
+	}
+	loadErr := errors.New("load failed")
+	if _, err := g.Do(context.Background(), 1, func() (interface{}, error) {
+		return nil, loadErr
+	}); err != loadErr {
+		t.Fatal("do should return fn's error")
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := &flightGroup{}
+	g.limit(1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	panics := make(chan interface{}, 2)
+	do := func(fn func() (interface{}, error)) {
+		defer func() {
+			panics <- recover()
+		}()
+		g.Do(context.Background(), 1, fn)
+	}
+	go do(func() (interface{}, error) {
+		close(started)
+		<-release
+		panic("fn panicked")
+	})
+	<-started
+	go do(func() (interface{}, error) {
+		return 1, nil
+	})
+	time.Sleep(wait)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if r := <-panics; r != "fn panicked" {
+			t.Fatal("do should pass on fn's panic to every caller")
+		}
+	}
+	if value, err := g.Do(context.Background(), 1, func() (interface{}, error) {
+		return 1, nil
+	}); err != nil || value.(int) != 1 {
+		t.Fatal("do should run fn again after a panic")
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/dgraph-io/ristretto
 
-go 1.12
+go 1.18
 
 require github.com/dgryski/go-farm v0.0.0-20190423205320-6a90982ecee2
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"container/list"
+)
+
+// LRUPolicy is a Policy that admits every key and evicts the least recently
+// used ones. It can do better than the default policy on workloads where
+// TinyLFU admission hurts, such as scans with little reuse.
+type LRUPolicy struct {
+	// keys holds an element for every key, with the most recently used at
+	// the front.
+	keys    *list.List
+	entries map[uint64]*list.Element
+	maxCost int64
+	used    int64
+}
+
+// NewLRUPolicy returns a new LRUPolicy, to be passed in Config.Policy.
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{
+		keys:    list.New(),
+		entries: make(map[uint64]*list.Element),
+	}
+}
+
+// Push moves the keys to the front.
+func (p *LRUPolicy) Push(keys []uint64) {
+	for _, key := range keys {
+		if e, ok := p.entries[key]; ok {
+			p.keys.MoveToFront(e)
+		}
+	}
+}
+
+// Add evicts the least recently used keys until there's room for the key, and
+// adds it at the front.
+func (p *LRUPolicy) Add(key uint64, cost int64) ([]Victim, bool) {
+	victims := p.evict(p.maxCost - cost)
+	p.entries[key] = p.keys.PushFront(&Victim{Key: key, Cost: cost})
+	p.used += cost
+	return victims, true
+}
+
+// evict evicts the least recently used keys until the total cost is at most
+// target.
+func (p *LRUPolicy) evict(target int64) []Victim {
+	var victims []Victim
+	for p.used > target && p.keys.Len() > 0 {
+		victim := p.keys.Remove(p.keys.Back()).(*Victim)
+		delete(p.entries, victim.Key)
+		p.used -= victim.Cost
+		victims = append(victims, *victim)
+	}
+	return victims
+}
+
+// Has returns true if the key is in the policy.
+func (p *LRUPolicy) Has(key uint64) bool {
+	_, ok := p.entries[key]
+	return ok
+}
+
+// Del deletes the key.
+func (p *LRUPolicy) Del(key uint64) {
+	if e, ok := p.entries[key]; ok {
+		p.used -= p.keys.Remove(e).(*Victim).Cost
+		delete(p.entries, key)
+	}
+}
+
+// Update changes the cost of the key.
+func (p *LRUPolicy) Update(key uint64, cost int64) {
+	if e, ok := p.entries[key]; ok {
+		entry := e.Value.(*Victim)
+		p.used += cost - entry.Cost
+		entry.Cost = cost
+	}
+}
+
+// Cost returns the cost of the key, or -1 if it's missing.
+func (p *LRUPolicy) Cost(key uint64) int64 {
+	if e, ok := p.entries[key]; ok {
+		return e.Value.(*Victim).Cost
+	}
+	return -1
+}
+
+// SetMaxCost sets the max cost, evicting the least recently used keys until
+// the total cost fits.
+func (p *LRUPolicy) SetMaxCost(maxCost int64) []Victim {
+	p.maxCost = maxCost
+	return p.evict(maxCost)
+}
+
+// Clear deletes all keys.
+func (p *LRUPolicy) Clear() {
+	p.keys.Init()
+	p.entries = make(map[uint64]*list.Element)
+	p.used = 0
+}
+
+// CollectMetrics does nothing, since LRUPolicy doesn't adapt to metrics.
+func (p *LRUPolicy) CollectMetrics(*Metrics) {}
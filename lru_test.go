@@ -0,0 +1,104 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUPolicy(t *testing.T) {
+	p := NewLRUPolicy()
+	p.SetMaxCost(3)
+	for key := uint64(1); key <= 3; key++ {
+		if victims, added := p.Add(key, 1); !added || len(victims) != 0 {
+			t.Fatal("lru should add keys while there's room")
+		}
+	}
+	p.Push([]uint64{1})
+	victims, added := p.Add(4, 2)
+	if !added || len(victims) != 2 || victims[0].Key != 2 || victims[1].Key != 3 {
+		t.Fatal("lru should evict the least recently used keys")
+	}
+	if !p.Has(1) || p.Has(2) || p.Cost(4) != 2 {
+		t.Fatal("lru should keep the recently used and added keys")
+	}
+	p.Update(4, 1)
+	p.Del(1)
+	if p.Cost(4) != 1 || p.Has(1) || p.used != 1 {
+		t.Fatal("lru should track updates and deletions")
+	}
+	if victims := p.SetMaxCost(0); len(victims) != 1 || victims[0].Key != 4 {
+		t.Fatal("lru should evict when the max cost shrinks")
+	}
+	p.SetMaxCost(3)
+	p.Add(1, 1)
+	p.Clear()
+	if p.Has(1) || p.used != 0 {
+		t.Fatal("lru clear should delete all keys")
+	}
+}
+
+func TestCacheLRUPolicy(t *testing.T) {
+	c, err := NewCache(&Config{
+		MaxCost:     3,
+		BufferItems: 64,
+		Metrics:     true,
+		Policy:      NewLRUPolicy(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 1; i <= 3; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	// with no Gets, TinyLFU admission could reject new keys but LRU can't
+	for i := 4; i <= 6; i++ {
+		c.Set(i, i, 1)
+		c.Wait()
+		if _, ok := c.Get(i); !ok {
+			t.Fatal("lru policy should admit every key")
+		}
+		if _, ok := c.Get(i - 3); ok {
+			t.Fatal("lru policy should evict the least recently used key")
+		}
+	}
+	if c.CurrentCost() != 3 || c.policy.Len() != 3 || c.Metrics.KeysEvicted() != 3 {
+		t.Fatal("custom policy costs should be tracked")
+	}
+	c.UpdateMaxCost(1)
+	if c.CurrentCost() != 1 || c.Len() != 1 {
+		t.Fatal("custom policy should evict when the max cost shrinks")
+	}
+	c.SetWithTTL(7, 7, 1, wait)
+	time.Sleep(wait * 2)
+	// stand in for the sweeper goroutine
+	c.sweep <- struct{}{}
+	time.Sleep(wait)
+	if c.policy.Len() != 0 || c.Len() != 0 {
+		t.Fatal("custom policy should expire keys")
+	}
+	if _, err := c.Export(); err == nil {
+		t.Fatal("export should fail with a custom policy")
+	}
+	c.Set(8, 8, 2)
+	c.Wait()
+	if c.Metrics.SetsRejectedOversize() != 1 {
+		t.Fatal("custom policy should count items over the max cost")
+	}
+}
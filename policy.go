@@ -18,7 +18,9 @@ package ristretto
 
 import (
 	"math"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/ristretto/z"
 )
@@ -27,18 +29,24 @@ const (
 	// lfuSample is the number of items to sample when looking at eviction
 	// candidates. 5 seems to be the most optimal number [citation needed].
 	lfuSample = 5
+	// expirationBucket is the span of expiration times grouped together by
+	// expirationMap.
+	expirationBucket = int64(time.Second)
 )
 
-// policy is the interface encapsulating eviction/admission behavior.
-//
-// TODO: remove this interface and just rename defaultPolicy to policy, as we
-//       are probably only going to use/implement/maintain one policy.
+// policy is the interface encapsulating eviction/admission behavior. It's
+// implemented by defaultPolicy, and by customPolicy for the Policy passed in
+// Config.Policy.
 type policy interface {
 	ringConsumer
 	// Add attempts to Add the key-cost pair to the Policy. It returns a slice
 	// of evicted keys and a bool denoting whether or not the key-cost pair
 	// was added. If it returns true, the key should be stored in cache.
 	Add(uint64, int64) ([]*item, bool)
+	// Warm adds the key-cost pair like Add, but bypasses admission: victims
+	// are evicted regardless of their hits. The key's frequency is seeded so
+	// it doesn't start out as the least valuable.
+	Warm(uint64, int64) ([]*item, bool)
 	// Has returns true if the key exists in the Policy.
 	Has(uint64) bool
 	// Del deletes the key from the Policy.
@@ -47,18 +55,70 @@ type policy interface {
 	Cap() int64
 	// Close stops all goroutines and closes all channels.
 	Close()
+	// Trim evicts keys until the total cost is at most the target cost and
+	// returns the evicted keys.
+	Trim(int64) []*item
 	// Update updates the cost value for the key.
 	Update(uint64, int64)
+	// SetExpiration sets the UnixNano time the key expires at, or 0 if it
+	// never does. Expired keys are evicted ahead of all others.
+	SetExpiration(uint64, int64)
+	// Expired deletes the keys that expired by the given UnixNano time and
+	// returns them.
+	Expired(int64) []*item
 	// Cost returns the cost value of a key or -1 if missing.
 	Cost(uint64) int64
+	// Len returns the number of keys in the Policy.
+	Len() int
+	// Used returns the total cost of all keys in the Policy.
+	Used() int64
+	// MaxCost returns the max cost of the Policy.
+	MaxCost() int64
+	// UpdateMaxCost changes the max cost of the Policy. Keys aren't evicted if
+	// the cost goes over it, which is left to Trim.
+	UpdateMaxCost(int64)
+	// Saturation returns the fraction of frequency counters at max value.
+	Saturation() float64
+	// NextReset returns the number of counter increments left until the
+	// frequency counters are halved.
+	NextReset() int64
+	// Estimate returns the estimated access frequency of the key.
+	Estimate(uint64) int64
+	// Fingerprint returns an order-independent hash of all key-cost pairs.
+	Fingerprint() uint64
+	// Overhead returns an estimate of the memory used by the Policy in bytes.
+	Overhead() int64
+	// Candidates returns up to n keys in the order they'd most likely be
+	// evicted in, without evicting them.
+	Candidates(int) []candidate
+	// Counters returns a copy of the frequency counters.
+	Counters() *policyCounters
+	// SetCounters replaces the frequency counters with a copy returned by
+	// Counters for a policy with the same number of counters.
+	SetCounters(*policyCounters)
 	// Optionally, set stats object to track how policy is performing.
 	CollectMetrics(*Metrics)
+	// Optionally, set how long new keys are skipped when picking victims.
+	SetGracePeriod(time.Duration)
+	// Optionally, set the fraction of the max cost to free up whenever keys
+	// have to be evicted.
+	SetBatchRatio(float64)
+	// Optionally, set how to choose between victims with the same hits.
+	SetTieBreaker(TieBreaker)
+	// Optionally, set the number of keys that are never evicted, even if the
+	// cost goes over the max cost.
+	SetMinRetained(int)
+	// Optionally, set the max number of keys, in addition to the max cost.
+	SetMaxItems(int64)
 	// Clear zeroes out all counters and clears hashmaps.
 	Clear()
 }
 
-func newPolicy(numCounters, maxCost int64) policy {
-	return newDefaultPolicy(numCounters, maxCost)
+func newPolicy(config *Config) policy {
+	if config.Policy != nil {
+		return newCustomPolicy(config.Policy, config.MaxCost)
+	}
+	return newDefaultPolicy(config.NumCounters, config.MaxCost)
 }
 
 type defaultPolicy struct {
@@ -86,6 +146,57 @@ func (p *defaultPolicy) CollectMetrics(metrics *Metrics) {
 	p.evict.metrics = metrics
 }
 
+func (p *defaultPolicy) SetMinRetained(n int) {
+	p.Lock()
+	p.evict.minRetained = n
+	p.Unlock()
+}
+
+func (p *defaultPolicy) SetMaxItems(n int64) {
+	p.Lock()
+	p.evict.maxItems = n
+	p.Unlock()
+}
+
+func (p *defaultPolicy) SetTieBreaker(tieBreaker TieBreaker) {
+	p.Lock()
+	p.evict.tieBreaker = tieBreaker
+	if tieBreaker == TieBreakOldest && p.evict.addedAt == nil {
+		p.evict.addedAt = make(map[uint64]int64)
+	}
+	p.Unlock()
+}
+
+func (p *defaultPolicy) SetBatchRatio(ratio float64) {
+	p.Lock()
+	p.evict.batchRatio = ratio
+	p.Unlock()
+}
+
+func (p *defaultPolicy) SetGracePeriod(grace time.Duration) {
+	p.Lock()
+	p.evict.gracePeriod = int64(grace)
+	if grace > 0 && p.evict.addedAt == nil {
+		p.evict.addedAt = make(map[uint64]int64)
+	}
+	p.Unlock()
+}
+
+// TieBreaker chooses which of the sampled eviction victims with the same
+// (lowest) estimated hits is evicted.
+type TieBreaker int
+
+const (
+	// TieBreakRandom evicts any of them, depending on the random sampling.
+	TieBreakRandom TieBreaker = iota
+	// TieBreakOldest evicts the one that was added the longest ago. This
+	// requires keeping the time every key was added.
+	TieBreakOldest
+	// TieBreakLargestCost evicts the one with the largest cost, which frees up
+	// the most room.
+	TieBreakLargestCost
+)
+
 type policyPair struct {
 	key  uint64
 	cost int64
@@ -123,6 +234,7 @@ func (p *defaultPolicy) Add(key uint64, cost int64) ([]*item, bool) {
 	defer p.Unlock()
 	// can't add an item bigger than entire cache
 	if cost > p.evict.maxCost {
+		p.metrics.add(rejectOversize, key, 1)
 		return nil, false
 	}
 	// we don't need to go any further if the item is already in the cache
@@ -149,39 +261,144 @@ func (p *defaultPolicy) Add(key uint64, cost int64) ([]*item, bool) {
 	sample := make([]*policyPair, 0, lfuSample)
 	// as items are evicted they will be appended to victims
 	victims := make([]*item, 0)
+	// batchRoom is the room to free up beyond the incoming item, so that the
+	// next Sets don't have to evict again right away
+	batchRoom := p.evict.batchRoom(cost)
 	// delete victims until there's enough space or a minKey is found that has
-	// more hits than incoming item.
-	for ; room < 0; room = p.evict.roomLeft(cost) {
+	// more hits than incoming item. If only the retained keys are left, the
+	// item is added anyway and the cost temporarily overflows.
+	for ; room < batchRoom && p.evict.evictable(); room = p.evict.roomLeft(cost) {
 		// fill up empty slots in sample
 		sample = p.evict.fillSample(sample)
 		// find minimally used item in sample
-		minKey, minHits, minId, minCost := uint64(0), int64(math.MaxInt64), 0, int64(0)
-		for i, pair := range sample {
-			// look up hit count for sample key
-			if hits := p.admit.Estimate(pair.key); hits < minHits {
-				minKey, minHits, minId, minCost = pair.key, hits, i, pair.cost
-			}
-		}
+		minId, minHits := p.sampleMin(sample)
 		// if the incoming item isn't worth keeping in the policy, reject.
 		if incHits < minHits {
+			if room >= 0 {
+				// there's already room for the incoming item, so just stop
+				// freeing up more
+				break
+			}
 			p.metrics.add(rejectSets, key, 1)
 			return victims, false
 		}
-		// delete the victim from metadata
-		p.evict.del(minKey)
-		// delete the victim from sample
-		sample[minId] = sample[len(sample)-1]
-		sample = sample[:len(sample)-1]
-		// store victim in evicted victims slice
-		victims = append(victims, &item{
-			keyHash: minKey,
-			cost:    minCost,
-		})
+		victims, sample = p.evictSample(victims, sample, minId)
 	}
 	p.evict.add(key, cost)
 	return victims, true
 }
 
+func (p *defaultPolicy) Warm(key uint64, cost int64) ([]*item, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if cost > p.evict.maxCost {
+		return nil, false
+	}
+	p.admit.Increment(key)
+	if has := p.evict.updateIfHas(key, cost); has {
+		return nil, true
+	}
+	sample := make([]*policyPair, 0, lfuSample)
+	victims := make([]*item, 0)
+	for p.evict.roomLeft(cost) < 0 && p.evict.evictable() {
+		sample = p.evict.fillSample(sample)
+		minId, _ := p.sampleMin(sample)
+		victims, sample = p.evictSample(victims, sample, minId)
+	}
+	p.evict.add(key, cost)
+	return victims, true
+}
+
+// sampleMin returns the index of the sampled key with the fewest hits, along
+// with its hit count. An expired key is returned right away, with a hit count
+// of -1 so it's always evicted. Keys still within the grace period are skipped,
+// unless the whole sample is, in which case the oldest key is returned.
+func (p *defaultPolicy) sampleMin(sample []*policyPair) (int, int64) {
+	if p.evict.expirations.len() > 0 {
+		now := time.Now().UnixNano()
+		for i, pair := range sample {
+			if p.evict.expired(pair.key, now) {
+				return i, -1
+			}
+		}
+	}
+	minId, minHits := -1, int64(math.MaxInt64)
+	oldestId, oldest := 0, int64(math.MaxInt64)
+	var now int64
+	if p.evict.gracePeriod > 0 {
+		now = z.NanoTime()
+	}
+	for i, pair := range sample {
+		if p.evict.gracePeriod > 0 {
+			if added := p.evict.addedAt[pair.key]; now-added < p.evict.gracePeriod {
+				if added < oldest {
+					oldestId, oldest = i, added
+				}
+				continue
+			}
+		}
+		// look up hit count for sample key
+		hits := p.admit.Estimate(pair.key)
+		if hits < minHits || (hits == minHits && p.breaksTie(pair, sample[minId])) {
+			minId, minHits = i, hits
+		}
+	}
+	if minId == -1 {
+		return oldestId, p.admit.Estimate(sample[oldestId].key)
+	}
+	return minId, minHits
+}
+
+// breaksTie returns true if pair should be evicted rather than min, which has
+// the same hit count, according to the tie breaker.
+func (p *defaultPolicy) breaksTie(pair, min *policyPair) bool {
+	switch p.evict.tieBreaker {
+	case TieBreakOldest:
+		return p.evict.addedAt[pair.key] < p.evict.addedAt[min.key]
+	case TieBreakLargestCost:
+		return pair.cost > min.cost
+	default:
+		return false
+	}
+}
+
+// evictSample deletes the sampled key at index i from the policy and the
+// sample, and appends it to victims.
+func (p *defaultPolicy) evictSample(victims []*item, sample []*policyPair,
+	i int) ([]*item, []*policyPair) {
+	pair := sample[i]
+	// delete the victim from sample
+	sample[i] = sample[len(sample)-1]
+	sample = sample[:len(sample)-1]
+	// the sample can hold the same key more than once, so it may already be
+	// gone from metadata
+	if _, ok := p.evict.keyCosts[pair.key]; !ok {
+		return victims, sample
+	}
+	victim := &item{
+		keyHash:    pair.key,
+		cost:       pair.cost,
+		expiration: p.evict.expirations.get(pair.key),
+	}
+	// delete the victim from metadata
+	p.evict.del(pair.key)
+	// store victim in evicted victims slice
+	return append(victims, victim), sample
+}
+
+func (p *defaultPolicy) Trim(target int64) []*item {
+	p.Lock()
+	defer p.Unlock()
+	sample := make([]*policyPair, 0, lfuSample)
+	victims := make([]*item, 0)
+	for p.evict.used > target && p.evict.evictable() {
+		sample = p.evict.fillSample(sample)
+		minId, _ := p.sampleMin(sample)
+		victims, sample = p.evictSample(victims, sample, minId)
+	}
+	return victims
+}
+
 func (p *defaultPolicy) Has(key uint64) bool {
 	p.Lock()
 	_, exists := p.evict.keyCosts[key]
@@ -202,12 +419,49 @@ func (p *defaultPolicy) Cap() int64 {
 	return capacity
 }
 
+func (p *defaultPolicy) MaxCost() int64 {
+	p.Lock()
+	maxCost := p.evict.maxCost
+	p.Unlock()
+	return maxCost
+}
+
+func (p *defaultPolicy) UpdateMaxCost(maxCost int64) {
+	p.Lock()
+	p.evict.maxCost = maxCost
+	p.Unlock()
+}
+
 func (p *defaultPolicy) Update(key uint64, cost int64) {
 	p.Lock()
 	p.evict.updateIfHas(key, cost)
 	p.Unlock()
 }
 
+func (p *defaultPolicy) SetExpiration(key uint64, expiration int64) {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.evict.keyCosts[key]; !ok {
+		return
+	}
+	p.evict.expirations.set(key, expiration)
+}
+
+func (p *defaultPolicy) Expired(now int64) []*item {
+	p.Lock()
+	defer p.Unlock()
+	var victims []*item
+	p.evict.expirations.cleanup(now, func(key uint64, expiration int64) {
+		victims = append(victims, &item{
+			keyHash:    key,
+			cost:       p.evict.keyCosts[key],
+			expiration: expiration,
+		})
+		p.evict.del(key)
+	})
+	return victims
+}
+
 func (p *defaultPolicy) Cost(key uint64) int64 {
 	p.Lock()
 	if cost, found := p.evict.keyCosts[key]; found {
@@ -218,6 +472,142 @@ func (p *defaultPolicy) Cost(key uint64) int64 {
 	return -1
 }
 
+func (p *defaultPolicy) Len() int {
+	p.Lock()
+	n := len(p.evict.keyCosts)
+	p.Unlock()
+	return n
+}
+
+func (p *defaultPolicy) Used() int64 {
+	p.Lock()
+	used := p.evict.used
+	p.Unlock()
+	return used
+}
+
+func (p *defaultPolicy) Saturation() float64 {
+	p.Lock()
+	saturation := p.admit.freq.Saturation()
+	p.Unlock()
+	return saturation
+}
+
+func (p *defaultPolicy) Estimate(key uint64) int64 {
+	p.Lock()
+	hits := p.admit.Estimate(key)
+	p.Unlock()
+	return hits
+}
+
+func (p *defaultPolicy) NextReset() int64 {
+	p.Lock()
+	left := p.admit.resetAt - p.admit.incrs
+	p.Unlock()
+	return left
+}
+
+// candidate is a key returned by Candidates, along with its cost and hits.
+type candidate struct {
+	key  uint64
+	cost int64
+	hits int64
+}
+
+// Candidates sorts every key by its estimated hits, so it's O(n log n) in the
+// number of keys. Victims are picked from random samples, so this is only the
+// order they're most likely evicted in.
+func (p *defaultPolicy) Candidates(n int) []candidate {
+	p.Lock()
+	defer p.Unlock()
+	if n <= 0 {
+		return nil
+	}
+	all := make([]candidate, 0, len(p.evict.keyCosts))
+	for key, cost := range p.evict.keyCosts {
+		all = append(all, candidate{key, cost, p.admit.Estimate(key)})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].hits != all[j].hits {
+			return all[i].hits < all[j].hits
+		}
+		return all[i].key < all[j].key
+	})
+	if n < len(all) {
+		all = all[:n]
+	}
+	return all
+}
+
+// policyKeyOverhead is a rough estimate of the bytes used per key by the maps
+// of sampledLFU, including the overhead of the map buckets.
+const policyKeyOverhead = 40
+
+func (p *defaultPolicy) Overhead() int64 {
+	p.Lock()
+	keys := len(p.evict.keyCosts) + p.evict.expirations.len() +
+		len(p.evict.addedAt)
+	overhead := int64(p.admit.freq.Bytes()) + int64(p.admit.door.Bytes()) +
+		int64(keys)*policyKeyOverhead
+	p.Unlock()
+	return overhead
+}
+
+func (p *defaultPolicy) Fingerprint() uint64 {
+	p.Lock()
+	defer p.Unlock()
+	var fp uint64
+	for key, cost := range p.evict.keyCosts {
+		// XOR keeps the fingerprint independent of map iteration order
+		fp ^= mix64(key ^ mix64(uint64(cost)))
+	}
+	return fp
+}
+
+// mix64 is the splitmix64 finalizer. Unlike z.MemHash, it isn't seeded per
+// process, so fingerprints can be compared across processes.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// policyCounters is a copy of the TinyLFU frequency counters, for Export. The
+// doorkeeper isn't included, as it's cleared often anyway.
+type policyCounters struct {
+	Rows  [][]byte
+	Seeds []uint64
+	Incrs int64
+}
+
+func (p *defaultPolicy) Counters() *policyCounters {
+	p.Lock()
+	defer p.Unlock()
+	counters := &policyCounters{
+		Rows:  make([][]byte, cmDepth),
+		Seeds: make([]uint64, cmDepth),
+		Incrs: p.admit.incrs,
+	}
+	for i, row := range p.admit.freq.rows {
+		counters.Rows[i] = append([]byte(nil), row...)
+		counters.Seeds[i] = p.admit.freq.seed[i]
+	}
+	return counters
+}
+
+func (p *defaultPolicy) SetCounters(counters *policyCounters) {
+	p.Lock()
+	defer p.Unlock()
+	for i := range p.admit.freq.rows {
+		copy(p.admit.freq.rows[i], counters.Rows[i])
+		p.admit.freq.seed[i] = counters.Seeds[i]
+	}
+	p.admit.incrs = counters.Incrs
+}
+
 func (p *defaultPolicy) Clear() {
 	p.Lock()
 	p.admit.clear()
@@ -229,7 +619,54 @@ func (p *defaultPolicy) Close() {
 	// block until p.processItems goroutine is returned
 	p.stop <- struct{}{}
 	close(p.stop)
-	close(p.itemsCh)
+	// itemsCh isn't closed, since Gets racing with Close may still push to it
+}
+
+// policyState is a snapshot of the internal state of defaultPolicy, so tests
+// can make exact assertions about admission and eviction behavior.
+type policyState struct {
+	// used and maxCost are the current and maximum total cost.
+	used    int64
+	maxCost int64
+	// incrs is the number of counter increments since the last reset, which
+	// happens once resetAt is reached.
+	incrs   int64
+	resetAt int64
+	// costs maps every key to its cost.
+	costs map[uint64]int64
+	// hits maps every key to its estimated hit count.
+	hits map[uint64]int64
+	// candidates holds every key ordered by hits, lowest first, which is the
+	// order an exact LFU would evict them in.
+	candidates []uint64
+}
+
+// state returns a snapshot of the policy's internal state.
+func (p *defaultPolicy) state() *policyState {
+	p.Lock()
+	defer p.Unlock()
+	s := &policyState{
+		used:       p.evict.used,
+		maxCost:    p.evict.maxCost,
+		incrs:      p.admit.incrs,
+		resetAt:    p.admit.resetAt,
+		costs:      make(map[uint64]int64, len(p.evict.keyCosts)),
+		hits:       make(map[uint64]int64, len(p.evict.keyCosts)),
+		candidates: make([]uint64, 0, len(p.evict.keyCosts)),
+	}
+	for key, cost := range p.evict.keyCosts {
+		s.costs[key] = cost
+		s.hits[key] = p.admit.Estimate(key)
+		s.candidates = append(s.candidates, key)
+	}
+	sort.Slice(s.candidates, func(i, j int) bool {
+		a, b := s.candidates[i], s.candidates[j]
+		if s.hits[a] != s.hits[b] {
+			return s.hits[a] < s.hits[b]
+		}
+		return a < b
+	})
+	return s
 }
 
 // sampledLFU is an eviction helper storing key-cost pairs.
@@ -238,6 +675,21 @@ type sampledLFU struct {
 	maxCost  int64
 	used     int64
 	metrics  *Metrics
+	// batchRatio is the fraction of maxCost to keep free after evicting.
+	batchRatio float64
+	// tieBreaker chooses between sampled victims with the same hits.
+	tieBreaker TieBreaker
+	// minRetained is the number of keys eviction stops at.
+	minRetained int
+	// maxItems, if not zero, is the max number of keys.
+	maxItems int64
+	// gracePeriod is how long (in nanoseconds) new keys are skipped when
+	// sampling victims. addedAt holds the time each key was added, and is
+	// only kept when gracePeriod is set or tieBreaker is TieBreakOldest.
+	gracePeriod int64
+	addedAt     map[uint64]int64
+	// expirations holds the UnixNano time keys with a TTL expire at.
+	expirations expirationMap
 }
 
 func newSampledLFU(maxCost int64) *sampledLFU {
@@ -248,7 +700,28 @@ func newSampledLFU(maxCost int64) *sampledLFU {
 }
 
 func (p *sampledLFU) roomLeft(cost int64) int64 {
-	return p.maxCost - (p.used + cost)
+	room := p.maxCost - (p.used + cost)
+	if room >= 0 && p.maxItems > 0 && int64(len(p.keyCosts)) >= p.maxItems {
+		// there's no room for another key, whatever its cost
+		return -1
+	}
+	return room
+}
+
+// evictable returns true if there are more keys than the ones retained.
+func (p *sampledLFU) evictable() bool {
+	return len(p.keyCosts) > p.minRetained
+}
+
+// batchRoom returns the room to free up beyond an incoming item of the given
+// cost. A large item leaves no room for the batch unless the whole cache is
+// emptied, so then only its own room is freed up.
+func (p *sampledLFU) batchRoom(cost int64) int64 {
+	room := int64(p.batchRatio * float64(p.maxCost))
+	if room >= p.maxCost-cost {
+		return 0
+	}
+	return room
 }
 
 func (p *sampledLFU) fillSample(in []*policyPair) []*policyPair {
@@ -273,6 +746,15 @@ func (p *sampledLFU) del(key uint64) {
 	p.metrics.add(costEvict, key, uint64(cost))
 	p.used -= cost
 	delete(p.keyCosts, key)
+	if p.addedAt != nil {
+		delete(p.addedAt, key)
+	}
+	p.expirations.del(key)
+}
+
+func (p *sampledLFU) expired(key uint64, now int64) bool {
+	expiration := p.expirations.get(key)
+	return expiration != 0 && now >= expiration
 }
 
 func (p *sampledLFU) add(key uint64, cost int64) {
@@ -280,6 +762,9 @@ func (p *sampledLFU) add(key uint64, cost int64) {
 	p.metrics.add(costAdd, key, uint64(cost))
 	p.keyCosts[key] = cost
 	p.used += cost
+	if p.addedAt != nil {
+		p.addedAt[key] = z.NanoTime()
+	}
 }
 
 func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
@@ -297,6 +782,99 @@ func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
 func (p *sampledLFU) clear() {
 	p.used = 0
 	p.keyCosts = make(map[uint64]int64)
+	if p.addedAt != nil {
+		p.addedAt = make(map[uint64]int64)
+	}
+	p.expirations = expirationMap{}
+}
+
+// expirationMap holds the expiration times of keys, also grouped into buckets
+// of expirationBucket by time, so the keys due can be found without going
+// through all of them. It's NOT thread safe, and its zero value is empty.
+type expirationMap struct {
+	at      map[uint64]int64
+	buckets map[int64]map[uint64]struct{}
+	// next is the first bucket that may hold keys, if there are any.
+	next int64
+}
+
+func (m *expirationMap) len() int {
+	return len(m.at)
+}
+
+// get returns the expiration of the key, or 0 if it doesn't have one.
+func (m *expirationMap) get(key uint64) int64 {
+	return m.at[key]
+}
+
+// set sets the expiration of the key, removing it if expiration is 0.
+func (m *expirationMap) set(key uint64, expiration int64) {
+	m.del(key)
+	if expiration == 0 {
+		return
+	}
+	if m.at == nil {
+		m.at = make(map[uint64]int64)
+		m.buckets = make(map[int64]map[uint64]struct{})
+	}
+	b := expiration / expirationBucket
+	if len(m.at) == 0 || b < m.next {
+		m.next = b
+	}
+	m.at[key] = expiration
+	bucket, ok := m.buckets[b]
+	if !ok {
+		bucket = make(map[uint64]struct{})
+		m.buckets[b] = bucket
+	}
+	bucket[key] = struct{}{}
+}
+
+func (m *expirationMap) del(key uint64) {
+	expiration, ok := m.at[key]
+	if !ok {
+		return
+	}
+	delete(m.at, key)
+	b := expiration / expirationBucket
+	delete(m.buckets[b], key)
+	if len(m.buckets[b]) == 0 {
+		delete(m.buckets, b)
+	}
+}
+
+// cleanup removes the keys expired as of now and calls fn for each, only
+// looking at the buckets that are due.
+func (m *expirationMap) cleanup(now int64,
+	fn func(key uint64, expiration int64)) {
+	if len(m.at) == 0 {
+		return
+	}
+	last := now / expirationBucket
+	expire := func(bucket map[uint64]struct{}) {
+		for key := range bucket {
+			if expiration := m.at[key]; now >= expiration {
+				m.del(key)
+				fn(key, expiration)
+			}
+		}
+	}
+	if last-m.next >= int64(len(m.buckets)) {
+		// after a long gap it's cheaper to go through the buckets instead
+		for b, bucket := range m.buckets {
+			if b <= last {
+				expire(bucket)
+			}
+		}
+	} else {
+		for b := m.next; b <= last; b++ {
+			expire(m.buckets[b])
+		}
+	}
+	// every bucket before the last is now empty
+	if last > m.next {
+		m.next = last
+	}
 }
 
 // tinyLFU is an admission helper that keeps track of access frequency using
@@ -357,3 +935,319 @@ func (p *tinyLFU) clear() {
 	p.door.Clear()
 	p.freq.Clear()
 }
+
+// Policy is the interface for custom admission and eviction policies, which
+// can replace the default (TinyLFU admission with sampled LFU eviction) with
+// Config.Policy. Keys are the key hashes, and a cost is whatever the cache is
+// configured to count. The cache serializes all calls to a Policy, so
+// implementations don't have to be safe for concurrent use.
+type Policy interface {
+	// Push records accesses to the keys by Gets, which may include keys the
+	// Policy doesn't have.
+	Push(keys []uint64)
+	// Add attempts to add a key the Policy doesn't have, returning the keys
+	// evicted to make room for it and whether it was added. Victims are
+	// deleted from the cache even if the key isn't added. Keys with a cost
+	// over the max cost are rejected without calling Add.
+	Add(key uint64, cost int64) (victims []Victim, added bool)
+	// Has returns true if the key is in the Policy.
+	Has(key uint64) bool
+	// Del deletes the key from the Policy.
+	Del(key uint64)
+	// Update changes the cost of a key the Policy has. Keys don't have to
+	// be evicted if the total cost goes over the max cost, that can be left
+	// to the next Add.
+	Update(key uint64, cost int64)
+	// Cost returns the cost of the key, or -1 if the Policy doesn't have it.
+	Cost(key uint64) int64
+	// SetMaxCost sets the max total cost of the keys in the Policy, evicting
+	// keys until their total cost is at most maxCost and returning them. It's
+	// called with Config.MaxCost before the cache is used.
+	SetMaxCost(maxCost int64) []Victim
+	// Clear deletes all keys from the Policy.
+	Clear()
+	// CollectMetrics is called with the Metrics of the cache, if
+	// Config.Metrics is set. The cache records the metrics of adds, updates
+	// and evictions itself, so it's only needed for policies that adapt to
+	// them (such as the hit ratio).
+	CollectMetrics(metrics *Metrics)
+}
+
+// Victim is a key evicted by a Policy, along with its cost.
+type Victim struct {
+	Key  uint64
+	Cost int64
+}
+
+// customPolicy adapts a Policy passed in Config.Policy to the policy interface,
+// keeping track of the total cost and expirations of its keys. The options of
+// the default policy (such as the grace period) are ignored, and so is Warm's
+// bypassing of admission.
+type customPolicy struct {
+	sync.Mutex
+	policy      Policy
+	maxCost     int64
+	used        int64
+	keys        int
+	expirations expirationMap
+	metrics     *Metrics
+}
+
+func newCustomPolicy(policy Policy, maxCost int64) *customPolicy {
+	policy.SetMaxCost(maxCost)
+	return &customPolicy{
+		policy:  policy,
+		maxCost: maxCost,
+	}
+}
+
+func (p *customPolicy) CollectMetrics(metrics *Metrics) {
+	p.Lock()
+	p.metrics = metrics
+	p.policy.CollectMetrics(metrics)
+	p.Unlock()
+}
+
+func (p *customPolicy) SetGracePeriod(time.Duration) {}
+
+func (p *customPolicy) SetBatchRatio(float64) {}
+
+func (p *customPolicy) SetTieBreaker(TieBreaker) {}
+
+func (p *customPolicy) SetMinRetained(int) {}
+
+func (p *customPolicy) SetMaxItems(int64) {}
+
+func (p *customPolicy) Push(keys []uint64) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	p.Lock()
+	p.policy.Push(keys)
+	p.Unlock()
+	p.metrics.add(keepGets, keys[0], uint64(len(keys)))
+	return true
+}
+
+func (p *customPolicy) Add(key uint64, cost int64) ([]*item, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if cost > p.maxCost {
+		p.metrics.add(rejectOversize, key, 1)
+		return nil, false
+	}
+	if p.updateIfHas(key, cost) {
+		return nil, true
+	}
+	victims, added := p.policy.Add(key, cost)
+	evicted := p.evicted(victims)
+	if !added {
+		p.metrics.add(rejectSets, key, 1)
+		return evicted, false
+	}
+	p.metrics.add(keyAdd, key, 1)
+	p.metrics.add(costAdd, key, uint64(cost))
+	p.used += cost
+	p.keys++
+	return evicted, true
+}
+
+func (p *customPolicy) Warm(key uint64, cost int64) ([]*item, bool) {
+	return p.Add(key, cost)
+}
+
+// updateIfHas updates the cost of the key if the Policy has it.
+func (p *customPolicy) updateIfHas(key uint64, cost int64) bool {
+	prev := p.policy.Cost(key)
+	if prev == -1 {
+		return false
+	}
+	p.metrics.add(keyUpdate, key, 1)
+	p.policy.Update(key, cost)
+	p.used += cost - prev
+	return true
+}
+
+// evicted accounts for the keys evicted by the Policy and returns them as
+// items for the cache to delete.
+func (p *customPolicy) evicted(victims []Victim) []*item {
+	if len(victims) == 0 {
+		return nil
+	}
+	items := make([]*item, len(victims))
+	for i, victim := range victims {
+		p.metrics.add(keyEvict, victim.Key, 1)
+		p.metrics.add(costEvict, victim.Key, uint64(victim.Cost))
+		p.used -= victim.Cost
+		p.keys--
+		items[i] = &item{
+			keyHash:    victim.Key,
+			cost:       victim.Cost,
+			expiration: p.expirations.get(victim.Key),
+		}
+		p.expirations.del(victim.Key)
+	}
+	return items
+}
+
+func (p *customPolicy) Has(key uint64) bool {
+	p.Lock()
+	has := p.policy.Has(key)
+	p.Unlock()
+	return has
+}
+
+func (p *customPolicy) Del(key uint64) {
+	p.Lock()
+	p.del(key)
+	p.Unlock()
+}
+
+func (p *customPolicy) del(key uint64) {
+	cost := p.policy.Cost(key)
+	if cost == -1 {
+		return
+	}
+	p.metrics.add(keyEvict, key, 1)
+	p.metrics.add(costEvict, key, uint64(cost))
+	p.policy.Del(key)
+	p.used -= cost
+	p.keys--
+	p.expirations.del(key)
+}
+
+func (p *customPolicy) Cap() int64 {
+	p.Lock()
+	capacity := p.maxCost - p.used
+	p.Unlock()
+	return capacity
+}
+
+func (p *customPolicy) Close() {}
+
+func (p *customPolicy) Trim(target int64) []*item {
+	p.Lock()
+	defer p.Unlock()
+	if p.used <= target {
+		return nil
+	}
+	// shrink the max cost of the Policy to make it evict, then restore it
+	victims := p.evicted(p.policy.SetMaxCost(target))
+	p.policy.SetMaxCost(p.maxCost)
+	return victims
+}
+
+func (p *customPolicy) Update(key uint64, cost int64) {
+	p.Lock()
+	p.updateIfHas(key, cost)
+	p.Unlock()
+}
+
+func (p *customPolicy) SetExpiration(key uint64, expiration int64) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.policy.Has(key) {
+		return
+	}
+	p.expirations.set(key, expiration)
+}
+
+func (p *customPolicy) Expired(now int64) []*item {
+	p.Lock()
+	defer p.Unlock()
+	var victims []*item
+	p.expirations.cleanup(now, func(key uint64, expiration int64) {
+		victims = append(victims, &item{
+			keyHash:    key,
+			cost:       p.policy.Cost(key),
+			expiration: expiration,
+		})
+		p.del(key)
+	})
+	return victims
+}
+
+func (p *customPolicy) Cost(key uint64) int64 {
+	p.Lock()
+	cost := p.policy.Cost(key)
+	p.Unlock()
+	return cost
+}
+
+func (p *customPolicy) Len() int {
+	p.Lock()
+	n := p.keys
+	p.Unlock()
+	return n
+}
+
+func (p *customPolicy) Used() int64 {
+	p.Lock()
+	used := p.used
+	p.Unlock()
+	return used
+}
+
+func (p *customPolicy) MaxCost() int64 {
+	p.Lock()
+	maxCost := p.maxCost
+	p.Unlock()
+	return maxCost
+}
+
+func (p *customPolicy) UpdateMaxCost(maxCost int64) {
+	p.Lock()
+	p.maxCost = maxCost
+	// growing the max cost doesn't evict anything, and shrinking it is left to
+	// Trim so the victims are returned
+	if maxCost >= p.used {
+		p.policy.SetMaxCost(maxCost)
+	}
+	p.Unlock()
+}
+
+// Saturation, NextReset, Estimate, Fingerprint, Candidates and Counters aren't
+// supported by custom policies, since Policy doesn't expose the frequencies or
+// keys.
+
+func (p *customPolicy) Saturation() float64 {
+	return 0
+}
+
+func (p *customPolicy) NextReset() int64 {
+	return 0
+}
+
+func (p *customPolicy) Estimate(uint64) int64 {
+	return 0
+}
+
+func (p *customPolicy) Fingerprint() uint64 {
+	return 0
+}
+
+func (p *customPolicy) Candidates(int) []candidate {
+	return nil
+}
+
+func (p *customPolicy) Counters() *policyCounters {
+	return nil
+}
+
+func (p *customPolicy) SetCounters(*policyCounters) {}
+
+func (p *customPolicy) Overhead() int64 {
+	p.Lock()
+	overhead := int64(p.keys+p.expirations.len()) * policyKeyOverhead
+	p.Unlock()
+	return overhead
+}
+
+func (p *customPolicy) Clear() {
+	p.Lock()
+	p.policy.Clear()
+	p.used = 0
+	p.keys = 0
+	p.expirations = expirationMap{}
+	p.Unlock()
+}
@@ -1,6 +1,7 @@
 package ristretto
 
 import (
+	"sort"
 	"testing"
 	"time"
 )
@@ -11,7 +12,7 @@ func TestPolicy(t *testing.T) {
 			t.Fatal("newPolicy failed")
 		}
 	}()
-	newPolicy(100, 10)
+	newPolicy(&Config{NumCounters: 100, MaxCost: 10})
 }
 
 func TestPolicyMetrics(t *testing.T) {
@@ -84,6 +85,181 @@ func TestPolicyAdd(t *testing.T) {
 	}
 }
 
+func TestPolicyTrim(t *testing.T) {
+	p := newDefaultPolicy(100, 10)
+	for i := uint64(1); i <= 5; i++ {
+		p.Add(i, 2)
+	}
+	victims := p.Trim(5)
+	if len(victims) != 3 || p.Cap() != 6 {
+		t.Fatal("trim didn't evict down to the target cost")
+	}
+	for _, victim := range victims {
+		if p.Has(victim.keyHash) {
+			t.Fatal("trim didn't delete victims")
+		}
+	}
+	if len(p.Trim(0)) != 2 || p.Len() != 0 {
+		t.Fatal("trim to 0 should evict everything")
+	}
+}
+
+func TestPolicyGracePeriod(t *testing.T) {
+	p := newDefaultPolicy(100, 2)
+	p.SetGracePeriod(time.Hour)
+	p.Add(1, 1)
+	p.Add(2, 1)
+	// key 1 was added long ago, key 2 is within the grace period
+	p.evict.addedAt[1] -= int64(2 * time.Hour)
+	for i := 0; i < 3; i++ {
+		p.admit.Increment(1)
+		p.admit.Increment(3)
+	}
+	victims, added := p.Add(3, 1)
+	if !added || len(victims) != 1 || victims[0].keyHash != 1 {
+		t.Fatal("grace period should protect the new key from eviction")
+	}
+	// every key is within the grace period, so the oldest one is evicted
+	victims, _ = p.Add(4, 1)
+	if len(victims) != 1 || victims[0].keyHash != 2 {
+		t.Fatal("oldest key should be evicted when all are within grace period")
+	}
+	p.Clear()
+	if len(p.evict.addedAt) != 0 {
+		t.Fatal("clear didn't reset added times")
+	}
+}
+
+func TestPolicyBatchRatio(t *testing.T) {
+	p := newDefaultPolicy(100, 10)
+	p.SetBatchRatio(0.5)
+	for i := uint64(1); i <= 10; i++ {
+		p.Add(i, 1)
+	}
+	victims, added := p.Add(11, 1)
+	if !added || len(victims) != 6 || p.Cap() != 5 {
+		t.Fatal("eviction should free up the batch ratio of max cost")
+	}
+	// keys with more hits than the incoming one stop the batch early
+	p = newDefaultPolicy(100, 4)
+	p.SetBatchRatio(0.5)
+	for i := uint64(1); i <= 4; i++ {
+		p.Add(i, 1)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		p.admit.Increment(i)
+		p.admit.Increment(i)
+	}
+	p.admit.Increment(5)
+	victims, added = p.Add(5, 1)
+	if !added || len(victims) != 1 || victims[0].keyHash != 4 || p.Cap() != 0 {
+		t.Fatal("eviction should only free up what's needed for hot keys")
+	}
+	// the batch can't be freed up along with a large item without emptying
+	// the cache
+	p = newDefaultPolicy(1000, 100)
+	p.SetBatchRatio(0.5)
+	for i := uint64(1); i <= 100; i++ {
+		p.Add(i, 1)
+	}
+	victims, added = p.Add(101, 60)
+	if !added || len(victims) != 60 || len(p.evict.keyCosts) != 41 {
+		t.Fatal("eviction should only free up what a large item needs")
+	}
+}
+
+func TestPolicyTieBreaker(t *testing.T) {
+	p := newDefaultPolicy(100, 4)
+	p.SetTieBreaker(TieBreakLargestCost)
+	p.Add(1, 1)
+	p.Add(2, 2)
+	p.Add(3, 1)
+	victims, _ := p.Add(4, 1)
+	if len(victims) != 1 || victims[0].keyHash != 2 {
+		t.Fatal("largest cost tie breaker should evict the largest key")
+	}
+	p = newDefaultPolicy(100, 3)
+	p.SetTieBreaker(TieBreakOldest)
+	for i := uint64(1); i <= 3; i++ {
+		p.Add(i, 1)
+	}
+	// make key 2 the oldest
+	p.evict.addedAt[2] -= int64(time.Hour)
+	victims, _ = p.Add(4, 1)
+	if len(victims) != 1 || victims[0].keyHash != 2 {
+		t.Fatal("oldest tie breaker should evict the oldest key")
+	}
+}
+
+func TestPolicyExpiration(t *testing.T) {
+	p := newDefaultPolicy(100, 2)
+	p.Add(1, 1)
+	p.Add(2, 1)
+	for i := 0; i < 3; i++ {
+		p.admit.Increment(1)
+	}
+	past := time.Now().Add(-time.Second).UnixNano()
+	p.SetExpiration(1, past)
+	victims, added := p.Add(3, 1)
+	if !added || len(victims) != 1 || victims[0].keyHash != 1 {
+		t.Fatal("expired key should be evicted ahead of live ones")
+	}
+	p.SetExpiration(2, past)
+	p.SetExpiration(3, time.Now().Add(time.Hour).UnixNano())
+	victims = p.Expired(time.Now().UnixNano())
+	if len(victims) != 1 || victims[0].keyHash != 2 || p.Has(2) || !p.Has(3) {
+		t.Fatal("expired should only delete expired keys")
+	}
+	p.SetExpiration(3, 0)
+	if p.evict.expirations.len() != 0 {
+		t.Fatal("expiration of 0 should remove the expiration")
+	}
+}
+
+func TestPolicyMinRetained(t *testing.T) {
+	p := newDefaultPolicy(100, 4)
+	p.SetMinRetained(2)
+	p.Add(1, 2)
+	p.Add(2, 2)
+	victims, added := p.Add(3, 2)
+	if !added || len(victims) != 0 || p.Cap() != -2 {
+		t.Fatal("retained keys shouldn't be evicted, overflowing the cost")
+	}
+	// only one of the 3 keys can be evicted, and the new key is added anyway
+	victims, _ = p.Add(4, 1)
+	if len(victims) != 1 || p.Len() != 3 {
+		t.Fatal("eviction should stop at the retained keys")
+	}
+	if len(p.Trim(0)) != 1 || p.Len() != 2 {
+		t.Fatal("trim shouldn't evict retained keys")
+	}
+}
+
+func TestPolicyState(t *testing.T) {
+	p := newDefaultPolicy(100, 10)
+	p.Add(1, 4)
+	p.Add(2, 3)
+	p.Add(3, 3)
+	p.admit.Increment(1)
+	p.admit.Increment(1)
+	p.admit.Increment(2)
+	p.admit.Increment(3)
+	s := p.state()
+	if s.used != 10 || s.maxCost != 10 || s.incrs != 4 || s.resetAt != 100 {
+		t.Fatal("state returned wrong costs or counters")
+	}
+	if len(s.costs) != 3 || s.costs[1] != 4 || s.hits[1] != 2 || s.hits[2] != 1 {
+		t.Fatal("state returned wrong keys")
+	}
+	if s.candidates[0] != 2 || s.candidates[1] != 3 || s.candidates[2] != 1 {
+		t.Fatal("state candidates should be ordered by hits")
+	}
+	// the new key has fewer hits than every candidate, so it's rejected
+	if _, added := p.Add(4, 1); added {
+		t.Fatal("item with fewer hits than every candidate should be rejected")
+	}
+}
+
 func TestPolicyHas(t *testing.T) {
 	p := newDefaultPolicy(100, 10)
 	p.Add(1, 1)
@@ -139,6 +315,22 @@ func TestPolicyCost(t *testing.T) {
 	}
 }
 
+func TestPolicyLen(t *testing.T) {
+	p := newDefaultPolicy(100, 10)
+	p.Add(1, 1)
+	p.Add(2, 2)
+	if p.Len() != 2 {
+		t.Fatal("len returned wrong value")
+	}
+	p.Del(1)
+	if p.Len() != 1 {
+		t.Fatal("len not reflecting deletes")
+	}
+	if p.Used() != 2 {
+		t.Fatal("used returned wrong value")
+	}
+}
+
 func TestPolicyClear(t *testing.T) {
 	p := newDefaultPolicy(100, 10)
 	p.Add(1, 1)
@@ -151,15 +343,45 @@ func TestPolicyClear(t *testing.T) {
 }
 
 func TestPolicyClose(t *testing.T) {
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatal("close didn't close channels")
-		}
-	}()
 	p := newDefaultPolicy(100, 10)
 	p.Add(1, 1)
 	p.Close()
-	p.itemsCh <- []uint64{1}
+	// pushes racing with Close shouldn't panic
+	p.Push([]uint64{1})
+	p.Lock()
+	if p.admit.Estimate(1) != 0 {
+		p.Unlock()
+		t.Fatal("close didn't stop processItems")
+	}
+	p.Unlock()
+}
+
+func TestExpirationMap(t *testing.T) {
+	var m expirationMap
+	now := time.Now().UnixNano()
+	m.set(1, now-expirationBucket)
+	m.set(2, now+expirationBucket)
+	m.set(3, now+2*expirationBucket)
+	m.set(3, 0)
+	m.set(4, 1)
+	var expired []uint64
+	m.cleanup(now, func(key uint64, _ int64) {
+		expired = append(expired, key)
+	})
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	if len(expired) != 2 || expired[0] != 1 || expired[1] != 4 {
+		t.Fatal("cleanup should only remove the expired keys")
+	}
+	if m.len() != 1 || m.get(2) == 0 || len(m.buckets) != 1 {
+		t.Fatal("cleanup should keep the keys that haven't expired")
+	}
+	m.cleanup(now+2*expirationBucket, func(key uint64, _ int64) {
+		expired = append(expired, key)
+	})
+	if len(expired) != 3 || expired[2] != 2 || m.len() != 0 ||
+		len(m.buckets) != 0 {
+		t.Fatal("cleanup should remove keys once they expire")
+	}
 }
 
 func TestSampledLFUAdd(t *testing.T) {
@@ -224,6 +446,20 @@ func TestSampledLFURoom(t *testing.T) {
 	}
 }
 
+func TestSampledLFUMaxItems(t *testing.T) {
+	e := newSampledLFU(16)
+	e.maxItems = 3
+	e.add(1, 1)
+	e.add(2, 2)
+	if e.roomLeft(1) != 12 {
+		t.Fatal("roomLeft should be the cost left below maxItems keys")
+	}
+	e.add(3, 3)
+	if e.roomLeft(1) >= 0 {
+		t.Fatal("roomLeft should be negative with maxItems keys")
+	}
+}
+
 func TestSampledLFUSample(t *testing.T) {
 	e := newSampledLFU(16)
 	e.add(4, 4)
@@ -18,6 +18,7 @@ package ristretto
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 // ringConsumer is the user-defined object responsible for receiving and
@@ -31,6 +32,8 @@ type ringStripe struct {
 	cons ringConsumer
 	data []uint64
 	capa int
+	// id is the order in which the pool allocated the stripe
+	id uint64
 }
 
 func newRingStripe(cons ringConsumer, capa int64) *ringStripe {
@@ -47,12 +50,20 @@ func (s *ringStripe) Push(item uint64) {
 	s.data = append(s.data, item)
 	// if we should drain
 	if len(s.data) >= s.capa {
-		// Send elements to consumer. Create a new one.
-		if s.cons.Push(s.data) {
-			s.data = make([]uint64, 0, s.capa)
-		} else {
-			s.data = s.data[:0]
-		}
+		s.drain()
+	}
+}
+
+// drain sends the buffered items to the Consumer.
+func (s *ringStripe) drain() {
+	if len(s.data) == 0 {
+		return
+	}
+	// Send elements to consumer. Create a new one.
+	if s.cons.Push(s.data) {
+		s.data = make([]uint64, 0, s.capa)
+	} else {
+		s.data = s.data[:0]
 	}
 }
 
@@ -64,6 +75,8 @@ func (s *ringStripe) Push(item uint64) {
 type ringBuffer struct {
 	stripes []*ringStripe
 	pool    *sync.Pool
+	// allocs is the number of stripes allocated by the pool so far
+	allocs uint64
 }
 
 // newRingBuffer returns a striped ring buffer. The Consumer in ringConfig will
@@ -75,11 +88,15 @@ func newRingBuffer(cons ringConsumer, capa int64) *ringBuffer {
 	// percentage of elements lost. The performance primarily comes from
 	// low-level runtime functions used in the standard library that aren't
 	// available to us (such as runtime_procPin()).
-	return &ringBuffer{
-		pool: &sync.Pool{
-			New: func() interface{} { return newRingStripe(cons, capa) },
+	b := &ringBuffer{}
+	b.pool = &sync.Pool{
+		New: func() interface{} {
+			stripe := newRingStripe(cons, capa)
+			stripe.id = atomic.AddUint64(&b.allocs, 1)
+			return stripe
 		},
 	}
+	return b
 }
 
 // Push adds an element to one of the internal stripes and possibly drains if
@@ -90,3 +107,35 @@ func (b *ringBuffer) Push(item uint64) {
 	stripe.Push(item)
 	b.pool.Put(stripe)
 }
+
+// PushMany adds all elements to a single stripe, so a batch of accesses only
+// takes one stripe from the pool.
+func (b *ringBuffer) PushMany(items []uint64) {
+	stripe := b.pool.Get().(*ringStripe)
+	for _, item := range items {
+		stripe.Push(item)
+	}
+	b.pool.Put(stripe)
+}
+
+// Flush drains the stripes currently held by the pool, regardless of how full
+// they are. This is best-effort: stripes in use by concurrent Pushes, or cached
+// privately by other Ps in the pool, aren't reached.
+func (b *ringBuffer) Flush() {
+	last := atomic.LoadUint64(&b.allocs)
+	stripes := make([]*ringStripe, 0)
+	for {
+		stripe := b.pool.Get().(*ringStripe)
+		// a stripe allocated during this call means the pool had nothing left
+		// to hand out, so it's dropped instead of growing the pool on every
+		// Flush
+		if stripe.id > last {
+			break
+		}
+		stripe.drain()
+		stripes = append(stripes, stripe)
+	}
+	for _, stripe := range stripes {
+		b.pool.Put(stripe)
+	}
+}
@@ -71,3 +71,61 @@ func TestRingConsumer(t *testing.T) {
 		t.Fatal("drains not being processed correctly")
 	}
 }
+
+func TestRingFlush(t *testing.T) {
+	drained := 0
+	r := newRingBuffer(&testConsumer{
+		push: func(items []uint64) {
+			drained += len(items)
+		},
+		save: true,
+	}, 64)
+	r.Push(1)
+	if drained != 0 {
+		t.Fatal("stripe shouldn't drain before it's full")
+	}
+	// the pool may drop stripes (always a possibility with -race), so retry
+	for i := 0; i < 100 && drained == 0; i++ {
+		r.Push(uint64(i))
+		r.Flush()
+	}
+	if drained == 0 {
+		t.Fatal("flush didn't drain stripe")
+	}
+}
+
+func TestRingPushMany(t *testing.T) {
+	drains := 0
+	r := newRingBuffer(&testConsumer{
+		push: func(items []uint64) {
+			drains++
+		},
+		save: true,
+	}, 2)
+	r.PushMany([]uint64{1, 2, 3, 4})
+	if drains != 2 {
+		t.Fatal("push many should drain the stripe whenever it's full")
+	}
+}
+
+func TestRingFlushTwice(t *testing.T) {
+	drained := 0
+	// the pool may drop stripes (always a possibility with -race), so retry
+	for i := 0; i < 100 && drained == 0; i++ {
+		r := newRingBuffer(&testConsumer{
+			push: func(items []uint64) {
+				drained += len(items)
+			},
+			save: true,
+		}, 64)
+		// a Push still holding its stripe while the first Flush runs
+		stripe := r.pool.Get().(*ringStripe)
+		stripe.Push(1)
+		r.Flush()
+		r.pool.Put(stripe)
+		r.Flush()
+	}
+	if drained == 0 {
+		t.Fatal("empty stripe from the first flush stopped the second one")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ristrettoprom exports the Metrics of Ristretto caches to
+// Prometheus. It's a module of its own, so the core package doesn't depend on
+// the Prometheus client.
+package ristrettoprom
+
+import (
+	"github.com/dgraph-io/ristretto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counter is a Metrics counter exported by the Collector.
+type counter struct {
+	name string
+	help string
+	get  func(*ristretto.Metrics) uint64
+}
+
+var counters = []counter{
+	{"hits_total", "Number of Get calls where a value was found.",
+		(*ristretto.Metrics).Hits},
+	{"misses_total", "Number of Get calls where a value wasn't found.",
+		(*ristretto.Metrics).Misses},
+	{"stale_hits_total", "Number of Get calls served by the shadow of ClearWithShadow.",
+		(*ristretto.Metrics).StaleHits},
+	{"keys_added_total", "Number of keys added to the cache.",
+		(*ristretto.Metrics).KeysAdded},
+	{"keys_updated_total", "Number of key updates.",
+		(*ristretto.Metrics).KeysUpdated},
+	{"keys_evicted_total", "Number of keys evicted from the cache.",
+		(*ristretto.Metrics).KeysEvicted},
+	{"cost_added_total", "Sum of the costs of the keys added.",
+		(*ristretto.Metrics).CostAdded},
+	{"cost_evicted_total", "Sum of the costs of the keys evicted.",
+		(*ristretto.Metrics).CostEvicted},
+	{"sets_dropped_total", "Number of Sets dropped because the Set buffer was full.",
+		(*ristretto.Metrics).SetsDropped},
+	{"sets_rejected_total", "Number of Sets rejected by the admission policy.",
+		(*ristretto.Metrics).SetsRejected},
+	{"sets_rejected_on_clear_total", "Number of Sets rejected because the cache was being cleared.",
+		(*ristretto.Metrics).SetsRejectedOnClear},
+	{"sets_rejected_oversize_total", "Number of Sets rejected for exceeding the maximum cost of an item.",
+		(*ristretto.Metrics).SetsRejectedOversize},
+	{"callback_panics_total", "Number of panics recovered from callbacks.",
+		(*ristretto.Metrics).CallbackPanics},
+	{"gets_dropped_total", "Number of Get accesses dropped before reaching the policy.",
+		(*ristretto.Metrics).GetsDropped},
+	{"gets_kept_total", "Number of Get accesses passed on to the policy.",
+		(*ristretto.Metrics).GetsKept},
+	{"evictions_dropped_total", "Number of evictions not passed to an asynchronous OnEvict.",
+		(*ristretto.Metrics).EvictionsDropped},
+	{"mirrors_dropped_total", "Number of Sets and Dels not forwarded to the mirror.",
+		(*ristretto.Metrics).MirrorsDropped},
+	{"cost_throughput_total", "Sum of the costs of all Sets processed, admitted or not.",
+		(*ristretto.Metrics).ThroughputCost},
+}
+
+// Collector is a prometheus.Collector exporting the counters of a cache's
+// Metrics, along with its hit ratio as a gauge. Metric names are prefixed by
+// the namespace (e.g. "ristretto" turns hits into ristretto_hits_total), and
+// multiple caches can be registered with the same namespace by telling them
+// apart with distinct const labels.
+type Collector struct {
+	metrics *ristretto.Metrics
+	descs   []*prometheus.Desc
+	ratio   *prometheus.Desc
+}
+
+// NewCollector returns a Collector for the metrics of a cache created with
+// Config.Metrics set (a nil *Metrics exports zeros).
+func NewCollector(metrics *ristretto.Metrics, namespace string,
+	constLabels prometheus.Labels) *Collector {
+	c := &Collector{
+		metrics: metrics,
+		descs:   make([]*prometheus.Desc, len(counters)),
+		ratio: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "hit_ratio"),
+			"Ratio of hits to Get calls.", nil, constLabels),
+	}
+	for i, counter := range counters {
+		c.descs[i] = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", counter.name),
+			counter.help, nil, constLabels)
+	}
+	return c
+}
+
+// Describe sends the descriptors of every metric to ch.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+	ch <- c.ratio
+}
+
+// Collect sends the current value of every metric to ch.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for i, counter := range counters {
+		ch <- prometheus.MustNewConstMetric(c.descs[i],
+			prometheus.CounterValue, float64(counter.get(c.metrics)))
+	}
+	ch <- prometheus.MustNewConstMetric(c.ratio, prometheus.GaugeValue,
+		c.metrics.Ratio())
+}
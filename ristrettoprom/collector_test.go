@@ -0,0 +1,81 @@
+package ristrettoprom
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	newCache := func() *ristretto.Cache {
+		c, err := ristretto.NewCache(&ristretto.Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+			Metrics:     true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return c
+	}
+	a, b := newCache(), newCache()
+	a.Set(1, 1, 1)
+	a.Wait()
+	a.Get(1)
+	a.Get(2)
+	registry := prometheus.NewRegistry()
+	// caches share the namespace, told apart by their labels
+	registry.MustRegister(
+		NewCollector(a.Metrics, "ristretto", prometheus.Labels{"cache": "a"}),
+		NewCollector(b.Metrics, "ristretto", prometheus.Labels{"cache": "b"}))
+	families, err := registry.Gather()
+	if err != nil {
+		panic(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() != "a" {
+				continue
+			}
+			value := metric.GetCounter().GetValue()
+			if metric.GetGauge() != nil {
+				value = metric.GetGauge().GetValue()
+			}
+			values[family.GetName()] = value
+		}
+	}
+	if len(values) != len(counters)+1 {
+		t.Fatal("collector should export every counter and the hit ratio")
+	}
+	if values["ristretto_hits_total"] != 1 ||
+		values["ristretto_misses_total"] != 1 ||
+		values["ristretto_keys_added_total"] != 1 {
+		t.Fatal("collector should export the values of the counters")
+	}
+	if values["ristretto_hit_ratio"] != 0.5 {
+		t.Fatal("collector should export the hit ratio")
+	}
+	exported := make(map[string]bool)
+	for _, c := range counters {
+		name := runtime.FuncForPC(reflect.ValueOf(c.get).Pointer()).Name()
+		exported[name[strings.LastIndex(name, ".")+1:]] = true
+	}
+	typ := reflect.TypeOf(&ristretto.Metrics{})
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		// counters are the methods taking no arguments and returning a uint64
+		if m.Type.NumIn() != 1 || m.Type.NumOut() != 1 ||
+			m.Type.Out(0).Kind() != reflect.Uint64 {
+			continue
+		}
+		if !exported[m.Name] {
+			t.Fatalf("collector should export Metrics.%s", m.Name)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+module github.com/dgraph-io/ristretto/ristrettoprom
+
+go 1.20
+
+require (
+	github.com/dgraph-io/ristretto v0.0.0-20261016120804-172ebb0b4f71
+	github.com/prometheus/client_golang v1.20.5
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+)
+
+// Development in this repository uses the ristretto package next to it. Modules
+// importing ristrettoprom ignore this and use the version required above, so it
+// must be bumped to a commit with every Metrics counter the collector exports.
+replace github.com/dgraph-io/ristretto => ../
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ristrettotest provides helpers for testing Ristretto caches and
+// tuning their configuration.
+package ristrettotest
+
+import (
+	"github.com/dgraph-io/ristretto"
+)
+
+// accessesPerKey is the number of accesses TestHitRatio runs for every key.
+const accessesPerKey = 16
+
+// TestHitRatio runs a synthetic workload against a cache created from config
+// and returns the hit ratio it achieved. The workload accesses keys at the
+// indices returned by accessPattern (which could follow a Zipfian distribution
+// generated with the sim package, for example), 16 times as many times as there
+// are keys. Every access is a Get, followed by a Set of the key (as its own
+// value) on a miss, just like a cache in front of a slower store would see.
+// Every Set is waited for (see Cache.Wait), so the result doesn't depend on
+// how quickly the buffered Sets happen to be applied.
+//
+// Keys are Set with a cost of 1, unless config.Cost or config.AutoCost is set,
+// in which case their cost is computed. Running TestHitRatio with different
+// NumCounters and MaxCost values helps picking them empirically.
+//
+// TestHitRatio panics if the cache can't be created from config.
+func TestHitRatio(config *ristretto.Config, keys []interface{},
+	accessPattern func() int) float64 {
+	cache, err := ristretto.NewCache(config)
+	if err != nil {
+		panic(err)
+	}
+	defer cache.Close()
+	cost := int64(1)
+	if config.Cost != nil || config.AutoCost {
+		cost = 0
+	}
+	var hits, total float64
+	for i := 0; i < len(keys)*accessesPerKey; i++ {
+		key := keys[accessPattern()]
+		total++
+		if _, ok := cache.Get(key); ok {
+			hits++
+			continue
+		}
+		cache.Set(key, key, cost)
+		cache.Wait()
+	}
+	if total == 0 {
+		return 0
+	}
+	return hits / total
+}
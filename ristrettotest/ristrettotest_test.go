@@ -0,0 +1,54 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristrettotest
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/sim"
+)
+
+func TestTestHitRatio(t *testing.T) {
+	keys := make([]interface{}, 1000)
+	for i := range keys {
+		keys[i] = i
+	}
+	zipf := sim.NewZipfian(1.5, 1, uint64(len(keys)-1))
+	pattern := func() int {
+		k, _ := zipf()
+		return int(k)
+	}
+	config := &ristretto.Config{
+		NumCounters: 10000,
+		MaxCost:     100,
+		BufferItems: 64,
+	}
+	ratio := TestHitRatio(config, keys, pattern)
+	if ratio <= 0 || ratio >= 1 {
+		t.Fatal("hit ratio out of range")
+	}
+	if TestHitRatio(config, nil, pattern) != 0 {
+		t.Fatal("hit ratio should be 0 without keys")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("invalid config should panic")
+		}
+	}()
+	TestHitRatio(&ristretto.Config{}, keys, pattern)
+}
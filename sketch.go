@@ -94,6 +94,25 @@ func (s *cmSketch) Clear() {
 	}
 }
 
+// Saturation returns the fraction of counters that are at their max value.
+func (s *cmSketch) Saturation() float64 {
+	saturated, total := 0, 0
+	for _, r := range s.rows {
+		saturated += r.saturated()
+		total += len(r) * 2
+	}
+	return float64(saturated) / float64(total)
+}
+
+// Bytes returns the memory taken up by the counters in bytes.
+func (s *cmSketch) Bytes() int {
+	total := 0
+	for _, r := range s.rows {
+		total += len(r)
+	}
+	return total
+}
+
 // cmRow is a row of bytes, with each byte holding two counters
 type cmRow []byte
 
@@ -132,6 +151,20 @@ func (r cmRow) clear() {
 	}
 }
 
+// saturated returns the number of counters at max value.
+func (r cmRow) saturated() int {
+	n := 0
+	for _, b := range r {
+		if b&0x0f == 0x0f {
+			n++
+		}
+		if b&0xf0 == 0xf0 {
+			n++
+		}
+	}
+	return n
+}
+
 func (r cmRow) string() string {
 	s := ""
 	for i := uint64(0); i < uint64(len(r)*2); i++ {
@@ -56,6 +56,20 @@ func TestSketchReset(t *testing.T) {
 	}
 }
 
+func TestSketchSaturation(t *testing.T) {
+	s := newCmSketch(16)
+	if s.Saturation() != 0 {
+		t.Fatal("saturation of new sketch should be 0")
+	}
+	for i := 0; i < 20; i++ {
+		s.Increment(1)
+	}
+	// one counter out of 16 in each row
+	if s.Saturation() != 1.0/16 {
+		t.Fatal("saturation returned wrong value")
+	}
+}
+
 func TestSketchClear(t *testing.T) {
 	s := newCmSketch(16)
 	for i := 0; i < 16; i++ {
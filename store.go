@@ -17,15 +17,38 @@
 package ristretto
 
 import (
+	"bytes"
+	"reflect"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/ristretto/z"
 )
 
+// storeItemOverhead is a rough estimate of the bytes used per item by the
+// store: a storeItem without the values its fields point to, its key in the map
+// and the overhead of the map buckets.
+const storeItemOverhead = 100
+
 type storeItem struct {
 	keyHash uint64
 	hashes  []uint64
-	value   interface{}
+	// key is the original key, only retained if the store was created with
+	// storeKeys set
+	key   interface{}
+	value interface{}
+	// updated is the UnixNano time the value was last set
+	updated int64
+	// expiration is the UnixNano time the item expires at, or 0 if it never
+	// does
+	expiration int64
+}
+
+// expired returns true if the item has an expiration that's before now.
+func (i *storeItem) expired(now int64) bool {
+	return i.expiration != 0 && now >= i.expiration
 }
 
 // store is the interface fulfilled by all hash map implementations in this
@@ -35,23 +58,73 @@ type storeItem struct {
 //
 // Every store is safe for concurrent usage.
 type store interface {
-	// Get returns the value associated with the key parameter.
+	// Get returns the value associated with the key parameter. Expired items
+	// are never returned.
 	Get(uint64, interface{}) (interface{}, bool)
-	// Set adds the key-value pair to the Map or updates the value if it's
-	// already present.
-	Set(uint64, interface{}, interface{})
-	// Del deletes the key-value pair from the Map.
-	Del(uint64, interface{})
-	// Update attempts to update the key with a new value and returns true if
-	// successful.
-	Update(uint64, interface{}, interface{}) bool
+	// GetItem returns the storeItem (with the value and its metadata)
+	// associated with the key parameter.
+	GetItem(uint64, interface{}) (storeItem, bool)
+	// GetMany returns the values associated with every key parameter (and its
+	// hash at the same index), and whether each was found, as of a single
+	// point in time: no write to any of the keys can interleave. Unless the
+	// deadline is zero, it gives up and returns false if the keys can't all be
+	// locked by then.
+	GetMany([]uint64, []interface{}, time.Time) ([]interface{}, []bool, bool)
+	// Set adds the key-value pair, with its expiration time (0 for none), to
+	// the Map or updates the value if it's already present.
+	Set(uint64, interface{}, interface{}, int64)
+	// SetIfAbsent adds the key-value pair like Set, but only if the key isn't
+	// present (or has expired), atomically. It returns true if it was added.
+	// A different key with the same hash counts as present.
+	SetIfAbsent(uint64, interface{}, interface{}, int64) bool
+	// SetItem adds a storeItem returned by GetItem or Range as is, such as
+	// when importing items whose original keys weren't kept.
+	SetItem(storeItem)
+	// Del deletes the key-value pair from the Map and returns the storeItem
+	// (even if expired) and true if it was present.
+	Del(uint64, interface{}) (storeItem, bool)
+	// DelIf deletes the key-value pair from the Map if the function returns
+	// true for its value, atomically. It returns true if the pair was deleted.
+	DelIf(uint64, interface{}, func(interface{}) bool) bool
+	// Update attempts to update the key with a new value and expiration time
+	// and returns the previous value and true if successful.
+	Update(uint64, interface{}, interface{}, int64) (interface{}, bool)
+	// Merge replaces the value and expiration time of the key with the result
+	// of calling the function on them, atomically. If the key is missing the
+	// function is called with nil and 0, and its result isn't stored. It
+	// returns the resulting value and whether the key was found.
+	Merge(uint64, interface{},
+		func(interface{}, int64) (interface{}, int64)) (interface{}, bool)
+	// MapValues replaces the value of every unexpired item with the result of
+	// calling the function on its key (if kept) and value, one shard at a time.
+	MapValues(func(interface{}, interface{}) interface{})
+	// Range calls the function for every unexpired item in the store until it
+	// returns false.
+	Range(func(storeItem) bool)
+	// Len returns the number of items in the store, including expired items
+	// that haven't been deleted yet.
+	Len() int
 	// Clear clears all contents of the store.
 	Clear()
+	// Take moves all contents of the store into a new store and returns it,
+	// leaving this one empty.
+	Take() store
+	// Optionally, count the collisions found by Get, where two different keys
+	// have the same hash. Only collisions the extra hashes (or the stored
+	// keys) can tell apart are counted.
+	CountCollisions()
+	// Collisions returns the number of collisions counted.
+	Collisions() uint64
+	// Optionally, set the function computing the extra hashes of keys (with
+	// seeds from 1) that tell keys with the same hash apart. It defaults to
+	// z.KeyToHash.
+	SetKeyToHash(func(interface{}, uint8) uint64)
 }
 
-// newStore returns the default store implementation.
-func newStore(rounds uint8) store {
-	return newShardedMap(rounds)
+// newStore returns the default store implementation. If storeKeys is true,
+// original keys are retained alongside their values.
+func newStore(rounds uint8, storeKeys bool) store {
+	return newShardedMap(rounds, storeKeys)
 }
 
 const numShards uint64 = 256
@@ -60,12 +133,12 @@ type shardedMap struct {
 	shards []*lockedMap
 }
 
-func newShardedMap(rounds uint8) *shardedMap {
+func newShardedMap(rounds uint8, storeKeys bool) *shardedMap {
 	sm := &shardedMap{
 		shards: make([]*lockedMap, int(numShards)),
 	}
 	for i := range sm.shards {
-		sm.shards[i] = newLockedMap(rounds)
+		sm.shards[i] = newLockedMap(rounds, storeKeys)
 	}
 	return sm
 }
@@ -74,16 +147,114 @@ func (sm *shardedMap) Get(hashed uint64, key interface{}) (interface{}, bool) {
 	return sm.shards[hashed%numShards].Get(hashed, key)
 }
 
-func (sm *shardedMap) Set(hashed uint64, key, value interface{}) {
-	sm.shards[hashed%numShards].Set(hashed, key, value)
+func (sm *shardedMap) GetItem(hashed uint64, key interface{}) (storeItem, bool) {
+	return sm.shards[hashed%numShards].GetItem(hashed, key)
+}
+
+// GetMany read locks every shard holding one of the keys at once, in shard
+// order so concurrent calls can't deadlock.
+func (sm *shardedMap) GetMany(hashes []uint64, keys []interface{},
+	deadline time.Time) ([]interface{}, []bool, bool) {
+	var locked [numShards]bool
+	for _, hashed := range hashes {
+		locked[hashed%numShards] = true
+	}
+	for i := range locked {
+		if !locked[i] {
+			continue
+		}
+		if deadline.IsZero() {
+			sm.shards[i].RLock()
+			continue
+		}
+		for !sm.shards[i].TryRLock() {
+			if time.Now().After(deadline) {
+				sm.runlock(locked[:i])
+				return nil, nil, false
+			}
+			runtime.Gosched()
+		}
+	}
+	items, found := make([]storeItem, len(keys)), make([]bool, len(keys))
+	for i, hashed := range hashes {
+		items[i], found[i] = sm.shards[hashed%numShards].data[hashed]
+	}
+	sm.runlock(locked[:])
+	// the checks don't need the locks, as they work on copies of the items
+	values := make([]interface{}, len(keys))
+	for i, hashed := range hashes {
+		shard := sm.shards[hashed%numShards]
+		item, ok := shard.checkItem(items[i], found[i], keys[i])
+		values[i], found[i] = item.value, ok
+	}
+	return values, found, true
+}
+
+// runlock read unlocks the shards flagged in locked.
+func (sm *shardedMap) runlock(locked []bool) {
+	for i := range locked {
+		if locked[i] {
+			sm.shards[i].RUnlock()
+		}
+	}
+}
+
+func (sm *shardedMap) Set(hashed uint64, key, value interface{}, expiration int64) {
+	sm.shards[hashed%numShards].Set(hashed, key, value, expiration)
 }
 
-func (sm *shardedMap) Del(hashed uint64, key interface{}) {
-	sm.shards[hashed%numShards].Del(hashed, key)
+func (sm *shardedMap) SetIfAbsent(hashed uint64, key, value interface{},
+	expiration int64) bool {
+	return sm.shards[hashed%numShards].SetIfAbsent(hashed, key, value, expiration)
+}
+
+func (sm *shardedMap) SetItem(item storeItem) {
+	sm.shards[item.keyHash%numShards].SetItem(item)
+}
+
+func (sm *shardedMap) Del(hashed uint64, key interface{}) (storeItem, bool) {
+	return sm.shards[hashed%numShards].Del(hashed, key)
+}
+
+func (sm *shardedMap) DelIf(hashed uint64, key interface{},
+	fn func(interface{}) bool) bool {
+	return sm.shards[hashed%numShards].DelIf(hashed, key, fn)
+}
+
+func (sm *shardedMap) Merge(hashed uint64, key interface{},
+	fn func(interface{}, int64) (interface{}, int64)) (interface{}, bool) {
+	return sm.shards[hashed%numShards].Merge(hashed, key, fn)
+}
+
+func (sm *shardedMap) Update(hashed uint64, key, value interface{},
+	expiration int64) (interface{}, bool) {
+	return sm.shards[hashed%numShards].Update(hashed, key, value, expiration)
+}
+
+func (sm *shardedMap) MapValues(fn func(interface{}, interface{}) interface{}) {
+	for i := range sm.shards {
+		sm.shards[i].MapValues(fn)
+	}
+}
+
+// Range iterates the shards one at a time, so it's not a consistent view of the
+// whole store under concurrent modification.
+func (sm *shardedMap) Range(fn func(storeItem) bool) {
+	for i := uint64(0); i < numShards; i++ {
+		if !sm.shards[i].Range(fn) {
+			return
+		}
+	}
 }
 
-func (sm *shardedMap) Update(hashed uint64, key, value interface{}) bool {
-	return sm.shards[hashed%numShards].Update(hashed, key, value)
+// Len sums the lengths of the shards one at a time, so it's not a consistent
+// view of the store if it's modified concurrently.
+func (sm *shardedMap) Len() int {
+	n := 0
+	for i := uint64(0); i < numShards; i++ {
+		n += sm.shards[i].Len()
+	}
+	return n
 }
 
 func (sm *shardedMap) Clear() {
@@ -92,113 +263,354 @@ func (sm *shardedMap) Clear() {
 	}
 }
 
+func (sm *shardedMap) CountCollisions() {
+	collisions := new(uint64)
+	for i := range sm.shards {
+		sm.shards[i].Lock()
+		sm.shards[i].collisions = collisions
+		sm.shards[i].Unlock()
+	}
+}
+
+func (sm *shardedMap) SetKeyToHash(keyToHash func(interface{}, uint8) uint64) {
+	for i := range sm.shards {
+		sm.shards[i].Lock()
+		sm.shards[i].keyToHash = keyToHash
+		sm.shards[i].Unlock()
+	}
+}
+
+func (sm *shardedMap) Collisions() uint64 {
+	// every shard shares the same counter
+	if collisions := sm.shards[0].collisions; collisions != nil {
+		return atomic.LoadUint64(collisions)
+	}
+	return 0
+}
+
+func (sm *shardedMap) Take() store {
+	taken := &shardedMap{
+		shards: make([]*lockedMap, int(numShards)),
+	}
+	for i := range sm.shards {
+		taken.shards[i] = sm.shards[i].Take()
+	}
+	return taken
+}
+
+// lockedMap is a single shard of the shardedMap. Reads only take the read lock
+// and do the collision checks on a copy of the item after releasing it, so
+// concurrent Gets of the same shard don't block each other.
 type lockedMap struct {
 	sync.RWMutex
-	data   map[uint64]storeItem
-	rounds uint8
+	data      map[uint64]storeItem
+	rounds    uint8
+	storeKeys bool
+	// collisions, if not nil, counts the collisions found by Get. It's shared
+	// by all shards.
+	collisions *uint64
+	// keyToHash computes the extra hashes of keys
+	keyToHash func(interface{}, uint8) uint64
 }
 
-func newLockedMap(rounds uint8) *lockedMap {
+func newLockedMap(rounds uint8, storeKeys bool) *lockedMap {
 	return &lockedMap{
-		data:   make(map[uint64]storeItem),
-		rounds: rounds,
+		data:      make(map[uint64]storeItem),
+		rounds:    rounds,
+		storeKeys: storeKeys,
+		keyToHash: z.KeyToHash,
 	}
 }
 
 func (m *lockedMap) Get(keyHash uint64, key interface{}) (interface{}, bool) {
+	item, ok := m.GetItem(keyHash, key)
+	return item.value, ok
+}
+
+func (m *lockedMap) GetItem(keyHash uint64, key interface{}) (storeItem, bool) {
 	m.RLock()
 	item, ok := m.data[keyHash]
 	m.RUnlock()
-	if !ok {
-		return nil, false
+	return m.checkItem(item, ok, key)
+}
+
+// checkItem returns the item looked up for the key if it was found, isn't
+// expired and passes the collision checks. It doesn't need the lock.
+func (m *lockedMap) checkItem(item storeItem, ok bool,
+	key interface{}) (storeItem, bool) {
+	if !ok || (item.expiration != 0 && item.expired(time.Now().UnixNano())) {
+		return storeItem{}, false
 	}
 	if key != nil {
 		for i := uint8(1); i < m.rounds; i++ {
-			if z.KeyToHash(key, i) != item.hashes[i-1] {
-				return nil, false
+			if m.keyToHash(key, i) != item.hashes[i-1] {
+				m.collided()
+				return storeItem{}, false
 			}
 		}
+		// only possible to tell with storeKeys, when the hashes couldn't
+		if item.key != nil && !keysEqual(key, item.key) {
+			m.collided()
+			return storeItem{}, false
+		}
 	}
-	return item.value, true
+	return item, true
 }
 
-func (m *lockedMap) Set(keyHash uint64, key, value interface{}) {
+// collided counts a collision between two keys, if collisions are counted.
+func (m *lockedMap) collided() {
+	if m.collisions != nil {
+		atomic.AddUint64(m.collisions, 1)
+	}
+}
+
+// keysEqual compares two keys of any of the types supported by z.KeyToHash.
+// Keys of other types (with a custom KeyToHash) that can't be compared with ==,
+// such as slices, are assumed to be equal, so only their hashes tell them
+// apart.
+func keysEqual(a, b interface{}) bool {
+	if x, ok := a.([]byte); ok {
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	}
+	if _, ok := b.([]byte); ok {
+		return false
+	}
+	t := reflect.TypeOf(a)
+	if t != reflect.TypeOf(b) {
+		return false
+	}
+	if !t.Comparable() {
+		return true
+	}
+	return a == b
+}
+
+func (m *lockedMap) SetIfAbsent(keyHash uint64, key, value interface{},
+	expiration int64) bool {
+	now := time.Now().UnixNano()
+	m.Lock()
+	defer m.Unlock()
+	if item, ok := m.data[keyHash]; ok && !item.expired(now) {
+		return false
+	}
+	hashes := make([]uint64, m.rounds)
+	for i := uint8(1); i < m.rounds; i++ {
+		hashes[i-1] = m.keyToHash(key, i)
+	}
+	m.data[keyHash] = storeItem{
+		keyHash:    keyHash,
+		hashes:     hashes,
+		key:        m.keep(key),
+		value:      value,
+		updated:    now,
+		expiration: expiration,
+	}
+	return true
+}
+
+func (m *lockedMap) SetItem(item storeItem) {
+	m.Lock()
+	m.data[item.keyHash] = item
+	m.Unlock()
+}
+
+func (m *lockedMap) Set(keyHash uint64, key, value interface{}, expiration int64) {
+	now := time.Now().UnixNano()
+	// hash before locking, so a panicking KeyToHash can't leave the shard
+	// locked
+	hashes := make([]uint64, m.rounds)
+	for i := uint8(1); i < m.rounds; i++ {
+		hashes[i-1] = m.keyToHash(key, i)
+	}
 	m.Lock()
 	item, ok := m.data[keyHash]
 	if !ok {
-		hashes := make([]uint64, m.rounds)
-		for i := uint8(1); i < m.rounds; i++ {
-			hashes[i-1] = z.KeyToHash(key, i)
-		}
 		m.data[keyHash] = storeItem{
-			keyHash: keyHash,
-			hashes:  hashes,
-			value:   value,
+			keyHash:    keyHash,
+			hashes:     hashes,
+			key:        m.keep(key),
+			value:      value,
+			updated:    now,
+			expiration: expiration,
 		}
 		m.Unlock()
 		return
 	}
 	if key != nil {
 		for i := uint8(1); i < m.rounds; i++ {
-			if z.KeyToHash(key, i) != item.hashes[i-1] {
+			if hashes[i-1] != item.hashes[i-1] {
 				m.Unlock()
 				return
 			}
 		}
 	}
 	m.data[keyHash] = storeItem{
-		keyHash: keyHash,
-		hashes:  item.hashes,
-		value:   value,
+		keyHash:    keyHash,
+		hashes:     item.hashes,
+		key:        item.key,
+		value:      value,
+		updated:    now,
+		expiration: expiration,
 	}
 	m.Unlock()
 }
 
-func (m *lockedMap) Del(keyHash uint64, key interface{}) {
+func (m *lockedMap) Del(keyHash uint64, key interface{}) (storeItem, bool) {
 	m.Lock()
 	item, ok := m.data[keyHash]
 	if !ok {
 		m.Unlock()
-		return
+		return storeItem{}, false
 	}
 	if key != nil {
 		for i := uint8(1); i < m.rounds; i++ {
-			if z.KeyToHash(key, i) != item.hashes[i-1] {
+			if m.keyToHash(key, i) != item.hashes[i-1] {
 				m.Unlock()
-				return
+				return storeItem{}, false
 			}
 		}
 	}
 	delete(m.data, keyHash)
 	m.Unlock()
+	return item, true
 }
 
-func (m *lockedMap) Update(keyHash uint64, key, value interface{}) bool {
+func (m *lockedMap) DelIf(keyHash uint64, key interface{},
+	fn func(interface{}) bool) bool {
 	m.Lock()
+	defer m.Unlock()
 	item, ok := m.data[keyHash]
 	if !ok {
-		m.Unlock()
 		return false
 	}
 	if key != nil {
 		for i := uint8(1); i < m.rounds; i++ {
-			if z.KeyToHash(key, i) != item.hashes[i-1] {
-				m.Unlock()
+			if m.keyToHash(key, i) != item.hashes[i-1] {
 				return false
 			}
 		}
 	}
+	if !fn(item.value) {
+		return false
+	}
+	delete(m.data, keyHash)
+	return true
+}
+
+func (m *lockedMap) Update(keyHash uint64, key, value interface{},
+	expiration int64) (interface{}, bool) {
+	now := time.Now().UnixNano()
+	m.Lock()
+	item, ok := m.data[keyHash]
+	if !ok {
+		m.Unlock()
+		return nil, false
+	}
+	if key != nil {
+		for i := uint8(1); i < m.rounds; i++ {
+			if m.keyToHash(key, i) != item.hashes[i-1] {
+				m.Unlock()
+				return nil, false
+			}
+		}
+	}
 	m.data[keyHash] = storeItem{
-		keyHash: keyHash,
-		hashes:  item.hashes,
-		value:   value,
+		keyHash:    keyHash,
+		hashes:     item.hashes,
+		key:        item.key,
+		value:      value,
+		updated:    now,
+		expiration: expiration,
 	}
 	m.Unlock()
+	return item.value, true
+}
+
+// keep returns the key to retain in a storeItem.
+func (m *lockedMap) keep(key interface{}) interface{} {
+	if m.storeKeys {
+		return key
+	}
+	return nil
+}
+
+func (m *lockedMap) MapValues(fn func(interface{}, interface{}) interface{}) {
+	now := time.Now().UnixNano()
+	m.Lock()
+	defer m.Unlock()
+	for keyHash, item := range m.data {
+		if item.expired(now) {
+			continue
+		}
+		item.value = fn(item.key, item.value)
+		m.data[keyHash] = item
+	}
+}
+
+func (m *lockedMap) Range(fn func(storeItem) bool) bool {
+	now := time.Now().UnixNano()
+	m.RLock()
+	defer m.RUnlock()
+	for _, item := range m.data {
+		if item.expired(now) {
+			continue
+		}
+		if !fn(item) {
+			return false
+		}
+	}
 	return true
 }
 
+func (m *lockedMap) Len() int {
+	m.RLock()
+	n := len(m.data)
+	m.RUnlock()
+	return n
+}
+
 func (m *lockedMap) Clear() {
 	m.Lock()
 	m.data = make(map[uint64]storeItem)
 	m.Unlock()
 }
+
+// Take moves the contents of the map into a new lockedMap and returns it.
+func (m *lockedMap) Take() *lockedMap {
+	m.Lock()
+	taken := &lockedMap{
+		data:       m.data,
+		rounds:     m.rounds,
+		storeKeys:  m.storeKeys,
+		collisions: m.collisions,
+		keyToHash:  m.keyToHash,
+	}
+	m.data = make(map[uint64]storeItem)
+	m.Unlock()
+	return taken
+}
+
+func (m *lockedMap) Merge(keyHash uint64, key interface{},
+	fn func(interface{}, int64) (interface{}, int64)) (interface{}, bool) {
+	now := time.Now().UnixNano()
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data[keyHash]
+	if ok && key != nil {
+		for i := uint8(1); i < m.rounds; i++ {
+			if m.keyToHash(key, i) != item.hashes[i-1] {
+				ok = false
+				break
+			}
+		}
+	}
+	if !ok || item.expired(now) {
+		value, _ := fn(nil, 0)
+		return value, false
+	}
+	item.value, item.expiration = fn(item.value, item.expiration)
+	item.updated = now
+	m.data[keyHash] = item
+	return item.value, true
+}
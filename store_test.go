@@ -2,31 +2,125 @@ package ristretto
 
 import (
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/ristretto/z"
 )
 
 func TestStoreSetGet(t *testing.T) {
-	s := newStore(2)
+	s := newStore(2, false)
 	hashed := z.KeyToHash(1, 0)
-	s.Set(hashed, 1, 2)
+	s.Set(hashed, 1, 2, 0)
 	if val, ok := s.Get(hashed, 1); (val == nil || !ok) || val.(int) != 2 {
 		t.Fatal("set/get error")
 	}
-	s.Set(hashed, 1, 3)
+	s.Set(hashed, 1, 3, 0)
 	if val, ok := s.Get(hashed, 1); (val == nil || !ok) || val.(int) != 3 {
 		t.Fatal("set/get overwrite error")
 	}
-	s.Set(z.KeyToHash(2, 0), nil, 2)
+	s.Set(z.KeyToHash(2, 0), nil, 2, 0)
 	if val, ok := s.Get(z.KeyToHash(2, 0), nil); !ok || val.(int) != 2 {
 		t.Fatal("set/get nil key error")
 	}
 }
 
+func TestStoreGetItem(t *testing.T) {
+	s := newStore(2, false)
+	hashed := z.KeyToHash(1, 0)
+	if _, ok := s.GetItem(hashed, 1); ok {
+		t.Fatal("get item should fail for missing key")
+	}
+	before := time.Now().UnixNano()
+	s.Set(hashed, 1, 2, 0)
+	item, ok := s.GetItem(hashed, 1)
+	if !ok || item.value.(int) != 2 || item.updated < before {
+		t.Fatal("get item returned wrong item")
+	}
+	s.Update(hashed, 1, 3, 0)
+	if updated, _ := s.GetItem(hashed, 1); updated.updated < item.updated {
+		t.Fatal("update didn't refresh the updated time")
+	}
+}
+
+func TestStoreGetMany(t *testing.T) {
+	s := newStore(2, false)
+	keys := []interface{}{1, 2, 3}
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i] = z.KeyToHash(key, 0)
+	}
+	s.Set(hashes[0], 1, 1, 0)
+	s.Set(hashes[2], 3, 3, time.Now().Add(-time.Second).UnixNano())
+	values, found, ok := s.GetMany(hashes, keys, time.Time{})
+	if !ok || !found[0] || values[0].(int) != 1 || found[1] || found[2] {
+		t.Fatal("get many returned wrong values")
+	}
+	// a shard locked for writing past the deadline makes it give up
+	shard := s.(*shardedMap).shards[hashes[1]%numShards]
+	shard.Lock()
+	if _, _, ok := s.GetMany(hashes, keys, time.Now().Add(wait)); ok {
+		t.Fatal("get many should give up at the deadline")
+	}
+	shard.Unlock()
+	if _, _, ok := s.GetMany(hashes, keys, time.Now().Add(wait)); !ok {
+		t.Fatal("get many should release the shards it locked when giving up")
+	}
+}
+
+func TestStoreMerge(t *testing.T) {
+	s := newStore(2, false)
+	hashed := z.KeyToHash(1, 0)
+	value, found := s.Merge(hashed, 1,
+		func(existing interface{}, expiration int64) (interface{}, int64) {
+			if existing != nil || expiration != 0 {
+				t.Fatal("merge should pass nil for a missing key")
+			}
+			return 1, 0
+		})
+	if found || value.(int) != 1 {
+		t.Fatal("merge of a missing key returned wrong result")
+	}
+	if _, ok := s.Get(hashed, 1); ok {
+		t.Fatal("merge shouldn't store a missing key")
+	}
+	expiration := time.Now().Add(time.Hour).UnixNano()
+	s.Set(hashed, 1, 2, expiration)
+	value, found = s.Merge(hashed, 1,
+		func(existing interface{}, current int64) (interface{}, int64) {
+			if current != expiration {
+				t.Fatal("merge should pass the current expiration")
+			}
+			return existing.(int) * 3, 0
+		})
+	if stored, _ := s.Get(hashed, 1); !found || value.(int) != 6 || stored.(int) != 6 {
+		t.Fatal("merge didn't store the merged value")
+	}
+	if item, _ := s.GetItem(hashed, 1); item.expiration != 0 {
+		t.Fatal("merge didn't store the merged expiration")
+	}
+}
+
+func TestStoreExpiration(t *testing.T) {
+	s := newStore(2, false)
+	hashed := z.KeyToHash(1, 0)
+	s.Set(hashed, 1, 1, time.Now().Add(-time.Second).UnixNano())
+	if _, ok := s.Get(hashed, 1); ok {
+		t.Fatal("get shouldn't return an expired item")
+	}
+	s.Range(func(storeItem) bool {
+		t.Fatal("range shouldn't pass expired items")
+		return false
+	})
+	s.Update(hashed, 1, 2, time.Now().Add(time.Hour).UnixNano())
+	if value, ok := s.Get(hashed, 1); !ok || value.(int) != 2 {
+		t.Fatal("get should return an unexpired item")
+	}
+}
+
 func TestStoreDel(t *testing.T) {
-	s := newStore(2)
+	s := newStore(2, false)
 	hashed := z.KeyToHash(1, 0)
-	s.Set(hashed, 1, 1)
+	s.Set(hashed, 1, 1, 0)
 	s.Del(hashed, 1)
 	if val, ok := s.Get(hashed, 1); val != nil || ok {
 		t.Fatal("del error")
@@ -35,9 +129,9 @@ func TestStoreDel(t *testing.T) {
 }
 
 func TestStoreClear(t *testing.T) {
-	s := newStore(2)
+	s := newStore(2, false)
 	for i := uint64(0); i < 1000; i++ {
-		s.Set(z.KeyToHash(i, 0), i, i)
+		s.Set(z.KeyToHash(i, 0), i, i, 0)
 	}
 	s.Clear()
 	for i := uint64(0); i < 1000; i++ {
@@ -47,12 +141,30 @@ func TestStoreClear(t *testing.T) {
 	}
 }
 
+func TestStoreTake(t *testing.T) {
+	s := newStore(2, false)
+	for i := uint64(0); i < 1000; i++ {
+		s.Set(z.KeyToHash(i, 0), i, i, 0)
+	}
+	taken := s.Take()
+	for i := uint64(0); i < 1000; i++ {
+		if val, ok := s.Get(z.KeyToHash(i, 0), i); val != nil || ok {
+			t.Fatal("take didn't empty the store")
+		}
+		if val, ok := taken.Get(z.KeyToHash(i, 0), i); !ok || val.(uint64) != i {
+			t.Fatal("take didn't move the contents")
+		}
+	}
+}
+
 func TestStoreUpdate(t *testing.T) {
-	s := newStore(2)
+	s := newStore(2, false)
 	hashedOne := z.KeyToHash(1, 0)
-	s.Set(hashedOne, 1, 1)
-	if updated := s.Update(hashedOne, 1, 2); !updated {
+	s.Set(hashedOne, 1, 1, 0)
+	if prev, updated := s.Update(hashedOne, 1, 2, 0); !updated {
 		t.Fatal("value should have been updated")
+	} else if prev.(int) != 1 {
+		t.Fatal("update should return the previous value")
 	}
 	if val, ok := s.Get(hashedOne, 1); val == nil || !ok {
 		t.Fatal("value was deleted")
@@ -60,14 +172,14 @@ func TestStoreUpdate(t *testing.T) {
 	if val, ok := s.Get(hashedOne, 1); val.(int) != 2 || !ok {
 		t.Fatal("value wasn't updated")
 	}
-	if !s.Update(hashedOne, nil, 3) {
+	if _, updated := s.Update(hashedOne, nil, 3, 0); !updated {
 		t.Fatal("value should have been updated")
 	}
 	if val, ok := s.Get(hashedOne, 1); val.(int) != 3 || !ok {
 		t.Fatal("value wasn't updated")
 	}
 	hashedTwo := z.KeyToHash(2, 0)
-	if updated := s.Update(hashedTwo, 2, 2); updated {
+	if _, updated := s.Update(hashedTwo, 2, 2, 0); updated {
 		t.Fatal("value should not have been updated")
 	}
 	if val, ok := s.Get(hashedTwo, 2); val != nil || ok {
@@ -75,8 +187,39 @@ func TestStoreUpdate(t *testing.T) {
 	}
 }
 
+func TestStoreRange(t *testing.T) {
+	s := newStore(2, true)
+	for i := 0; i < 10; i++ {
+		s.Set(z.KeyToHash(i, 0), i, i, 0)
+	}
+	seen := make(map[interface{}]interface{})
+	s.Range(func(item storeItem) bool {
+		seen[item.key] = item.value
+		return true
+	})
+	if len(seen) != 10 || seen[5] != 5 {
+		t.Fatal("range didn't visit all items")
+	}
+	visited := 0
+	s.Range(func(item storeItem) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatal("range didn't stop early")
+	}
+	s = newStore(2, false)
+	s.Set(z.KeyToHash(1, 0), 1, 1, 0)
+	s.Range(func(item storeItem) bool {
+		if item.key != nil {
+			t.Fatal("key retained without storeKeys")
+		}
+		return true
+	})
+}
+
 func TestStoreCollision(t *testing.T) {
-	s := newShardedMap(2)
+	s := newShardedMap(2, false)
 	s.shards[1].Lock()
 	s.shards[1].data[1] = storeItem{
 		keyHash: 1,
@@ -87,11 +230,11 @@ func TestStoreCollision(t *testing.T) {
 	if val, ok := s.Get(1, 1); val != nil || ok {
 		t.Fatal("collision should return nil")
 	}
-	s.Set(1, 1, 2)
+	s.Set(1, 1, 2, 0)
 	if val, ok := s.Get(1, 2); !ok || val == nil || val.(int) == 2 {
 		t.Fatal("collision should prevent Set update")
 	}
-	if s.Update(1, 1, 2) {
+	if _, updated := s.Update(1, 1, 2, 0); updated {
 		t.Fatal("collision should prevent Update")
 	}
 	if val, ok := s.Get(1, 2); !ok || val == nil || val.(int) == 2 {
@@ -104,9 +247,9 @@ func TestStoreCollision(t *testing.T) {
 }
 
 func BenchmarkStoreGet(b *testing.B) {
-	s := newStore(2)
+	s := newStore(2, false)
 	hashed := z.KeyToHash(1, 0)
-	s.Set(hashed, 1, 1)
+	s.Set(hashed, 1, 1, 0)
 	b.SetBytes(1)
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
@@ -116,24 +259,47 @@ func BenchmarkStoreGet(b *testing.B) {
 }
 
 func BenchmarkStoreSet(b *testing.B) {
-	s := newStore(2)
+	s := newStore(2, false)
 	hashed := z.KeyToHash(1, 0)
 	b.SetBytes(1)
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			s.Set(hashed, 1, 1)
+			s.Set(hashed, 1, 1, 0)
 		}
 	})
 }
 
 func BenchmarkStoreUpdate(b *testing.B) {
-	s := newStore(2)
+	s := newStore(2, false)
 	hashed := z.KeyToHash(1, 0)
-	s.Set(hashed, 1, 1)
+	s.Set(hashed, 1, 1, 0)
 	b.SetBytes(1)
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			s.Update(hashed, 1, 2)
+			s.Update(hashed, 1, 2, 0)
+		}
+	})
+}
+
+func BenchmarkStoreReadHeavy(b *testing.B) {
+	s := newStore(2, false)
+	// all keys land in the same shard, so Gets only scale if they can hold
+	// its lock at the same time
+	keys := make([]uint64, 16)
+	for i := range keys {
+		keys[i] = uint64(i) * numShards
+		s.Set(keys[i], nil, i, 0)
+	}
+	b.SetBytes(1)
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := keys[i%len(keys)]
+			// one write for every 15 reads
+			if i%16 == 0 {
+				s.Set(key, nil, i, 0)
+			} else {
+				s.Get(key, nil)
+			}
 		}
 	})
 }
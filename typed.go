@@ -0,0 +1,120 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"time"
+)
+
+// TypedConfig is the configuration of a TypedCache. It's a Config with typed
+// KeyToHash and Cost functions, which take precedence over the untyped ones
+// of the embedded Config when set.
+type TypedConfig[K comparable, V any] struct {
+	Config
+	// KeyToHash hashes keys, like Config.KeyToHash. It has to be set for key
+	// types not supported by the default hash function (such as structs).
+	KeyToHash func(key K, seed uint8) uint64
+	// Cost evaluates the cost of values Set with a cost of 0, like
+	// Config.Cost.
+	Cost func(value V) int64
+}
+
+// TypedCache is a Cache of values of type V keyed by keys of type K, which
+// saves the type assertions (and the panics when one is wrong) needed with the
+// untyped Cache. It delegates to an untyped Cache, which is returned by Cache
+// for everything TypedCache doesn't wrap.
+type TypedCache[K comparable, V any] struct {
+	cache *Cache
+}
+
+// NewTypedCache returns a new TypedCache instance and any configuration
+// errors, if any.
+func NewTypedCache[K comparable, V any](
+	config *TypedConfig[K, V]) (*TypedCache[K, V], error) {
+	untyped := config.Config
+	if keyToHash := config.KeyToHash; keyToHash != nil {
+		untyped.KeyToHash = func(key interface{}, seed uint8) uint64 {
+			return keyToHash(key.(K), seed)
+		}
+	}
+	if cost := config.Cost; cost != nil {
+		untyped.Cost = func(value interface{}) int64 {
+			typed, _ := value.(V)
+			return cost(typed)
+		}
+	}
+	cache, err := NewCache(&untyped)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedCache[K, V]{cache: cache}, nil
+}
+
+// Cache returns the untyped Cache the TypedCache delegates to.
+func (c *TypedCache[K, V]) Cache() *Cache {
+	if c == nil {
+		return nil
+	}
+	return c.cache
+}
+
+// Get is like Cache.Get, but returns the zero value of V when the key isn't
+// found.
+func (c *TypedCache[K, V]) Get(key K) (V, bool) {
+	value, ok := c.Cache().Get(key)
+	return typedValue[V](value), ok
+}
+
+// Set is like Cache.Set.
+func (c *TypedCache[K, V]) Set(key K, value V, cost int64) bool {
+	return c.Cache().Set(key, value, cost)
+}
+
+// SetWithTTL is like Cache.SetWithTTL.
+func (c *TypedCache[K, V]) SetWithTTL(key K, value V, cost int64,
+	ttl time.Duration) bool {
+	return c.Cache().SetWithTTL(key, value, cost, ttl)
+}
+
+// Del is like Cache.Del, but returns the zero value of V when the key isn't
+// found.
+func (c *TypedCache[K, V]) Del(key K) (V, bool) {
+	value, ok := c.Cache().Del(key)
+	return typedValue[V](value), ok
+}
+
+// Wait is like Cache.Wait.
+func (c *TypedCache[K, V]) Wait() {
+	c.Cache().Wait()
+}
+
+// Clear is like Cache.Clear.
+func (c *TypedCache[K, V]) Clear() {
+	c.Cache().Clear()
+}
+
+// Close is like Cache.Close.
+func (c *TypedCache[K, V]) Close() {
+	c.Cache().Close()
+}
+
+// typedValue returns value as a V, or the zero value of V if value is nil
+// (as returned for missing keys, or Set as the value of a nilable V).
+func typedValue[V any](value interface{}) V {
+	typed, _ := value.(V)
+	return typed
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+)
+
+func TestTypedCache(t *testing.T) {
+	c, err := NewTypedCache(&TypedConfig[string, []int]{
+		Config: Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+		},
+		Cost: func(value []int) int64 {
+			return int64(len(value))
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set("a", []int{1, 2, 3}, 0)
+	c.Wait()
+	if value, ok := c.Get("a"); !ok || len(value) != 3 {
+		t.Fatal("typed get should return the value set")
+	}
+	if c.Cache().policy.Cost(c.Cache().keyToHash("a", 0)) != 3 {
+		t.Fatal("typed cost function should be used")
+	}
+	if value, ok := c.Get("b"); ok || value != nil {
+		t.Fatal("typed get should return the zero value for missing keys")
+	}
+	if value, ok := c.Del("a"); !ok || len(value) != 3 {
+		t.Fatal("typed del should return the deleted value")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("typed del should delete the key")
+	}
+	c = nil
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("typed get should return false with nil cache")
+	}
+}
+
+func TestTypedCacheKeyToHash(t *testing.T) {
+	type key struct {
+		a, b uint32
+	}
+	c, err := NewTypedCache(&TypedConfig[key, int]{
+		Config: Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+		},
+		KeyToHash: func(k key, seed uint8) uint64 {
+			return (uint64(k.a)<<32 | uint64(k.b)) + uint64(seed)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.Set(key{1, 2}, 3, 1)
+	c.Wait()
+	if value, ok := c.Get(key{1, 2}); !ok || value != 3 {
+		t.Fatal("typed key to hash should be used")
+	}
+	if _, ok := c.Get(key{2, 1}); ok {
+		t.Fatal("typed get should miss on other keys")
+	}
+}
@@ -137,6 +137,11 @@ func (bl *Bloom) Size(sz uint64) {
 	bl.bitset = make([]uint64, sz>>6)
 }
 
+// Bytes returns the size of the bitset of the Bloom filter in bytes.
+func (bl *Bloom) Bytes() int {
+	return len(bl.bitset) * 8
+}
+
 // Clear resets the Bloom filter.
 func (bl *Bloom) Clear() {
 	for i := range bl.bitset {